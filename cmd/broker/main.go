@@ -1,24 +1,82 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/IgorLem99/simple_broker/internal/broker"
 	"github.com/IgorLem99/simple_broker/internal/config"
 	"github.com/IgorLem99/simple_broker/internal/server"
+	"github.com/IgorLem99/simple_broker/internal/server/mqtt"
+	"github.com/IgorLem99/simple_broker/internal/server/stomp"
+	"github.com/IgorLem99/simple_broker/internal/server/tcp"
 )
 
+// listener is a server of one of the protocols the broker speaks.
+type listener struct {
+	name string
+	addr string
+	srv  interface {
+		Start() error
+		Shutdown(ctx context.Context) error
+	}
+}
+
 func main() {
 	cfg, err := config.Load("config.json")
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
-	b := broker.New(cfg)
+	b, err := broker.New(cfg)
+	if err != nil {
+		log.Fatalf("failed to create broker: %v", err)
+	}
 	srv := server.New(cfg.Addr, b)
 
-	log.Printf("starting server on %s", cfg.Addr)
-	if err := srv.Start(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	servers := []listener{{"HTTP", cfg.Addr, srv}}
+	if cfg.TCPAddr != "" {
+		servers = append(servers, listener{"TCP", cfg.TCPAddr, tcp.New(cfg.TCPAddr, b)})
+	}
+	if cfg.StompAddr != "" {
+		servers = append(servers, listener{"STOMP", cfg.StompAddr, stomp.New(cfg.StompAddr, b)})
+	}
+	if cfg.MQTTAddr != "" {
+		servers = append(servers, listener{"MQTT", cfg.MQTTAddr, mqtt.New(cfg.MQTTAddr, b)})
+	}
+
+	errCh := make(chan error, len(servers))
+	for _, l := range servers {
+		go func() {
+			log.Printf("starting %s server on %s", l.name, l.addr)
+			if err := l.srv.Start(); err != nil {
+				errCh <- fmt.Errorf("%s server: %w", l.name, err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		b.Close()
 		log.Fatalf("failed to start server: %v", err)
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, l := range servers {
+		if err := l.srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shut down %s server: %v", l.name, err)
+		}
 	}
+	b.Close()
 }
@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrAckDisabled     = errors.New("queue does not require acknowledgements")
+	ErrUnknownDelivery = errors.New("unknown delivery tag")
+)
+
+// delivery is a message handed to a subscriber that has not been
+// acknowledged yet.
+type delivery struct {
+	entry *entry
+	group *group
+	sub   *subscriber
+	timer *time.Timer
+}
+
+// track registers a delivery of e to s and returns its tag. If the delivery
+// is not acknowledged within the visibility timeout the message is queued
+// again. The caller must hold q.mu.
+func (q *Queue) track(g *group, e *entry, s *subscriber) uint64 {
+	q.nextTag += q.tagStride
+	tag := q.nextTag
+
+	g.pending[e]++
+	s.unacked++
+	q.inflight[tag] = &delivery{
+		entry: e,
+		group: g,
+		sub:   s,
+		timer: time.AfterFunc(q.visibility, func() { q.expire(tag) }),
+	}
+
+	return tag
+}
+
+// untrack forgets a delivery that never reached its subscriber. The caller
+// must hold q.mu.
+func (q *Queue) untrack(tag uint64) {
+	d, ok := q.inflight[tag]
+	if !ok {
+		return
+	}
+
+	q.forget(tag, d)
+	q.unpend(d.group, d.entry)
+}
+
+// forget removes a delivery from the in-flight set. The caller must hold
+// q.mu.
+func (q *Queue) forget(tag uint64, d *delivery) {
+	d.timer.Stop()
+	d.sub.unacked--
+	delete(q.inflight, tag)
+}
+
+func (q *Queue) expire(tag uint64) {
+	q.mu.Lock()
+	d, ok := q.inflight[tag]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	q.forget(tag, d)
+	if d.entry.removed {
+		q.mu.Unlock()
+		return
+	}
+
+	if !q.exhausted(d.group, d.entry) {
+		q.requeue(d)
+		q.mu.Unlock()
+		return
+	}
+	q.mu.Unlock()
+
+	q.deadLetter(d.group, d.entry, ReasonMaxDeliveries)
+}
+
+// requeue queues a failed delivery for redelivery. It stays pending in its
+// group in the meantime. The caller must hold q.mu.
+func (q *Queue) requeue(d *delivery) {
+	it := item{entry: d.entry, target: d.sub, redelivered: true}
+	d.group.retry = append([]item{it}, d.group.retry...)
+	q.announce()
+}
+
+// exhausted reports whether e was delivered to g as often as allowed. The
+// caller must hold q.mu.
+func (q *Queue) exhausted(g *group, e *entry) bool {
+	return q.maxDeliveries > 0 && g.attempts[e] >= q.maxDeliveries
+}
+
+// Ack acknowledges deliveries by tag. Known tags are acknowledged even if
+// some of the others are not, in which case ErrUnknownDelivery is returned.
+func (q *Queue) Ack(tags ...uint64) error {
+	if !q.requireAck {
+		return ErrAckDisabled
+	}
+	if q.parts != nil {
+		return q.settlePartitions(tags, func(p *Queue, tags []uint64) error {
+			return p.Ack(tags...)
+		})
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var err error
+	for _, tag := range tags {
+		d, ok := q.inflight[tag]
+		if !ok {
+			err = ErrUnknownDelivery
+			continue
+		}
+
+		q.forget(tag, d)
+		q.unpend(d.group, d.entry)
+	}
+
+	return err
+}
+
+// Nack rejects deliveries by tag. With requeue they are delivered again
+// unless they reached the maximum number of deliveries, otherwise they are
+// moved to the dead letter queue, or dropped if there is none.
+func (q *Queue) Nack(requeue bool, tags ...uint64) error {
+	if !q.requireAck {
+		return ErrAckDisabled
+	}
+	if q.parts != nil {
+		return q.settlePartitions(tags, func(p *Queue, tags []uint64) error {
+			return p.Nack(requeue, tags...)
+		})
+	}
+
+	q.mu.Lock()
+	var err error
+	var dead []*delivery
+	var reasons []string
+	for _, tag := range tags {
+		d, ok := q.inflight[tag]
+		if !ok {
+			err = ErrUnknownDelivery
+			continue
+		}
+		q.forget(tag, d)
+
+		switch {
+		case d.entry.removed:
+		case !requeue:
+			dead = append(dead, d)
+			reasons = append(reasons, ReasonRejected)
+		case q.exhausted(d.group, d.entry):
+			dead = append(dead, d)
+			reasons = append(reasons, ReasonMaxDeliveries)
+		default:
+			q.requeue(d)
+		}
+	}
+	q.mu.Unlock()
+
+	for i, d := range dead {
+		q.deadLetter(d.group, d.entry, reasons[i])
+	}
+
+	return err
+}
@@ -2,188 +2,209 @@ package broker
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/IgorLem99/simple_broker/internal/config"
 )
 
+const DefaultDataDir = "data"
+
 var (
 	ErrQueueFull     = errors.New("queue full")
 	ErrTooManySub    = errors.New("too many subscribers")
 	ErrQueueNotFound = errors.New("queue not found")
+	ErrQueueExists   = errors.New("queue already exists")
 )
 
-type Message any
-
-type Subscriber chan Message
+const DefaultVisibilityTimeout = 30 * time.Second
 
-type Queue struct {
-	mu     sync.RWMutex
-	cond   *sync.Cond
-	name   string
-	size   int
-	maxSub int
-	msgs   []Message
-	subs   map[Subscriber]struct{}
-	done   chan struct{}
-	closed chan struct{}
+// Delivery is a message handed to a subscriber. On queues that require
+// acknowledgements Tag identifies the delivery for Queue.Ack, otherwise it
+// is zero.
+type Delivery struct {
+	Tag         uint64  `json:"tag"`
+	Redelivered bool    `json:"redelivered,omitempty"`
+	Message     Message `json:"message"`
 }
 
-func NewQueue(cfg config.QueueConfig) *Queue {
-	q := &Queue{
-		name:   cfg.Name,
-		size:   cfg.Size,
-		maxSub: cfg.MaxSub,
-		msgs:   make([]Message, 0, cfg.Size),
-		subs:   make(map[Subscriber]struct{}),
-		done:   make(chan struct{}),
-		closed: make(chan struct{}),
-	}
-	q.cond = sync.NewCond(&q.mu)
-	go q.broadcaster()
-	return q
-}
+type Subscriber chan Delivery
 
-func (q *Queue) Subscribe() (Subscriber, error) {
-	q.mu.Lock()
-	defer q.mu.Unlock()
+type Broker struct {
+	mu        sync.RWMutex
+	queues    map[string]*Queue
+	exchanges map[string]*exchange
+	dataDir   string
+
+	// deleting holds the names of the queues that are being deleted, whose
+	// channels are closed once their logs are gone. Until then the names
+	// are not reused.
+	deleting map[string]chan struct{}
+}
 
-	if len(q.subs) >= q.maxSub {
-		return nil, ErrTooManySub
+func New(cfg *config.Config) (*Broker, error) {
+	b := &Broker{
+		queues:    make(map[string]*Queue),
+		exchanges: make(map[string]*exchange),
+		dataDir:   cfg.DataDir,
+		deleting:  make(map[string]chan struct{}),
+	}
+	if b.dataDir == "" {
+		b.dataDir = DefaultDataDir
 	}
 
-	sub := make(Subscriber)
-	q.subs[sub] = struct{}{}
-	q.cond.Signal()
-
-	return sub, nil
-}
+	for _, qc := range cfg.Queues {
+		if err := qc.Validate(); err != nil {
+			b.Close()
+			return nil, err
+		}
 
-func (q *Queue) Unsubscribe(sub Subscriber) {
-	q.mu.Lock()
-	defer q.mu.Unlock()
+		q, err := b.openQueue(qc)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.queues[qc.Name] = q
+	}
 
-	if _, ok := q.subs[sub]; ok {
-		delete(q.subs, sub)
-		close(sub)
+	for _, ec := range cfg.Exchanges {
+		if _, err := b.CreateExchange(ec); err != nil {
+			b.Close()
+			return nil, fmt.Errorf("exchange %s: %w", ec.Name, err)
+		}
 	}
-}
 
-func (q *Queue) Send(msg Message) error {
-	q.mu.Lock()
-	defer q.mu.Unlock()
+	return b, nil
+}
 
-	if len(q.msgs) >= q.size {
-		return ErrQueueFull
+func (b *Broker) openQueue(qc config.QueueConfig) (*Queue, error) {
+	var q *Queue
+	if qc.Durable {
+		var err error
+		if q, err = OpenQueue(qc, filepath.Join(b.dataDir, qc.Name)); err != nil {
+			return nil, err
+		}
+	} else {
+		q = NewQueue(qc)
+	}
+	q.lookup = b.GetQueue
+	for _, p := range q.parts {
+		p.lookup = b.GetQueue
 	}
 
-	q.msgs = append(q.msgs, msg)
-	q.cond.Signal()
-
-	return nil
+	return q, nil
 }
 
-func (q *Queue) broadcaster() {
-	defer close(q.closed)
+// CreateQueue adds a queue while the broker is running. A durable queue
+// restores the log it finds in the data directory under its name. A queue
+// of the same name that is being deleted is waited for.
+func (b *Broker) CreateQueue(qc config.QueueConfig) (*Queue, error) {
+	if err := qc.Validate(); err != nil {
+		return nil, err
+	}
 
+	b.mu.Lock()
 	for {
-		q.mu.Lock()
-		select {
-		case <-q.done:
-			q.mu.Unlock()
-			return
-		default:
-		}
-
-		for len(q.msgs) == 0 || len(q.subs) == 0 {
-			q.cond.Wait()
-			select {
-			case <-q.done:
-				q.mu.Unlock()
-				return
-			default:
-			}
+		done, ok := b.deleting[qc.Name]
+		if !ok {
+			break
 		}
+		b.mu.Unlock()
+		<-done
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
 
-		msg := q.msgs[0]
-		q.msgs = q.msgs[1:]
-
-		subs := make([]Subscriber, 0, len(q.subs))
-		for sub := range q.subs {
-			subs = append(subs, sub)
-		}
-		q.mu.Unlock()
-
-		var wg sync.WaitGroup
-		for _, sub := range subs {
-			wg.Add(1)
-			go func(sub Subscriber) {
-				defer wg.Done()
-				defer func() {
-					_ = recover()
-				}()
-				select {
-				case sub <- msg:
-				case <-q.done:
-				}
-			}(sub)
-		}
+	if _, ok := b.queues[qc.Name]; ok {
+		return nil, ErrQueueExists
+	}
 
-		wg.Wait()
+	q, err := b.openQueue(qc)
+	if err != nil {
+		return nil, err
 	}
-}
+	b.queues[qc.Name] = q
 
-func (q *Queue) Close() {
-	q.mu.Lock()
+	return q, nil
+}
 
-	select {
-	case <-q.done:
-		q.mu.Unlock()
-		return
-	default:
-		close(q.done)
+// DeleteQueue closes a queue, which ends its subscriptions, and removes it
+// together with its log and its bindings.
+func (b *Broker) DeleteQueue(name string) error {
+	b.mu.Lock()
+	q, ok := b.queues[name]
+	if !ok {
+		b.mu.Unlock()
+		return ErrQueueNotFound
+	}
+	delete(b.queues, name)
+	b.unbindQueue(name)
+	done := make(chan struct{})
+	b.deleting[name] = done
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.deleting, name)
+		b.mu.Unlock()
+		close(done)
+	}()
+
+	q.Close()
+	if q.cfg.Durable {
+		return os.RemoveAll(filepath.Join(b.dataDir, name))
 	}
-	q.cond.Broadcast()
-	q.mu.Unlock()
 
-	<-q.closed
+	return nil
+}
 
-	q.mu.Lock()
-	defer q.mu.Unlock()
+func (b *Broker) GetQueue(name string) (*Queue, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	for sub := range q.subs {
-		delete(q.subs, sub)
-		close(sub)
+	q, ok := b.queues[name]
+	if !ok {
+		return nil, ErrQueueNotFound
 	}
-}
 
-type Broker struct {
-	mu     sync.RWMutex
-	queues map[string]*Queue
+	return q, nil
 }
 
-func New(cfg *config.Config) *Broker {
-	b := &Broker{
-		queues: make(map[string]*Queue),
+// Redrive moves the messages that the named queue dead-lettered back from
+// its dead letter queue and returns how many were moved.
+func (b *Broker) Redrive(name string) (int, error) {
+	q, err := b.GetQueue(name)
+	if err != nil {
+		return 0, err
+	}
+	if q.deadLetterQueue == "" {
+		return 0, ErrNoDeadLetterQueue
 	}
 
-	for _, qc := range cfg.Queues {
-		b.queues[qc.Name] = NewQueue(qc)
+	dlq, err := b.GetQueue(q.deadLetterQueue)
+	if err != nil {
+		return 0, err
 	}
 
-	return b
+	return dlq.redrive(q)
 }
 
-func (b *Broker) GetQueue(name string) (*Queue, error) {
+// Queues returns the queues of the broker ordered by name.
+func (b *Broker) Queues() []*Queue {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	q, ok := b.queues[name]
-	if !ok {
-		return nil, ErrQueueNotFound
+	queues := make([]*Queue, 0, len(b.queues))
+	for _, q := range b.queues {
+		queues = append(queues, q)
 	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
 
-	return q, nil
+	return queues
 }
 
 func (b *Broker) Close() {
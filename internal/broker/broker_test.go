@@ -3,7 +3,12 @@ package broker
 import (
 	"github.com/IgorLem99/simple_broker/internal/config"
 
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -16,7 +21,10 @@ func TestNewBroker(t *testing.T) {
 			{Name: "q2", Size: 5, MaxSub: 1},
 		},
 	}
-	b := New(cfg)
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
 	defer b.Close()
 
 	if len(b.queues) != 2 {
@@ -37,7 +45,10 @@ func TestBroker_GetQueue(t *testing.T) {
 			{Name: "q1", Size: 1, MaxSub: 1},
 		},
 	}
-	b := New(cfg)
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
 	defer b.Close()
 
 	t.Run("existing queue", func(t *testing.T) {
@@ -58,6 +69,126 @@ func TestBroker_GetQueue(t *testing.T) {
 	})
 }
 
+func TestBroker_CreateDeleteQueue(t *testing.T) {
+	b, err := New(&config.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_, _ = b.GetQueue("q1")
+				_ = b.Queues()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	qc := config.QueueConfig{Name: "q1", Size: 1, MaxSub: 1, Durable: true}
+	q, err := b.CreateQueue(qc)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if _, err := b.CreateQueue(qc); err != ErrQueueExists {
+		t.Fatalf("expected error %v, got %v", ErrQueueExists, err)
+	}
+	if _, err := b.CreateQueue(config.QueueConfig{Name: "a/b"}); err == nil {
+		t.Fatal("expected an error for an invalid name")
+	}
+	if got, _ := b.GetQueue("q1"); got != q {
+		t.Fatal("expected GetQueue to return the created queue")
+	}
+
+	sub, _ := q.Subscribe()
+	if _, err := q.Send(text("m1")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	if err := b.DeleteQueue("q1"); err != nil {
+		t.Fatalf("failed to delete queue: %v", err)
+	}
+	if err := b.DeleteQueue("q1"); err != ErrQueueNotFound {
+		t.Fatalf("expected error %v, got %v", ErrQueueNotFound, err)
+	}
+	if _, err := b.GetQueue("q1"); err != ErrQueueNotFound {
+		t.Fatalf("expected error %v, got %v", ErrQueueNotFound, err)
+	}
+	if _, err := q.Send(text("m2")); err != ErrQueueClosed {
+		t.Fatalf("expected error %v, got %v", ErrQueueClosed, err)
+	}
+	for range sub {
+	}
+
+	// The log went with the queue.
+	q, err = b.CreateQueue(qc)
+	if err != nil {
+		t.Fatalf("failed to create queue again: %v", err)
+	}
+	if info := q.Info(); info.Messages != 0 || info.NextOffset != 0 {
+		t.Errorf("expected an empty queue, got %+v", info)
+	}
+
+	// A queue created while the old one is being deleted waits for it, and
+	// keeps its log. Holding the lock of the old queue stalls its deletion.
+	q.mu.Lock()
+	deleted := make(chan error)
+	go func() { deleted <- b.DeleteQueue("q1") }()
+	waitFor(t, func() bool {
+		_, err := b.GetQueue("q1")
+		return err == ErrQueueNotFound
+	}, "expected the queue to be removed")
+	created := make(chan error)
+	go func() {
+		_, err := b.CreateQueue(qc)
+		created <- err
+	}()
+	select {
+	case err := <-created:
+		t.Fatalf("expected creation to wait for the deletion, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.mu.Unlock()
+	if err := <-deleted; err != nil {
+		t.Fatalf("failed to delete queue: %v", err)
+	}
+	if err := <-created; err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(b.dataDir, "q1")); err != nil {
+		t.Errorf("expected the log of the new queue: %v", err)
+	}
+}
+
+func TestQueue_Info(t *testing.T) {
+	q := NewQueue(config.QueueConfig{Name: "q1", Size: 10, MaxSub: 2, RetentionMessages: 5})
+	defer q.Close()
+
+	_, _ = q.Subscribe(WithGroup("billing"))
+	if _, err := q.Send(text("m1")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	info := q.Info()
+	if info.Name != "q1" || info.Size != 10 || info.Messages != 1 || info.NextOffset != 1 || info.Subscribers != 1 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if !reflect.DeepEqual(info.Groups, []string{"billing"}) {
+		t.Errorf("expected groups [billing], got %v", info.Groups)
+	}
+}
+
 func TestNewQueue(t *testing.T) {
 	qCfg := config.QueueConfig{Name: "test", Size: 10, MaxSub: 5}
 	q := NewQueue(qCfg)
@@ -72,8 +203,8 @@ func TestNewQueue(t *testing.T) {
 	if q.maxSub != 5 {
 		t.Errorf("expected maxSub 5, got %d", q.maxSub)
 	}
-	if q.msgs == nil {
-		t.Error("msgs slice should be initialized")
+	if q.log == nil {
+		t.Error("log slice should be initialized")
 	}
 	if q.subs == nil {
 		t.Error("subs map should be initialized")
@@ -84,28 +215,150 @@ func TestQueue_Send(t *testing.T) {
 	t.Run("send to queue", func(t *testing.T) {
 		q := NewQueue(config.QueueConfig{Size: 1})
 		defer q.Close()
-		err := q.Send("hello")
+		_, err := q.Send(text("hello"))
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
 		q.mu.RLock()
 		defer q.mu.RUnlock()
-		if len(q.msgs) != 1 || !reflect.DeepEqual(q.msgs[0], "hello") {
+		if len(q.log) != 1 || !reflect.DeepEqual(textOf(q.log[0].msg), "hello") {
 			t.Errorf("message was not added to queue correctly")
 		}
 	})
 
+	t.Run("envelope", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 2})
+		defer q.Close()
+
+		first, err := q.Send(Message{Headers: map[string]string{"type": "order"}, Payload: json.RawMessage(`{"a":1}`)})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		second, err := q.Send(Message{ID: "custom", Payload: json.RawMessage(`2`)})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if first.ID == "" {
+			t.Error("expected an ID to be assigned")
+		}
+		if second.ID != "custom" {
+			t.Errorf("expected given ID to be kept, got %q", second.ID)
+		}
+		if first.Offset != 0 || second.Offset != 1 {
+			t.Errorf("expected offsets 0 and 1, got %d and %d", first.Offset, second.Offset)
+		}
+		if first.Timestamp.IsZero() {
+			t.Error("expected a timestamp to be assigned")
+		}
+		if first.Headers["type"] != "order" || string(first.Payload) != `{"a":1}` {
+			t.Errorf("expected headers and payload to be kept, got %+v", first)
+		}
+	})
+
 	t.Run("queue full", func(t *testing.T) {
 		q := NewQueue(config.QueueConfig{Size: 1})
 		defer q.Close()
-		if err := q.Send("world"); err != nil { // Fill the queue
+		if _, err := q.Send(text("world")); err != nil { // Fill the queue
 			t.Fatalf("failed to fill queue: %v", err)
 		}
-		err := q.Send("extra")
+		_, err := q.Send(text("extra"))
 		if err != ErrQueueFull {
 			t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
 		}
 	})
+
+	t.Run("batch", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 3, MaxSub: 1})
+		defer q.Close()
+
+		sent, err := q.SendBatch([]Message{text("m1"), text("m2")}, true)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(sent) != 2 || sent[0].Offset != 0 || sent[1].Offset != 1 || sent[1].ID == "" {
+			t.Fatalf("unexpected messages sent: %+v", sent)
+		}
+
+		if _, err := q.SendBatch([]Message{text("m3"), text("m4")}, true); err != ErrQueueFull {
+			t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
+		}
+		sent, err = q.SendBatch([]Message{text("m3"), text("m4")}, false)
+		if err != ErrQueueFull {
+			t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
+		}
+		if len(sent) != 1 || textOf(sent[0]) != "m3" || sent[0].Offset != 2 {
+			t.Fatalf("expected only m3 to be sent, got %+v", sent)
+		}
+
+		sub, _ := q.Subscribe()
+		if got := receiveAll(t, sub, 3); !reflect.DeepEqual(got, []string{"m1", "m2", "m3"}) {
+			t.Errorf("expected [m1 m2 m3], got %v", got)
+		}
+	})
+
+	t.Run("wait for room", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 1})
+		defer q.Close()
+		if _, err := q.Send(text("m1")); err != nil {
+			t.Fatalf("failed to fill queue: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := q.SendContext(ctx, text("m2")); err != ErrQueueFull {
+			t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
+		}
+
+		sent := make(chan error, 1)
+		go func() {
+			_, err := q.SendContext(context.Background(), text("m2"))
+			sent <- err
+		}()
+		select {
+		case err := <-sent:
+			t.Fatalf("expected send to wait, got %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		sub, _ := q.Subscribe()
+		receive(t, sub)
+		select {
+		case err := <-sent:
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for send")
+		}
+		if d := receive(t, sub); textOf(d.Message) != "m2" {
+			t.Errorf("expected m2, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("wait until closed", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1})
+		if _, err := q.Send(text("m1")); err != nil {
+			t.Fatalf("failed to fill queue: %v", err)
+		}
+
+		sent := make(chan error, 1)
+		go func() {
+			_, err := q.SendContext(context.Background(), text("m2"))
+			sent <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+
+		select {
+		case err := <-sent:
+			if err != ErrQueueClosed {
+				t.Fatalf("expected error %v, got %v", ErrQueueClosed, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for send")
+		}
+	})
 }
 
 func TestQueue_Subscribe(t *testing.T) {
@@ -172,7 +425,7 @@ func TestQueue_Broadcaster(t *testing.T) {
 	sub2, _ := q.Subscribe()
 
 	msg := "broadcast test"
-	if err := q.Send(msg); err != nil {
+	if _, err := q.Send(text(msg)); err != nil {
 		t.Fatalf("failed to send message: %v", err)
 	}
 
@@ -183,8 +436,8 @@ func TestQueue_Broadcaster(t *testing.T) {
 		defer wg.Done()
 		select {
 		case received := <-sub1:
-			if !reflect.DeepEqual(received, msg) {
-				t.Errorf("sub1: expected message '%v', got '%v'", msg, received)
+			if !reflect.DeepEqual(textOf(received.Message), msg) {
+				t.Errorf("sub1: expected message '%v', got '%v'", msg, textOf(received.Message))
 			}
 		case <-time.After(1 * time.Second):
 			t.Error("sub1: timed out waiting for message")
@@ -195,8 +448,8 @@ func TestQueue_Broadcaster(t *testing.T) {
 		defer wg.Done()
 		select {
 		case received := <-sub2:
-			if !reflect.DeepEqual(received, msg) {
-				t.Errorf("sub2: expected message '%v', got '%v'", msg, received)
+			if !reflect.DeepEqual(textOf(received.Message), msg) {
+				t.Errorf("sub2: expected message '%v', got '%v'", msg, textOf(received.Message))
 			}
 		case <-time.After(1 * time.Second):
 			t.Error("sub2: timed out waiting for message")
@@ -205,12 +458,12 @@ func TestQueue_Broadcaster(t *testing.T) {
 
 	wg.Wait()
 
-	// Check if message is removed from queue
-	q.mu.RLock()
-	defer q.mu.RUnlock()
-	if len(q.msgs) != 0 {
-		t.Errorf("expected message to be removed from queue, but length is %d", len(q.msgs))
-	}
+	// Check if message is removed from queue once every subscriber got it
+	waitFor(t, func() bool {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		return len(q.log) == 0
+	}, "expected message to be removed from queue")
 }
 
 func TestQueue_SlowSubscriber_DoesNotBlock(t *testing.T) {
@@ -222,7 +475,7 @@ func TestQueue_SlowSubscriber_DoesNotBlock(t *testing.T) {
 	_, _ = q.Subscribe()
 
 	// 2. Отправляем первое сообщение, чтобы занять broadcaster
-	if err := q.Send("msg1"); err != nil {
+	if _, err := q.Send(text("msg1")); err != nil {
 		t.Fatalf("failed to send msg1: %v", err)
 	}
 
@@ -235,7 +488,8 @@ func TestQueue_SlowSubscriber_DoesNotBlock(t *testing.T) {
 	// В новой версии мьютекс свободен, и Send должен пройти мгновенно.
 	done := make(chan error)
 	go func() {
-		done <- q.Send("msg2")
+		_, err := q.Send(text("msg2"))
+		done <- err
 	}()
 
 	select {
@@ -247,3 +501,378 @@ func TestQueue_SlowSubscriber_DoesNotBlock(t *testing.T) {
 		t.Fatal("Send blocked by slow subscriber! Fix is not working.")
 	}
 }
+
+func TestQueue_DurableReplay(t *testing.T) {
+	dir := t.TempDir()
+	qCfg := config.QueueConfig{Name: "durable", Size: 10, MaxSub: 1, Durable: true}
+
+	q, err := OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	for _, msg := range []string{"one", "two", "three"} {
+		if _, err := q.Send(text(msg)); err != nil {
+			t.Fatalf("failed to send %q: %v", msg, err)
+		}
+	}
+
+	sub, _ := q.Subscribe()
+	select {
+	case received := <-sub:
+		if !reflect.DeepEqual(textOf(received.Message), "one") {
+			t.Fatalf("expected 'one', got %v", textOf(received.Message))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	q.Unsubscribe(sub)
+	q.Close()
+
+	q, err = OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	defer q.Close()
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	var got []string
+	for _, e := range q.log {
+		got = append(got, textOf(e.msg))
+	}
+	if !reflect.DeepEqual(got, []string{"two", "three"}) {
+		t.Errorf("expected undelivered messages to be replayed, got %v", got)
+	}
+}
+
+func TestQueue_DurableBatch(t *testing.T) {
+	dir := t.TempDir()
+	qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Durable: true}
+
+	q, err := OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	if _, err := q.Send(text("m1")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if _, err := q.SendBatch([]Message{text("m2"), text("m3")}, true); err != nil {
+		t.Fatalf("failed to send batch: %v", err)
+	}
+	sub, _ := q.Subscribe()
+	receiveAll(t, sub, 2)
+	q.Unsubscribe(sub)
+	q.Close()
+
+	q, err = OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	defer q.Close()
+
+	sub, _ = q.Subscribe()
+	if d := receive(t, sub); textOf(d.Message) != "m3" || d.Message.Offset != 2 {
+		t.Errorf("expected m3 at offset 2, got %v at %d", textOf(d.Message), d.Message.Offset)
+	}
+}
+
+func TestNewBroker_Durable(t *testing.T) {
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+		Queues:  []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1, Durable: true, Fsync: "bogus"}},
+	}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("expected an error for unknown fsync policy")
+	}
+
+	cfg.Queues[0].Fsync = "interval"
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	q, _ := b.GetQueue("q1")
+	if _, err := q.Send(text("persisted")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	b.Close()
+
+	b, err = New(cfg)
+	if err != nil {
+		t.Fatalf("failed to recreate broker: %v", err)
+	}
+	defer b.Close()
+	q, _ = b.GetQueue("q1")
+	if _, err := q.Send(text("extra")); err != ErrQueueFull {
+		t.Errorf("expected replayed message to occupy the queue, got %v", err)
+	}
+}
+
+func text(s string) Message {
+	return Message{Payload: json.RawMessage(strconv.Quote(s))}
+}
+
+func textOf(m Message) string {
+	var s string
+	_ = json.Unmarshal(m.Payload, &s)
+	return s
+}
+
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, sub Subscriber) Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-sub:
+		if !ok {
+			t.Fatal("subscriber channel closed unexpectedly")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return Delivery{}
+}
+
+func TestQueue_Ack(t *testing.T) {
+	t.Run("ack", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 1, RequireAck: true})
+		defer q.Close()
+		sub, _ := q.Subscribe()
+
+		if _, err := q.Send(text("hello")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		d := receive(t, sub)
+		if d.Tag == 0 {
+			t.Fatal("expected a delivery tag")
+		}
+
+		if err := q.Ack(d.Tag); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := q.Ack(d.Tag); err != ErrUnknownDelivery {
+			t.Fatalf("expected error %v, got %v", ErrUnknownDelivery, err)
+		}
+
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		if len(q.inflight) != 0 {
+			t.Errorf("expected no deliveries in flight, got %d", len(q.inflight))
+		}
+	})
+
+	t.Run("redelivery after visibility timeout", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{
+			Size:              1,
+			MaxSub:            1,
+			RequireAck:        true,
+			VisibilityTimeout: config.Duration(50 * time.Millisecond),
+		})
+		defer q.Close()
+		sub, _ := q.Subscribe()
+
+		if _, err := q.Send(text("hello")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		first := receive(t, sub)
+		second := receive(t, sub)
+
+		if !second.Redelivered {
+			t.Error("expected redelivered flag to be set")
+		}
+		if second.Tag == first.Tag {
+			t.Error("expected a new tag for the redelivery")
+		}
+		if !reflect.DeepEqual(textOf(second.Message), "hello") {
+			t.Errorf("expected 'hello', got %v", textOf(second.Message))
+		}
+		if err := q.Ack(first.Tag); err != ErrUnknownDelivery {
+			t.Errorf("expected expired tag to be unknown, got %v", err)
+		}
+		if err := q.Ack(second.Tag); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+
+	t.Run("redelivery to another subscriber", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{
+			Size:              1,
+			MaxSub:            1,
+			RequireAck:        true,
+			VisibilityTimeout: config.Duration(50 * time.Millisecond),
+		})
+		defer q.Close()
+
+		sub1, _ := q.Subscribe()
+		if _, err := q.Send(text("hello")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		receive(t, sub1)
+		q.Unsubscribe(sub1)
+
+		sub2, _ := q.Subscribe()
+		if d := receive(t, sub2); !d.Redelivered {
+			t.Error("expected redelivered flag to be set")
+		}
+	})
+
+	t.Run("acks disabled", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 1})
+		defer q.Close()
+		if err := q.Ack(1); err != ErrAckDisabled {
+			t.Fatalf("expected error %v, got %v", ErrAckDisabled, err)
+		}
+	})
+}
+
+func TestQueue_DurableUnacked(t *testing.T) {
+	dir := t.TempDir()
+	qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Durable: true, RequireAck: true}
+
+	q, err := OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	sub, _ := q.Subscribe()
+	for _, msg := range []string{"acked", "unacked"} {
+		if _, err := q.Send(text(msg)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	if err := q.Ack(receive(t, sub).Tag); err != nil {
+		t.Fatalf("failed to ack: %v", err)
+	}
+	receive(t, sub)
+	q.Close()
+
+	q, err = OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	defer q.Close()
+
+	q.mu.RLock()
+	if len(q.log) != 1 || !reflect.DeepEqual(textOf(q.log[0].msg), "unacked") {
+		t.Errorf("expected only the unacked message to be replayed, got %v", q.log)
+	}
+	q.mu.RUnlock()
+
+	sub, _ = q.Subscribe()
+	if d := receive(t, sub); textOf(d.Message) != "unacked" || !d.Redelivered {
+		t.Errorf("expected the unacked message to be redelivered, got %v", d)
+	}
+}
+
+func TestQueue_WorkMode(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2, DeliveryMode: config.DeliveryWork})
+		defer q.Close()
+
+		sub1, _ := q.Subscribe()
+		sub2, _ := q.Subscribe()
+
+		for _, msg := range []string{"m1", "m2", "m3", "m4"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send %q: %v", msg, err)
+			}
+		}
+
+		var got1, got2 []string
+		for i := 0; i < 2; i++ {
+			got1 = append(got1, textOf(receive(t, sub1).Message))
+			got2 = append(got2, textOf(receive(t, sub2).Message))
+		}
+		if !reflect.DeepEqual(got1, []string{"m1", "m3"}) {
+			t.Errorf("sub1: expected [m1 m3], got %v", got1)
+		}
+		if !reflect.DeepEqual(got2, []string{"m2", "m4"}) {
+			t.Errorf("sub2: expected [m2 m4], got %v", got2)
+		}
+
+		select {
+		case d := <-sub1:
+			t.Errorf("sub1: unexpected extra message %v", textOf(d.Message))
+		case d := <-sub2:
+			t.Errorf("sub2: unexpected extra message %v", textOf(d.Message))
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("least busy", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{
+			Size:         10,
+			MaxSub:       2,
+			DeliveryMode: config.DeliveryWork,
+			WorkDispatch: config.DispatchLeastBusy,
+			RequireAck:   true,
+		})
+		defer q.Close()
+
+		sub1, _ := q.Subscribe()
+		sub2, _ := q.Subscribe()
+
+		if _, err := q.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		d1 := receive(t, sub1)
+		if _, err := q.Send(text("m2")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		receive(t, sub2)
+
+		// sub1 acknowledges its message and becomes the least busy one
+		// even though it would not be its turn.
+		if err := q.Ack(d1.Tag); err != nil {
+			t.Fatalf("failed to ack: %v", err)
+		}
+		if _, err := q.Send(text("m3")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if d := receive(t, sub1); !reflect.DeepEqual(textOf(d.Message), "m3") {
+			t.Errorf("expected m3 on sub1, got %v", textOf(d.Message))
+		}
+	})
+}
+
+func TestQueue_DurableOffsets(t *testing.T) {
+	dir := t.TempDir()
+	qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Durable: true, SegmentSize: 64}
+
+	q, err := OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	sub, _ := q.Subscribe()
+	for i := 0; i < 5; i++ {
+		if _, err := q.Send(text("m")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		receive(t, sub)
+	}
+	q.Close()
+
+	// Every message was delivered, so the log segments that held them may
+	// be gone. The offsets must keep growing nonetheless.
+	q, err = OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	defer q.Close()
+
+	msg, err := q.Send(text("next"))
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if msg.Offset != 5 {
+		t.Errorf("expected offset 5, got %d", msg.Offset)
+	}
+}
@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"errors"
+	"log"
+)
+
+// Headers added to messages moved to a dead letter queue.
+const (
+	HeaderDeadLetterReason = "dead-letter-reason"
+	HeaderDeadLetterQueue  = "dead-letter-queue"
+)
+
+// Reasons for moving a message to a dead letter queue.
+const (
+	ReasonRejected      = "rejected"
+	ReasonMaxDeliveries = "max_deliveries"
+	ReasonExpired       = "expired"
+)
+
+var ErrNoDeadLetterQueue = errors.New("queue has no dead letter queue")
+
+// deadLetter moves e, which g failed to process, to the dead letter queue
+// and then finishes it in g. The caller must not hold q.mu, so that queues
+// can be each other's dead letter queue.
+func (q *Queue) deadLetter(g *group, e *entry, reason string) {
+	q.publishDeadLetter(e.msg, reason)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !g.deleted {
+		q.unpend(g, e)
+	}
+}
+
+// publishDeadLetter sends a copy of msg to the dead letter queue, if there
+// is one. The caller must not hold q.mu.
+func (q *Queue) publishDeadLetter(msg Message, reason string) {
+	if q.deadLetterQueue == "" || q.lookup == nil {
+		return
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDeadLetterReason] = reason
+	headers[HeaderDeadLetterQueue] = q.name
+
+	dlq, err := q.lookup(q.deadLetterQueue)
+	if err == nil {
+		_, err = dlq.forward(Message{ID: msg.ID, Headers: headers, Payload: msg.Payload})
+	}
+	if err != nil {
+		log.Printf("queue %s: dead-letter message %s: %v", q.name, msg.ID, err)
+	}
+}
+
+// redrive sends the messages that src dead-lettered to q back to src and
+// removes them from q. It returns how many were moved.
+func (q *Queue) redrive(src *Queue) (int, error) {
+	if q.parts != nil {
+		moved := 0
+		for _, p := range q.parts {
+			n, err := p.redrive(src)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+		}
+		return moved, nil
+	}
+
+	q.mu.RLock()
+	var entries []*entry
+	for _, e := range q.log {
+		if e.refs > 0 && !e.removed && e.msg.Headers[HeaderDeadLetterQueue] == src.name {
+			entries = append(entries, e)
+		}
+	}
+	q.mu.RUnlock()
+
+	moved := 0
+	for _, e := range entries {
+		headers := make(map[string]string, len(e.msg.Headers))
+		for k, v := range e.msg.Headers {
+			if k != HeaderDeadLetterReason && k != HeaderDeadLetterQueue {
+				headers[k] = v
+			}
+		}
+		if len(headers) == 0 {
+			headers = nil
+		}
+
+		if _, err := src.forward(Message{ID: e.msg.ID, Headers: headers, Payload: e.msg.Payload}); err != nil {
+			return moved, err
+		}
+
+		q.mu.Lock()
+		q.remove(e)
+		q.mu.Unlock()
+		moved++
+	}
+
+	return moved, nil
+}
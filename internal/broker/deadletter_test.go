@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"testing"
+	"time"
+)
+
+func newDeadLetterBroker(t *testing.T, dir string) *Broker {
+	t.Helper()
+	b, err := New(&config.Config{
+		DataDir: dir,
+		Queues: []config.QueueConfig{
+			{
+				Name: "src", Size: 10, MaxSub: 2, RequireAck: true,
+				VisibilityTimeout: config.Duration(20 * time.Millisecond),
+				MaxDeliveries:     2, DeadLetterQueue: "dlq",
+			},
+			{Name: "dlq", Size: 10, MaxSub: 1, Durable: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	return b
+}
+
+func TestQueue_DeadLetter(t *testing.T) {
+	t.Run("max deliveries", func(t *testing.T) {
+		b := newDeadLetterBroker(t, t.TempDir())
+		defer b.Close()
+		src, _ := b.GetQueue("src")
+		dlq, _ := b.GetQueue("dlq")
+
+		sub, _ := src.Subscribe()
+		dead, _ := dlq.Subscribe()
+		msg := text("m1")
+		msg.Headers = map[string]string{"type": "order"}
+		if _, err := src.Send(msg); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		receive(t, sub)
+		if d := receive(t, sub); !d.Redelivered {
+			t.Error("expected a redelivery")
+		}
+
+		d := receive(t, dead)
+		if textOf(d.Message) != "m1" || d.Message.Headers["type"] != "order" ||
+			d.Message.Headers[HeaderDeadLetterReason] != ReasonMaxDeliveries ||
+			d.Message.Headers[HeaderDeadLetterQueue] != "src" {
+			t.Errorf("unexpected dead letter: %+v", d.Message)
+		}
+		waitFor(t, func() bool { return src.Info().Messages == 0 }, "expected src to be empty")
+	})
+
+	t.Run("nack", func(t *testing.T) {
+		b := newDeadLetterBroker(t, t.TempDir())
+		defer b.Close()
+		src, _ := b.GetQueue("src")
+		dlq, _ := b.GetQueue("dlq")
+
+		sub, _ := src.Subscribe()
+		dead, _ := dlq.Subscribe()
+		if _, err := src.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		d := receive(t, sub)
+		if err := src.Nack(true, d.Tag); err != nil {
+			t.Fatalf("failed to nack: %v", err)
+		}
+		d = receive(t, sub)
+		if !d.Redelivered {
+			t.Error("expected a redelivery")
+		}
+		if err := src.Nack(false, d.Tag); err != nil {
+			t.Fatalf("failed to nack: %v", err)
+		}
+		if err := src.Nack(false, d.Tag); err != ErrUnknownDelivery {
+			t.Fatalf("expected error %v, got %v", ErrUnknownDelivery, err)
+		}
+
+		if d := receive(t, dead); d.Message.Headers[HeaderDeadLetterReason] != ReasonRejected {
+			t.Errorf("expected reason %q, got %q", ReasonRejected, d.Message.Headers[HeaderDeadLetterReason])
+		}
+	})
+
+	t.Run("redrive", func(t *testing.T) {
+		dir := t.TempDir()
+		b := newDeadLetterBroker(t, dir)
+		src, _ := b.GetQueue("src")
+
+		sub, _ := src.Subscribe()
+		if _, err := src.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if err := src.Nack(false, receive(t, sub).Tag); err != nil {
+			t.Fatalf("failed to nack: %v", err)
+		}
+		dlq, _ := b.GetQueue("dlq")
+		waitFor(t, func() bool { return dlq.Info().Messages == 1 }, "expected a dead letter")
+
+		if _, err := b.Redrive("dlq"); err != ErrNoDeadLetterQueue {
+			t.Fatalf("expected error %v, got %v", ErrNoDeadLetterQueue, err)
+		}
+		moved, err := b.Redrive("src")
+		if err != nil || moved != 1 {
+			t.Fatalf("expected 1 message moved, got %d, %v", moved, err)
+		}
+
+		d := receive(t, sub)
+		if textOf(d.Message) != "m1" || d.Message.Headers != nil {
+			t.Errorf("unexpected redriven message: %+v", d.Message)
+		}
+		if info := dlq.Info(); info.Messages != 0 {
+			t.Errorf("expected dlq to be empty, got %d messages", info.Messages)
+		}
+		b.Close()
+
+		// The removal survives a restart.
+		b = newDeadLetterBroker(t, dir)
+		defer b.Close()
+		dlq, _ = b.GetQueue("dlq")
+		if info := dlq.Info(); info.Messages != 0 {
+			t.Errorf("expected dlq to stay empty, got %d messages", info.Messages)
+		}
+	})
+}
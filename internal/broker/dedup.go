@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDuplicate is returned with the original message when a message has the
+// ID of one that was sent within the dedup window of the queue.
+var ErrDuplicate = errors.New("duplicate message")
+
+// maxDedupIDs bounds the number of IDs a queue remembers however many
+// messages are sent within the dedup window. The oldest are forgotten
+// first.
+const maxDedupIDs = 1 << 20
+
+type sentID struct {
+	id     string
+	offset uint64
+	at     time.Time
+}
+
+// dedup remembers the IDs of the messages sent within window, oldest first,
+// but no more than limit.
+type dedup struct {
+	window time.Duration
+	limit  int
+	ids    []sentID
+	head   int
+	byID   map[string]sentID
+}
+
+func newDedup(window time.Duration) dedup {
+	return dedup{window: window, limit: maxDedupIDs, byID: make(map[string]sentID)}
+}
+
+// seen returns the message that was sent with id within the window.
+func (d *dedup) seen(id string, now time.Time) (Message, bool) {
+	if d.window <= 0 || id == "" {
+		return Message{}, false
+	}
+
+	d.prune(now)
+	s, ok := d.byID[id]
+	if !ok {
+		return Message{}, false
+	}
+	return Message{ID: s.id, Offset: s.offset, Timestamp: s.at}, true
+}
+
+func (d *dedup) add(msg Message) {
+	if d.window <= 0 {
+		return
+	}
+
+	s := sentID{id: msg.ID, offset: msg.Offset, at: msg.Timestamp}
+	d.ids = append(d.ids, s)
+	d.byID[s.id] = s
+	if len(d.ids)-d.head > d.limit {
+		d.pop()
+	}
+}
+
+// forget removes the ID of msg, as long as it was not sent again since.
+func (d *dedup) forget(msg Message) {
+	if cur, ok := d.byID[msg.ID]; ok && cur.offset == msg.Offset {
+		delete(d.byID, msg.ID)
+	}
+}
+
+// prune forgets the IDs that were sent before the window.
+func (d *dedup) prune(now time.Time) {
+	for d.head < len(d.ids) && !now.Before(d.ids[d.head].at.Add(d.window)) {
+		d.pop()
+	}
+}
+
+func (d *dedup) pop() {
+	s := d.ids[d.head]
+	d.ids[d.head] = sentID{}
+	d.head++
+	if cur, ok := d.byID[s.id]; ok && cur.offset == s.offset {
+		delete(d.byID, s.id)
+	}
+
+	if d.head == len(d.ids) {
+		d.ids, d.head = d.ids[:0], 0
+	} else if d.head > len(d.ids)/2 {
+		d.ids = append(d.ids[:0], d.ids[d.head:]...)
+		d.head = 0
+	}
+}
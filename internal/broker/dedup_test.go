@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueue_Dedup(t *testing.T) {
+	t.Run("duplicates within the window", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, DedupWindow: config.Duration(50 * time.Millisecond)})
+		defer q.Close()
+
+		first, err := q.Send(Message{ID: "k1", Payload: text("m1").Payload})
+		if err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		dup, err := q.Send(Message{ID: "k1", Payload: text("m2").Payload})
+		if err != ErrDuplicate {
+			t.Fatalf("expected error %v, got %v", ErrDuplicate, err)
+		}
+		if dup.ID != "k1" || dup.Offset != first.Offset {
+			t.Errorf("expected the original message, got %+v", dup)
+		}
+		if _, err := q.Send(text("m3")); err != nil {
+			t.Fatalf("expected messages without ID to be sent, got %v", err)
+		}
+
+		sent, err := q.SendBatch([]Message{{ID: "k1", Payload: text("m4").Payload}, {ID: "k2", Payload: text("m5").Payload}, {ID: "k2", Payload: text("m6").Payload}}, true)
+		if err != nil {
+			t.Fatalf("failed to send batch: %v", err)
+		}
+		if sent[0].Offset != first.Offset || sent[1].Offset != 2 || sent[2].Offset != 2 {
+			t.Errorf("expected duplicates to return the original messages, got %+v", sent)
+		}
+
+		time.Sleep(60 * time.Millisecond)
+		again, err := q.Send(Message{ID: "k1", Payload: text("m7").Payload})
+		if err != nil {
+			t.Fatalf("expected ID to be accepted after the window, got %v", err)
+		}
+		if again.Offset != 3 {
+			t.Errorf("expected offset 3, got %d", again.Offset)
+		}
+
+		sub, _ := q.Subscribe()
+		got := receiveAll(t, sub, 4)
+		if got[0] != "m1" || got[1] != "m3" || got[2] != "m5" || got[3] != "m7" {
+			t.Errorf("expected [m1 m3 m5 m7], got %v", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10})
+		defer q.Close()
+
+		for i := 0; i < 2; i++ {
+			if _, err := q.Send(Message{ID: "k1", Payload: text("m1").Payload}); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+	})
+
+	t.Run("durable", func(t *testing.T) {
+		dir := t.TempDir()
+		qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Durable: true, DedupWindow: config.Duration(time.Minute)}
+
+		q, err := OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to open queue: %v", err)
+		}
+		if _, err := q.Send(Message{ID: "k1", Payload: text("m1").Payload}); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		q.Close()
+
+		q, err = OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to reopen queue: %v", err)
+		}
+		defer q.Close()
+
+		if _, err := q.Send(Message{ID: "k1", Payload: text("m1").Payload}); err != ErrDuplicate {
+			t.Errorf("expected error %v after restart, got %v", ErrDuplicate, err)
+		}
+	})
+}
+
+func TestDedup_Bounded(t *testing.T) {
+	d := newDedup(time.Minute)
+	d.limit = 100
+	now := time.Now()
+	for i := uint64(0); i < 110; i++ {
+		d.add(Message{ID: strconv.FormatUint(i, 10), Offset: i, Timestamp: now})
+	}
+	if n := len(d.ids) - d.head; n != 100 || len(d.byID) != 100 {
+		t.Errorf("expected 100 IDs, got %d in order and %d by ID", n, len(d.byID))
+	}
+	if _, ok := d.seen("9", now); ok {
+		t.Error("expected the oldest IDs to be forgotten")
+	}
+	if _, ok := d.seen("10", now); !ok {
+		t.Error("expected newer IDs to be kept")
+	}
+
+	d.prune(now.Add(time.Minute))
+	if len(d.byID) != 0 || len(d.ids) != 0 {
+		t.Errorf("expected every ID to leave the window, got %d", len(d.byID))
+	}
+}
@@ -0,0 +1,218 @@
+package broker
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	opSend       = "send"
+	opBatch      = "batch"
+	opGroup      = "group"
+	opUngroup    = "ungroup"
+	opDone       = "done"
+	opDeliver    = "deliver"
+	opCheckpoint = "checkpoint"
+	opRemove     = "remove"
+	opSchedule   = "schedule"
+	opUnschedule = "unschedule"
+)
+
+type record struct {
+	Op     string            `json:"op"`
+	Offset uint64            `json:"offset,omitempty"`
+	Group  string            `json:"group,omitempty"`
+	Groups map[string]uint64 `json:"groups,omitempty"`
+	// Claimed is the offset from which a group holds entries against the
+	// queue size, Claims the same for every group of a checkpoint.
+	Claimed uint64            `json:"claimed,omitempty"`
+	Claims  map[string]uint64 `json:"claims,omitempty"`
+	Msg     *Message          `json:"msg,omitempty"`
+	Msgs    []Message         `json:"msgs,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	At      *time.Time        `json:"at,omitempty"`
+}
+
+func (q *Queue) appendRecord(rec record) (uint64, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.wal.Append(data)
+}
+
+type replayGroup struct {
+	start    uint64
+	claimed  uint64
+	done     map[uint64]bool
+	attempts map[uint64]int
+}
+
+// replay restores the queue from its log. Entries that a group had not
+// finished with are queued for redelivery to that group, marked as
+// redelivered if they had been delivered before.
+func (q *Queue) replay() error {
+	groups := make(map[string]*replayGroup)
+	addGroup := func(name string, start, claimed uint64) {
+		if _, ok := groups[name]; !ok {
+			groups[name] = &replayGroup{start: start, claimed: max(start, claimed), done: make(map[uint64]bool), attempts: make(map[uint64]int)}
+		}
+	}
+	addGroup(DefaultGroup, 0, 0)
+
+	removed := make(map[uint64]bool)
+
+	err := q.wal.Replay(func(seq uint64, data []byte) error {
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+
+		switch rec.Op {
+		case opSend:
+			if rec.Msg == nil {
+				return errors.New("send record without message")
+			}
+			q.restore(*rec.Msg, seq)
+			// A scheduled message is unscheduled by the record that sends it.
+			delete(q.byID, rec.ID)
+		case opBatch:
+			for _, msg := range rec.Msgs {
+				q.restore(msg, seq)
+			}
+		case opGroup:
+			addGroup(rec.Group, rec.Offset, rec.Claimed)
+		case opUngroup:
+			delete(groups, rec.Group)
+		case opSchedule:
+			if rec.Msg == nil || rec.At == nil {
+				return errors.New("schedule record without message")
+			}
+			q.byID[rec.Msg.ID] = &scheduled{msg: *rec.Msg, at: *rec.At, seq: seq}
+		case opUnschedule:
+			delete(q.byID, rec.ID)
+		case opRemove:
+			removed[rec.Offset] = true
+		case opDone:
+			if rg, ok := groups[rec.Group]; ok {
+				rg.done[rec.Offset] = true
+			}
+		case opDeliver:
+			if rg, ok := groups[rec.Group]; ok {
+				rg.attempts[rec.Offset]++
+			}
+		case opCheckpoint:
+			q.next = max(q.next, rec.Offset)
+			for name, start := range rec.Groups {
+				addGroup(name, start, rec.Claims[name])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range q.log {
+		e.removed = removed[e.offset]
+		if now.Sub(e.msg.Timestamp) < q.dedup.window {
+			q.dedup.add(e.msg)
+		}
+	}
+	for _, s := range q.byID {
+		heap.Push(&q.scheduled, s)
+	}
+
+	for name, rg := range groups {
+		g := newGroup(name, name != DefaultGroup || q.work, q.priorities)
+		g.start = rg.start
+		g.claimed = rg.claimed
+		g.cursor = q.next
+		for _, e := range q.log {
+			if e.offset < rg.start || rg.done[e.offset] || e.removed {
+				continue
+			}
+			if e.offset >= g.claimed {
+				q.claim(e)
+			}
+			attempts := rg.attempts[e.offset]
+			if g.levels != nil && attempts == 0 {
+				g.enqueue(e)
+				continue
+			}
+			g.retry = append(g.retry, item{entry: e, redelivered: attempts > 0})
+			if q.requireAck {
+				g.pending[e] = 1
+				if attempts > 0 {
+					g.attempts[e] = attempts
+				}
+			}
+		}
+		q.groups[name] = g
+	}
+
+	q.trim()
+
+	return nil
+}
+
+// restore adds a message read from the log.
+func (q *Queue) restore(msg Message, seq uint64) {
+	q.log = append(q.log, &entry{offset: msg.Offset, msg: msg, seq: seq})
+	q.bytes += int64(len(msg.Payload))
+	q.next = max(q.next, msg.Offset+1)
+}
+
+// logDelivery records a delivery of e to g on queues that require
+// acknowledgements, so that e counts as redelivered, and towards the
+// delivery limit, after a restart. The caller must hold q.mu.
+func (q *Queue) logDelivery(g *group, e *entry) {
+	if q.wal == nil || g.ephemeral || !q.requireAck {
+		return
+	}
+	if _, err := q.appendRecord(record{Op: opDeliver, Group: g.name, Offset: e.offset}); err != nil {
+		log.Printf("queue %s: mark delivery: %v", q.name, err)
+	}
+}
+
+// compact removes log segments that only hold entries no group needs any
+// more and no scheduled messages. The groups and the next offset are
+// written again first so that they survive the removal of the records that
+// declared them. The caller must hold q.mu.
+func (q *Queue) compact() {
+	if q.wal == nil {
+		return
+	}
+
+	oldest := q.wal.NextSeq()
+	if len(q.log) > 0 {
+		oldest = q.log[0].seq
+	}
+	for _, s := range q.scheduled {
+		oldest = min(oldest, s.seq)
+	}
+	if !q.wal.Truncatable(oldest) {
+		return
+	}
+
+	cp := record{Op: opCheckpoint, Offset: q.next, Groups: make(map[string]uint64), Claims: make(map[string]uint64)}
+	for name, g := range q.groups {
+		if name != DefaultGroup {
+			cp.Groups[name] = g.start
+			cp.Claims[name] = g.claimed
+		}
+	}
+	if _, err := q.appendRecord(cp); err != nil {
+		log.Printf("queue %s: write checkpoint: %v", q.name, err)
+		return
+	}
+
+	if err := q.wal.Truncate(oldest); err != nil {
+		log.Printf("queue %s: truncate log: %v", q.name, err)
+	}
+}
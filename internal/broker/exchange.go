@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/IgorLem99/simple_broker/internal/config"
+)
+
+// HeaderRoutingKey is set on messages published to an exchange.
+const HeaderRoutingKey = "routing-key"
+
+var (
+	ErrExchangeNotFound = errors.New("exchange not found")
+	ErrExchangeExists   = errors.New("exchange already exists")
+	ErrBindingNotFound  = errors.New("binding not found")
+	ErrUnroutable       = errors.New("no queue bound for routing key")
+)
+
+type exchange struct {
+	name     string
+	bindings []config.BindingConfig
+}
+
+func (x *exchange) config() config.ExchangeConfig {
+	return config.ExchangeConfig{
+		Name:     x.name,
+		Bindings: append([]config.BindingConfig(nil), x.bindings...),
+	}
+}
+
+// CreateExchange adds a topic exchange. Its bindings must name existing
+// queues.
+func (b *Broker) CreateExchange(ec config.ExchangeConfig) (config.ExchangeConfig, error) {
+	if err := ec.Validate(); err != nil {
+		return config.ExchangeConfig{}, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.exchanges[ec.Name]; ok {
+		return config.ExchangeConfig{}, ErrExchangeExists
+	}
+
+	x := &exchange{name: ec.Name}
+	for _, bc := range ec.Bindings {
+		if _, ok := b.queues[bc.Queue]; !ok {
+			return config.ExchangeConfig{}, ErrQueueNotFound
+		}
+		x.bind(bc)
+	}
+	b.exchanges[ec.Name] = x
+
+	return x.config(), nil
+}
+
+func (b *Broker) DeleteExchange(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.exchanges[name]; !ok {
+		return ErrExchangeNotFound
+	}
+	delete(b.exchanges, name)
+
+	return nil
+}
+
+func (b *Broker) GetExchange(name string) (config.ExchangeConfig, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	x, ok := b.exchanges[name]
+	if !ok {
+		return config.ExchangeConfig{}, ErrExchangeNotFound
+	}
+
+	return x.config(), nil
+}
+
+// Exchanges returns the exchanges of the broker ordered by name.
+func (b *Broker) Exchanges() []config.ExchangeConfig {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	exchanges := make([]config.ExchangeConfig, 0, len(b.exchanges))
+	for _, x := range b.exchanges {
+		exchanges = append(exchanges, x.config())
+	}
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].Name < exchanges[j].Name })
+
+	return exchanges
+}
+
+// Bind routes messages published to the exchange whose routing key matches
+// bc.Pattern to bc.Queue. Binding the same pattern twice has no effect.
+func (b *Broker) Bind(name string, bc config.BindingConfig) error {
+	if err := bc.Validate(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	x, ok := b.exchanges[name]
+	if !ok {
+		return ErrExchangeNotFound
+	}
+	if _, ok := b.queues[bc.Queue]; !ok {
+		return ErrQueueNotFound
+	}
+	x.bind(bc)
+
+	return nil
+}
+
+func (b *Broker) Unbind(name string, bc config.BindingConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	x, ok := b.exchanges[name]
+	if !ok {
+		return ErrExchangeNotFound
+	}
+	for i, existing := range x.bindings {
+		if existing == bc {
+			x.bindings = append(x.bindings[:i], x.bindings[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrBindingNotFound
+}
+
+func (x *exchange) bind(bc config.BindingConfig) {
+	for _, existing := range x.bindings {
+		if existing == bc {
+			return
+		}
+	}
+	x.bindings = append(x.bindings, bc)
+}
+
+// unbindQueue removes the bindings of a deleted queue. The caller must hold
+// b.mu.
+func (b *Broker) unbindQueue(queue string) {
+	for _, x := range b.exchanges {
+		bindings := x.bindings[:0]
+		for _, bc := range x.bindings {
+			if bc.Queue != queue {
+				bindings = append(bindings, bc)
+			}
+		}
+		x.bindings = bindings
+	}
+}
+
+// Route publishes msg through the named exchange to every queue with a
+// binding that matches key, either to all of them or to none, like Publish.
+// The routing key is added to the message headers.
+func (b *Broker) Route(name, key string, msg Message) ([]TxMessage, error) {
+	b.mu.RLock()
+	x, ok := b.exchanges[name]
+	var queues []string
+	if ok {
+		queues = x.route(key)
+	}
+	b.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrExchangeNotFound
+	}
+	if len(queues) == 0 {
+		return nil, ErrUnroutable
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRoutingKey] = key
+	msg.Headers = headers
+
+	tx := Tx{Messages: make([]TxMessage, len(queues))}
+	for i, queue := range queues {
+		tx.Messages[i] = TxMessage{Queue: queue, Message: msg}
+	}
+	sent, err := b.Publish(tx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tx.Messages {
+		tx.Messages[i].Message = sent[i]
+	}
+
+	return tx.Messages, nil
+}
+
+// Bound returns the queues with a binding of the named exchange that
+// matches key, for publishers that send to each of them on their own
+// rather than to all or none like Route.
+func (b *Broker) Bound(name, key string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	x, ok := b.exchanges[name]
+	if !ok {
+		return nil, ErrExchangeNotFound
+	}
+
+	return x.route(key), nil
+}
+
+// route returns the queues with a binding that matches key, each once, in
+// the order they were first bound.
+func (x *exchange) route(key string) []string {
+	words := strings.Split(key, ".")
+
+	var queues []string
+	seen := make(map[string]bool)
+	for _, bc := range x.bindings {
+		if seen[bc.Queue] || !match(strings.Split(bc.Pattern, "."), words) {
+			continue
+		}
+		seen[bc.Queue] = true
+		queues = append(queues, bc.Queue)
+	}
+
+	return queues
+}
+
+// match reports whether the words of a routing key match the words of a
+// binding pattern.
+func match(pattern, words []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			for i := 0; i <= len(words); i++ {
+				if match(pattern[1:], words[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+		default:
+			if len(words) == 0 || words[0] != pattern[0] {
+				return false
+			}
+		}
+		if len(words) == 0 {
+			return false
+		}
+		pattern, words = pattern[1:], words[1:]
+	}
+
+	return len(words) == 0
+}
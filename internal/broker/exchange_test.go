@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"orders.eu.created", "orders.eu.created", true},
+		{"orders.eu.created", "orders.us.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.#", "orders.eu.created", true},
+		{"orders.#", "orders", true},
+		{"orders.#.created", "orders.created", true},
+		{"orders.#.created", "orders.eu.paris.created", true},
+		{"orders.#.created", "orders.eu.deleted", false},
+		{"#", "anything.at.all", true},
+		{"*.#", "orders", true},
+		{"*", "orders.eu", false},
+	}
+	for _, tt := range tests {
+		got := match(strings.Split(tt.pattern, "."), strings.Split(tt.key, "."))
+		if got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestBroker_Exchanges(t *testing.T) {
+	b, err := New(&config.Config{
+		Queues: []config.QueueConfig{
+			{Name: "eu", Size: 10, MaxSub: 1},
+			{Name: "all", Size: 10, MaxSub: 1},
+			{Name: "audit", Size: 10, MaxSub: 1},
+		},
+		Exchanges: []config.ExchangeConfig{
+			{Name: "orders", Bindings: []config.BindingConfig{
+				{Queue: "eu", Pattern: "orders.eu.*"},
+				{Queue: "all", Pattern: "orders.#"},
+				{Queue: "all", Pattern: "#.created"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	defer b.Close()
+
+	routed := func(key string) []string {
+		t.Helper()
+		sent, err := b.Route("orders", key, text(key))
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", key, err)
+		}
+		var queues []string
+		for _, m := range sent {
+			if m.Headers[HeaderRoutingKey] != key {
+				t.Errorf("%s: expected routing key header, got %v", key, m.Headers)
+			}
+			queues = append(queues, m.Queue)
+		}
+		return queues
+	}
+
+	if got := routed("orders.eu.created"); !reflect.DeepEqual(got, []string{"eu", "all"}) {
+		t.Errorf("expected [eu all], got %v", got)
+	}
+	if got := routed("orders.us.created"); !reflect.DeepEqual(got, []string{"all"}) {
+		t.Errorf("expected [all], got %v", got)
+	}
+	if _, err := b.Route("orders", "payments.done", text("x")); err != ErrUnroutable {
+		t.Errorf("expected error %v, got %v", ErrUnroutable, err)
+	}
+	if _, err := b.Route("unknown", "orders.eu.created", text("x")); err != ErrExchangeNotFound {
+		t.Errorf("expected error %v, got %v", ErrExchangeNotFound, err)
+	}
+	if got, err := b.Bound("orders", "orders.eu.deleted"); err != nil || !reflect.DeepEqual(got, []string{"eu", "all"}) {
+		t.Errorf("expected [eu all], got %v and %v", got, err)
+	}
+
+	if err := b.Bind("orders", config.BindingConfig{Queue: "audit", Pattern: "payments.*"}); err != nil {
+		t.Fatalf("failed to bind: %v", err)
+	}
+	if err := b.Bind("orders", config.BindingConfig{Queue: "unknown", Pattern: "payments.*"}); err != ErrQueueNotFound {
+		t.Errorf("expected error %v, got %v", ErrQueueNotFound, err)
+	}
+	if got := routed("payments.done"); !reflect.DeepEqual(got, []string{"audit"}) {
+		t.Errorf("expected [audit], got %v", got)
+	}
+
+	if err := b.DeleteQueue("eu"); err != nil {
+		t.Fatalf("failed to delete queue: %v", err)
+	}
+	if err := b.Unbind("orders", config.BindingConfig{Queue: "all", Pattern: "#.created"}); err != nil {
+		t.Fatalf("failed to unbind: %v", err)
+	}
+	if err := b.Unbind("orders", config.BindingConfig{Queue: "all", Pattern: "#.created"}); err != ErrBindingNotFound {
+		t.Errorf("expected error %v, got %v", ErrBindingNotFound, err)
+	}
+	ec, _ := b.GetExchange("orders")
+	want := []config.BindingConfig{{Queue: "all", Pattern: "orders.#"}, {Queue: "audit", Pattern: "payments.*"}}
+	if !reflect.DeepEqual(ec.Bindings, want) {
+		t.Errorf("expected bindings %v, got %v", want, ec.Bindings)
+	}
+
+	all, _ := b.GetQueue("all")
+	sub, _ := all.Subscribe()
+	if got := receiveAll(t, sub, 2); !reflect.DeepEqual(got, []string{"orders.eu.created", "orders.us.created"}) {
+		t.Errorf("all: expected both orders, got %v", got)
+	}
+
+	if _, err := b.CreateExchange(config.ExchangeConfig{Name: "orders"}); err != ErrExchangeExists {
+		t.Errorf("expected error %v, got %v", ErrExchangeExists, err)
+	}
+	if err := b.DeleteExchange("orders"); err != nil {
+		t.Fatalf("failed to delete exchange: %v", err)
+	}
+	if len(b.Exchanges()) != 0 {
+		t.Errorf("expected no exchanges, got %v", b.Exchanges())
+	}
+}
@@ -0,0 +1,54 @@
+package broker
+
+import "time"
+
+// DefaultSweepInterval is how often a queue looks for expired messages and
+// messages past their retention age, unless a shorter limit calls for more.
+const DefaultSweepInterval = time.Second
+
+func (q *Queue) sweepInterval() time.Duration {
+	interval := DefaultSweepInterval
+	for _, limit := range []time.Duration{q.ttl, q.retention.age} {
+		if limit > 0 {
+			interval = min(interval, max(limit/4, 10*time.Millisecond))
+		}
+	}
+	return interval
+}
+
+// sweep drops expired messages in the background so that they stop taking
+// up space even if no subscriber comes along to skip them. It also forgets
+// the message IDs that left the dedup window.
+func (q *Queue) sweep() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.sweepInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var expired []*entry
+		q.mu.Lock()
+		for _, e := range q.log {
+			if e.refs > 0 && !e.removed && e.msg.expired(now) {
+				expired = append(expired, e)
+			}
+		}
+		for _, e := range expired {
+			q.remove(e)
+		}
+		q.trim()
+		q.dedup.prune(now)
+		q.mu.Unlock()
+
+		for _, e := range expired {
+			q.publishDeadLetter(e.msg, ReasonExpired)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"testing"
+	"time"
+)
+
+func TestQueue_Expiry(t *testing.T) {
+	t.Run("queue ttl frees capacity", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 1, MessageTTL: config.Duration(30 * time.Millisecond)})
+		defer q.Close()
+
+		future := time.Now().Add(time.Hour)
+		msg := text("m1")
+		msg.ExpiresAt = &future
+		m1, err := q.Send(msg)
+		if err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if want := m1.Timestamp.Add(30 * time.Millisecond); !m1.ExpiresAt.Equal(want) {
+			t.Errorf("expected the queue ttl to cap the expiry at %v, got %v", want, m1.ExpiresAt)
+		}
+		if _, err := q.Send(text("m2")); err != ErrQueueFull {
+			t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
+		}
+
+		waitFor(t, func() bool {
+			q.mu.RLock()
+			defer q.mu.RUnlock()
+			return q.live == 0
+		}, "expected m1 to expire")
+		if _, err := q.Send(text("m2")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	})
+
+	t.Run("expired messages are not delivered", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+		defer q.Close()
+
+		past := time.Now().Add(-time.Second)
+		msg := text("m1")
+		msg.ExpiresAt = &past
+		if _, err := q.Send(msg); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if _, err := q.Send(text("m2")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		sub, _ := q.Subscribe()
+		if d := receive(t, sub); textOf(d.Message) != "m2" {
+			t.Errorf("expected m2, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("expired messages are dead-lettered", func(t *testing.T) {
+		b, err := New(&config.Config{Queues: []config.QueueConfig{
+			{Name: "src", Size: 10, MaxSub: 1, MessageTTL: config.Duration(20 * time.Millisecond), DeadLetterQueue: "dlq"},
+			{Name: "dlq", Size: 10, MaxSub: 1},
+		}})
+		if err != nil {
+			t.Fatalf("failed to create broker: %v", err)
+		}
+		defer b.Close()
+
+		src, _ := b.GetQueue("src")
+		dlq, _ := b.GetQueue("dlq")
+		dead, _ := dlq.Subscribe()
+		if _, err := src.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		d := receive(t, dead)
+		if textOf(d.Message) != "m1" || d.Message.Headers[HeaderDeadLetterReason] != ReasonExpired {
+			t.Errorf("unexpected dead letter: %+v", d.Message)
+		}
+		if d.Message.ExpiresAt != nil {
+			t.Errorf("expected the dead letter not to expire, got %v", d.Message.ExpiresAt)
+		}
+	})
+
+	t.Run("in-flight deliveries can still be acknowledged", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, RequireAck: true, MessageTTL: config.Duration(20 * time.Millisecond)})
+		defer q.Close()
+
+		sub, _ := q.Subscribe()
+		if _, err := q.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		d := receive(t, sub)
+		waitFor(t, func() bool {
+			q.mu.RLock()
+			defer q.mu.RUnlock()
+			return q.live == 0
+		}, "expected m1 to expire")
+
+		if err := q.Ack(d.Tag); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+}
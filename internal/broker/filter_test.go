@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/filter"
+
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func order(t *testing.T, q *Queue, kind string, amount int) {
+	t.Helper()
+	payload, _ := json.Marshal(map[string]any{"amount": amount})
+	msg := Message{Headers: map[string]string{"type": kind}, Payload: payload}
+	if _, err := q.Send(msg); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+}
+
+func amounts(t *testing.T, sub Subscriber, n int) []float64 {
+	t.Helper()
+	var got []float64
+	for i := 0; i < n; i++ {
+		var payload struct{ Amount float64 }
+		_ = json.Unmarshal(receive(t, sub).Message.Payload, &payload)
+		got = append(got, payload.Amount)
+	}
+	return got
+}
+
+func noDelivery(t *testing.T, sub Subscriber) {
+	t.Helper()
+	select {
+	case d := <-sub:
+		t.Errorf("unexpected delivery %s", d.Message.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQueue_Filter(t *testing.T) {
+	big, err := filter.Parse("type = 'order' AND amount > 100")
+	if err != nil {
+		t.Fatalf("failed to parse filter: %v", err)
+	}
+
+	t.Run("broadcast", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2})
+		defer q.Close()
+
+		filtered, _ := q.Subscribe(WithFilter(big))
+		all, _ := q.Subscribe()
+		order(t, q, "order", 50)
+		order(t, q, "refund", 500)
+		order(t, q, "order", 150)
+
+		if got := amounts(t, filtered, 1); !reflect.DeepEqual(got, []float64{150}) {
+			t.Errorf("filtered: expected [150], got %v", got)
+		}
+		noDelivery(t, filtered)
+		if got := amounts(t, all, 3); !reflect.DeepEqual(got, []float64{50, 500, 150}) {
+			t.Errorf("all: expected every message, got %v", got)
+		}
+	})
+
+	t.Run("work group", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2, RequireAck: true})
+		defer q.Close()
+
+		filtered, _ := q.Subscribe(WithGroup("billing"), WithFilter(big))
+		order(t, q, "order", 50)
+		order(t, q, "order", 150)
+
+		d := receive(t, filtered)
+		if err := q.Ack(d.Tag); err != nil {
+			t.Fatalf("failed to ack: %v", err)
+		}
+		noDelivery(t, filtered)
+
+		// The group skipped the message no member matched.
+		waitFor(t, func() bool {
+			q.mu.RLock()
+			defer q.mu.RUnlock()
+			g := q.groups["billing"]
+			return len(g.pending) == 0 && g.cursor == 2
+		}, "expected the group to be done with both messages")
+
+		other, _ := q.Subscribe(WithGroup("billing"))
+		order(t, q, "order", 10)
+		order(t, q, "order", 200)
+		order(t, q, "order", 300)
+
+		// The small order can only go to the member without a filter.
+		got := map[float64]Subscriber{}
+		for i := 0; i < 3; i++ {
+			select {
+			case d := <-filtered:
+				got[amounts(t, singleDelivery(d), 1)[0]] = filtered
+			case d := <-other:
+				got[amounts(t, singleDelivery(d), 1)[0]] = other
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for message")
+			}
+		}
+		if got[10] != other {
+			t.Errorf("expected the small order to go to the member without a filter")
+		}
+		if len(got) != 3 {
+			t.Errorf("expected every order to be delivered once, got %v", got)
+		}
+	})
+}
+
+// singleDelivery returns a subscriber that holds just d.
+func singleDelivery(d Delivery) Subscriber {
+	sub := make(Subscriber, 1)
+	sub <- d
+	return sub
+}
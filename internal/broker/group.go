@@ -0,0 +1,449 @@
+package broker
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultGroup is the group of subscribers that do not name one. It follows
+// the delivery mode of the queue, while named groups always share messages
+// between their members.
+const DefaultGroup = ""
+
+var (
+	ErrGroupNotFound = errors.New("consumer group not found")
+	ErrGroupInUse    = errors.New("consumer group has subscribers")
+	ErrQueueClosed   = errors.New("queue closed")
+)
+
+// item is an entry waiting for dispatch within a group. A redelivered item
+// is sent only to the subscriber that failed to acknowledge it, if that one
+// is still around.
+type item struct {
+	*entry
+	target      *subscriber
+	redelivered bool
+}
+
+// group is a set of subscribers that consume the queue together. Entries
+// from cursor onwards have not been dispatched to the group yet; retry holds
+// older entries that have to be dispatched again. On priority queues the
+// entries before cursor that wait for dispatch are kept in levels. Entries
+// before claimed were already consumed when the group was created and are
+// only read from retention, so they do not count against the queue size.
+type group struct {
+	name      string
+	work      bool
+	ephemeral bool
+	members   []*subscriber
+	next      int
+	start     uint64
+	claimed   uint64
+	cursor    uint64
+	retry     []item
+	deleted   bool
+	levels    [][]*entry
+
+	// dispatching counts the dispatches of every entry that still wait in
+	// subscriber buffers.
+	dispatching map[*entry]int
+
+	// pending counts the unacknowledged deliveries and queued redeliveries
+	// of every entry on queues that require acknowledgements, and attempts
+	// how often each of them was delivered.
+	pending  map[*entry]int
+	attempts map[*entry]int
+}
+
+func newGroup(name string, work bool, priorities int) *group {
+	g := &group{
+		name:        name,
+		work:        work,
+		dispatching: make(map[*entry]int),
+		pending:     make(map[*entry]int),
+		attempts:    make(map[*entry]int),
+	}
+	if priorities > 1 {
+		g.levels = make([][]*entry, priorities)
+	}
+	return g
+}
+
+func (g *group) leave(s *subscriber) {
+	for i, m := range g.members {
+		if m == s {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			if g.next > i {
+				g.next--
+			}
+			return
+		}
+	}
+}
+
+// pick chooses the member that receives the next message of a group that
+// shares messages among the members that accept it. Members take turns;
+// with least-busy dispatch the one with the fewest unacknowledged
+// deliveries is preferred. It returns nil if no member accepts the message.
+func (g *group) pick(leastBusy bool, accepts func(*subscriber) bool) *subscriber {
+	n := len(g.members)
+	best := -1
+	for i := 0; i < n; i++ {
+		j := (g.next + i) % n
+		if !accepts(g.members[j]) {
+			continue
+		}
+		if best < 0 {
+			best = j
+			if !leastBusy {
+				break
+			}
+		} else if g.members[j].unacked < g.members[best].unacked {
+			best = j
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	g.next = best + 1
+
+	return g.members[best]
+}
+
+// joinGroup returns the group a subscriber with options o belongs to,
+// creating it if needed. A new group starts at the requested position or
+// else at the oldest message not consumed yet. The caller must hold q.mu.
+func (q *Queue) joinGroup(o subscribeOptions) (*group, error) {
+	if q.closing() {
+		return nil, ErrQueueClosed
+	}
+
+	start, explicit := q.position(o)
+	if o.group == DefaultGroup && explicit {
+		g := newGroup(DefaultGroup, true, q.priorities)
+		g.ephemeral = true
+		q.ephemeral[g] = struct{}{}
+		q.startGroup(g, start)
+		return g, nil
+	}
+
+	if g, ok := q.groups[o.group]; ok {
+		return g, nil
+	}
+
+	if q.wal != nil {
+		rec := record{Op: opGroup, Group: o.group, Offset: start, Claimed: max(start, q.firstLive())}
+		if _, err := q.appendRecord(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	g := newGroup(o.group, true, q.priorities)
+	q.groups[o.group] = g
+	q.startGroup(g, start)
+
+	return g, nil
+}
+
+// startGroup positions a new group at start and launches its dispatcher.
+// The caller must hold q.mu.
+func (q *Queue) startGroup(g *group, start uint64) {
+	g.start = start
+	g.cursor = start
+	g.claimed = max(start, q.firstLive())
+	for _, e := range q.log {
+		if e.offset >= g.claimed {
+			q.claim(e)
+		}
+	}
+
+	q.wg.Add(1)
+	go q.dispatch(g)
+}
+
+// DeleteGroup removes a named consumer group that has no subscribers so that
+// the queue stops holding messages for it.
+func (q *Queue) DeleteGroup(name string) error {
+	if q.parts != nil {
+		return q.deleteGroupPartitions(name)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	g, ok := q.groups[name]
+	if !ok || name == DefaultGroup {
+		return ErrGroupNotFound
+	}
+	if len(g.members) > 0 {
+		return ErrGroupInUse
+	}
+
+	if q.wal != nil {
+		if _, err := q.appendRecord(record{Op: opUngroup, Group: name}); err != nil {
+			return err
+		}
+	}
+
+	q.dropGroup(g)
+
+	return nil
+}
+
+// dropGroup stops g and releases the entries it still held. The caller must
+// hold q.mu.
+func (q *Queue) dropGroup(g *group) {
+	claimed := make(map[*entry]struct{})
+	for offset := max(g.cursor, g.claimed); offset < q.next; offset++ {
+		claimed[q.at(offset)] = struct{}{}
+	}
+	for _, it := range g.retry {
+		claimed[it.entry] = struct{}{}
+	}
+	for e := range g.pending {
+		claimed[e] = struct{}{}
+	}
+	for e := range g.dispatching {
+		claimed[e] = struct{}{}
+	}
+	for _, level := range g.levels {
+		for _, e := range level {
+			claimed[e] = struct{}{}
+		}
+	}
+	for tag, d := range q.inflight {
+		if d.group == g {
+			q.forget(tag, d)
+		}
+	}
+
+	g.deleted = true
+	if g.ephemeral {
+		delete(q.ephemeral, g)
+	} else {
+		delete(q.groups, g.name)
+	}
+	for e := range claimed {
+		if e.offset >= g.claimed && !e.removed {
+			q.release(e)
+		}
+	}
+	q.cond.Broadcast()
+}
+
+func (q *Queue) dispatch(g *group) {
+	defer q.wg.Done()
+
+	for {
+		q.mu.Lock()
+		for !q.closing() && !g.deleted && !q.ready(g) {
+			q.cond.Wait()
+		}
+		if q.closing() || g.deleted {
+			q.mu.Unlock()
+			return
+		}
+
+		it := q.take(g)
+		if it.msg.expired(time.Now()) {
+			live := q.remove(it.entry)
+			q.undispatch(g, it.entry)
+			q.mu.Unlock()
+			if live {
+				q.publishDeadLetter(it.msg, ReasonExpired)
+			}
+			continue
+		}
+
+		targets := q.targets(g, it)
+		if len(targets) == 0 {
+			// No member's filter matches, so the group skips the message.
+			q.complete(&dispatchState{group: g, it: it, left: 1, delivered: true}, true)
+			q.mu.Unlock()
+			continue
+		}
+		st := &dispatchState{group: g, it: it, left: len(targets)}
+		if q.requireAck {
+			g.attempts[it.entry]++
+			q.logDelivery(g, it.entry)
+		}
+		for _, s := range targets {
+			d := Delivery{Redelivered: it.redelivered, Message: it.msg}
+			if q.requireAck {
+				d.Tag = q.track(g, it.entry, s)
+			}
+			q.offer(s, queued{d: d, st: st})
+		}
+		q.mu.Unlock()
+	}
+}
+
+// ready reports whether g has members and something to send them. The
+// caller must hold q.mu.
+func (q *Queue) ready(g *group) bool {
+	return q.waiting(g) && len(g.members) > 0
+}
+
+// waiting reports whether g has something to send. It moves the cursor past
+// removed entries on the way. The caller must hold q.mu.
+func (q *Queue) waiting(g *group) bool {
+	if g.levels != nil {
+		q.drain(g)
+		return len(g.retry) > 0 || g.queued()
+	}
+
+	for g.cursor < q.next && q.at(g.cursor).removed {
+		g.cursor++
+	}
+	return len(g.retry) > 0 || g.cursor < q.next
+}
+
+// holds reports whether g has not finished with e yet. The caller must hold
+// q.mu.
+func (q *Queue) holds(g *group, e *entry) bool {
+	switch {
+	case e.offset >= g.cursor, g.pending[e] > 0:
+		return true
+	case g.dispatching[e] > 0:
+		return true
+	case g.levels != nil && g.isQueued(e):
+		return true
+	}
+	for _, it := range g.retry {
+		if it.entry == e {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes the next item to dispatch from g, preferring redeliveries.
+// The caller must hold q.mu.
+func (q *Queue) take(g *group) item {
+	var it item
+	switch {
+	case len(g.retry) > 0:
+		it = g.retry[0]
+		g.retry = g.retry[1:]
+	case g.levels != nil:
+		it = item{entry: g.dequeue(q.aging, time.Now())}
+		if q.requireAck {
+			g.pending[it.entry]++
+		}
+	default:
+		it = item{entry: q.at(g.cursor)}
+		g.cursor++
+		if q.requireAck {
+			g.pending[it.entry]++
+		}
+	}
+	g.dispatching[it.entry]++
+
+	return it
+}
+
+// undispatch records that one dispatch of e in g is over. The caller must
+// hold q.mu.
+func (q *Queue) undispatch(g *group, e *entry) {
+	g.dispatching[e]--
+	if g.dispatching[e] <= 0 {
+		delete(g.dispatching, e)
+	}
+}
+
+// targets returns the members of g that it should be sent to. The caller
+// must hold q.mu.
+func (q *Queue) targets(g *group, it item) []*subscriber {
+	lookup := messageFields(it.msg)
+	accepts := func(s *subscriber) bool {
+		return s.filter == nil || s.filter.Match(lookup)
+	}
+
+	switch {
+	case g.work:
+		if s := g.pick(q.leastBusy, accepts); s != nil {
+			return []*subscriber{s}
+		}
+		return nil
+	case it.target != nil && it.target.group == g && q.subs[it.target.ch] == it.target:
+		return []*subscriber{it.target}
+	default:
+		var targets []*subscriber
+		for _, s := range g.members {
+			if accepts(s) {
+				targets = append(targets, s)
+			}
+		}
+		return targets
+	}
+}
+
+// dispatchState follows one dispatch of an item to its targets.
+type dispatchState struct {
+	group     *group
+	it        item
+	left      int
+	delivered bool
+}
+
+// complete records the outcome of dispatching to one target. Once every
+// target is done the item is finished, or queued again if nobody received
+// it, for example because every member went away. The caller must hold q.mu.
+func (q *Queue) complete(st *dispatchState, delivered bool) {
+	st.delivered = st.delivered || delivered
+	st.left--
+	if st.left > 0 {
+		return
+	}
+
+	g, it := st.group, st.it
+	q.undispatch(g, it.entry)
+	if g.deleted || it.removed {
+		return
+	}
+
+	if !st.delivered {
+		if q.requireAck {
+			g.attempts[it.entry]--
+		}
+		g.retry = append([]item{it}, g.retry...)
+		q.announce()
+		return
+	}
+
+	if q.requireAck {
+		q.unpend(g, it.entry)
+	} else {
+		q.finish(g, it.entry)
+	}
+}
+
+// unpend drops one pending delivery of e in g and finishes e once none are
+// left. The caller must hold q.mu.
+func (q *Queue) unpend(g *group, e *entry) {
+	if e.removed {
+		return
+	}
+	g.pending[e]--
+	if g.pending[e] > 0 {
+		return
+	}
+	delete(g.pending, e)
+	delete(g.attempts, e)
+	q.finish(g, e)
+}
+
+// finish records that g is done with e. Entries before claimed are only
+// read from retention and have nothing to release. The caller must hold
+// q.mu.
+func (q *Queue) finish(g *group, e *entry) {
+	if q.wal != nil && !g.ephemeral {
+		if _, err := q.appendRecord(record{Op: opDone, Group: g.name, Offset: e.offset}); err != nil {
+			log.Printf("queue %s: mark delivered: %v", q.name, err)
+		}
+	}
+	if e.offset >= g.claimed {
+		q.release(e)
+	}
+}
@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueue_Groups(t *testing.T) {
+	t.Run("every group receives the full stream", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 4})
+		defer q.Close()
+
+		billing1, _ := q.Subscribe(WithGroup("billing"))
+		billing2, _ := q.Subscribe(WithGroup("billing"))
+		audit, _ := q.Subscribe(WithGroup("audit"))
+
+		for _, msg := range []string{"m1", "m2"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send %q: %v", msg, err)
+			}
+		}
+
+		// Members of a group take turns.
+		if d := receive(t, billing1); !reflect.DeepEqual(textOf(d.Message), "m1") {
+			t.Errorf("billing1: expected m1, got %v", textOf(d.Message))
+		}
+		if d := receive(t, billing2); !reflect.DeepEqual(textOf(d.Message), "m2") {
+			t.Errorf("billing2: expected m2, got %v", textOf(d.Message))
+		}
+
+		var got []string
+		for i := 0; i < 2; i++ {
+			got = append(got, textOf(receive(t, audit).Message))
+		}
+		if !reflect.DeepEqual(got, []string{"m1", "m2"}) {
+			t.Errorf("audit: expected [m1 m2], got %v", got)
+		}
+	})
+
+	t.Run("group keeps its position without members", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2})
+		defer q.Close()
+
+		sub, _ := q.Subscribe(WithGroup("billing"))
+		if _, err := q.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		receive(t, sub)
+		waitFor(t, func() bool {
+			q.mu.RLock()
+			defer q.mu.RUnlock()
+			return q.groups["billing"].cursor == 1 && len(q.groups["billing"].dispatching) == 0
+		}, "expected m1 to be dispatched")
+		q.Unsubscribe(sub)
+
+		if _, err := q.Send(text("m2")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		sub, _ = q.Subscribe(WithGroup("billing"))
+		if d := receive(t, sub); !reflect.DeepEqual(textOf(d.Message), "m2") {
+			t.Errorf("expected m2, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("messages are held for every group", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 2})
+		defer q.Close()
+
+		sub, _ := q.Subscribe()
+		_, _ = q.Subscribe(WithGroup("idle"))
+		if _, err := q.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		receive(t, sub)
+
+		if _, err := q.Send(text("m2")); err != ErrQueueFull {
+			t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
+		}
+	})
+}
+
+func TestQueue_DeleteGroup(t *testing.T) {
+	q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 2})
+	defer q.Close()
+
+	sub, _ := q.Subscribe(WithGroup("billing"))
+	if _, err := q.Send(text("m1")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	if err := q.DeleteGroup("billing"); err != ErrGroupInUse {
+		t.Fatalf("expected error %v, got %v", ErrGroupInUse, err)
+	}
+	if err := q.DeleteGroup("unknown"); err != ErrGroupNotFound {
+		t.Fatalf("expected error %v, got %v", ErrGroupNotFound, err)
+	}
+	if err := q.DeleteGroup(DefaultGroup); err != ErrGroupNotFound {
+		t.Fatalf("expected error %v, got %v", ErrGroupNotFound, err)
+	}
+
+	q.Unsubscribe(sub)
+	if err := q.DeleteGroup("billing"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// The default group still holds m1.
+	if _, err := q.Send(text("m2")); err != ErrQueueFull {
+		t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
+	}
+	def, _ := q.Subscribe()
+	receive(t, def)
+	waitFor(t, func() bool {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		return q.live == 0
+	}, "expected queue to be empty once the default group got m1")
+}
+
+func TestQueue_DurableGroups(t *testing.T) {
+	dir := t.TempDir()
+	qCfg := config.QueueConfig{Size: 10, MaxSub: 2, Durable: true}
+
+	q, err := OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	sub, _ := q.Subscribe(WithGroup("billing"))
+	for _, msg := range []string{"m1", "m2"} {
+		if _, err := q.Send(text(msg)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	receive(t, sub)
+	q.Unsubscribe(sub)
+	q.Close()
+
+	q, err = OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	defer q.Close()
+
+	sub, _ = q.Subscribe(WithGroup("billing"))
+	if d := receive(t, sub); !reflect.DeepEqual(textOf(d.Message), "m2") {
+		t.Errorf("billing: expected m2, got %v", textOf(d.Message))
+	}
+
+	// The default group never had subscribers and gets everything.
+	def, _ := q.Subscribe()
+	var got []string
+	for i := 0; i < 2; i++ {
+		got = append(got, textOf(receive(t, def).Message))
+	}
+	if !reflect.DeepEqual(got, []string{"m1", "m2"}) {
+		t.Errorf("default: expected [m1 m2], got %v", got)
+	}
+
+	select {
+	case d := <-sub:
+		t.Errorf("billing: unexpected message %v", textOf(d.Message))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
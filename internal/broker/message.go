@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/filter"
+)
+
+// Message is the envelope a payload travels in. Send assigns the ID (unless
+// one is given), the offset, which grows by one with every message accepted
+// by the queue, and the timestamp. A message that is not delivered by
+// ExpiresAt is dropped. On queues with priority levels, messages with a
+// higher Priority are delivered first. On partitioned queues offsets count
+// per Partition.
+type Message struct {
+	ID        string            `json:"id"`
+	Offset    uint64            `json:"offset"`
+	Partition int               `json:"partition,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Priority  int               `json:"priority,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   json.RawMessage   `json:"payload"`
+}
+
+func (m Message) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// messageFields returns the lookup filters use for msg. It decodes the
+// payload the first time a field is not among the headers.
+func messageFields(msg Message) filter.Lookup {
+	var payload map[string]any
+	decoded := false
+
+	return func(name string) (any, bool) {
+		if v, ok := msg.Headers[name]; ok {
+			return v, true
+		}
+		if !decoded {
+			decoded = true
+			_ = json.Unmarshal(msg.Payload, &payload)
+		}
+		v, ok := payload[name]
+		return v, ok
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,387 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/IgorLem99/simple_broker/internal/config"
+)
+
+// HeaderPartitionKey selects the partition of a message on a partitioned
+// queue. Messages with the same key go to the same partition and are
+// delivered in the order they were sent.
+const HeaderPartitionKey = "partition-key"
+
+var ErrPartitionedOffset = errors.New("offsets are per partition; subscribe with a time instead")
+
+// member is a subscriber of a partitioned queue. It is subscribed to the
+// partitions in attached with its own channel. Members that share the
+// messages of a group own some of the partitions each, the others are
+// subscribed to all of them.
+type member struct {
+	id       uint64
+	ch       Subscriber
+	opts     subscribeOptions
+	shared   bool
+	attached []bool
+}
+
+// PartitionInfo describes one partition of a queue. Subscribers lists the
+// subscribers the partition delivers to.
+type PartitionInfo struct {
+	Partition   int      `json:"partition"`
+	Messages    int      `json:"messages"`
+	Retained    int      `json:"retained"`
+	NextOffset  uint64   `json:"next_offset"`
+	Subscribers []uint64 `json:"subscribers,omitempty"`
+}
+
+// newPartitions creates a queue that spreads its messages over
+// cfg.Partitions queues. Each of them gets the size, retention and dedup
+// window of cfg. open creates partition i.
+func newPartitions(cfg config.QueueConfig, open func(i int, pc config.QueueConfig) (*Queue, error)) (*Queue, error) {
+	q := newQueue(cfg)
+	q.members = make(map[Subscriber]*member)
+	q.shared = make(map[string][]*member)
+
+	pc := cfg
+	pc.Partitions = 0
+	for i := 0; i < cfg.Partitions; i++ {
+		p, err := open(i, pc)
+		if err != nil {
+			for _, p := range q.parts {
+				p.Close()
+			}
+			return nil, fmt.Errorf("partition %d: %w", i, err)
+		}
+		p.mu.Lock()
+		p.partition = i
+		p.nextTag = uint64(i)
+		p.tagStride = uint64(cfg.Partitions)
+		p.notify = q.notifyArrival
+		p.mu.Unlock()
+		q.parts = append(q.parts, p)
+	}
+
+	return q, nil
+}
+
+// openPartitions is OpenQueue for partitioned queues. Partition i keeps its
+// log in a directory named i below dir.
+func openPartitions(cfg config.QueueConfig, dir string) (*Queue, error) {
+	return newPartitions(cfg, func(i int, pc config.QueueConfig) (*Queue, error) {
+		return OpenQueue(pc, filepath.Join(dir, strconv.Itoa(i)))
+	})
+}
+
+// partitionFor returns the partition msg goes to: the one its partition key
+// hashes to, or else the one its ID hashes to, so that duplicates meet in
+// the same dedup window. Messages without either are spread round-robin.
+func (q *Queue) partitionFor(msg Message) *Queue {
+	key := msg.Headers[HeaderPartitionKey]
+	if key == "" {
+		key = msg.ID
+	}
+	if key == "" {
+		return q.parts[(q.spread.Add(1)-1)%uint64(len(q.parts))]
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return q.parts[h.Sum32()%uint32(len(q.parts))]
+}
+
+// partitionOf returns the partition that issued a delivery tag.
+func (q *Queue) partitionOf(tag uint64) *Queue {
+	return q.parts[tag%uint64(len(q.parts))]
+}
+
+// subscribePartitions is Subscribe for partitioned queues. Members of named
+// groups, and of the default group on work queues, share the partitions
+// among them; adding one moves partitions over from the others.
+func (q *Queue) subscribePartitions(o subscribeOptions) (Subscriber, error) {
+	if o.offset != nil {
+		return nil, ErrPartitionedOffset
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closing() {
+		return nil, ErrQueueClosed
+	}
+	if len(q.members) >= q.maxSub {
+		return nil, ErrTooManySub
+	}
+
+	q.nextSub++
+	m := &member{
+		id:       q.nextSub,
+		ch:       make(Subscriber),
+		opts:     o,
+		shared:   o.group != DefaultGroup || (q.work && o.since.IsZero() && o.offsets == nil),
+		attached: make([]bool, len(q.parts)),
+	}
+	q.members[m.ch] = m
+
+	var err error
+	if m.shared {
+		q.shared[o.group] = append(q.shared[o.group], m)
+		err = q.rebalance(o.group)
+	} else {
+		for i := range q.parts {
+			if err = q.attachMember(m, i); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		q.removeMember(m)
+		return nil, err
+	}
+
+	return m.ch, nil
+}
+
+func (q *Queue) unsubscribePartitions(sub Subscriber) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m, ok := q.members[sub]
+	if !ok {
+		return
+	}
+	q.removeMember(m)
+	close(sub)
+}
+
+// attachMember subscribes m to partition i. The caller must hold q.mu.
+func (q *Queue) attachMember(m *member, i int) error {
+	p := q.parts[i]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	disconnect := func() { q.unsubscribePartitions(m.ch) }
+	if err := p.attach(m.ch, m.id, m.opts, disconnect); err != nil {
+		return err
+	}
+	m.attached[i] = true
+
+	return nil
+}
+
+// detachMember ends the subscription of m to partition i. The caller must
+// hold q.mu.
+func (q *Queue) detachMember(m *member, i int) {
+	q.parts[i].drop(m.ch)
+	m.attached[i] = false
+}
+
+// removeMember detaches m from every partition and hands the partitions it
+// owned to the other members of its group. The caller must hold q.mu.
+func (q *Queue) removeMember(m *member) {
+	delete(q.members, m.ch)
+	for i, ok := range m.attached {
+		if ok {
+			q.detachMember(m, i)
+		}
+	}
+
+	if !m.shared {
+		return
+	}
+	members := q.shared[m.opts.group]
+	for i, other := range members {
+		if other == m {
+			q.shared[m.opts.group] = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(q.shared[m.opts.group]) == 0 {
+		delete(q.shared, m.opts.group)
+		return
+	}
+	if err := q.rebalance(m.opts.group); err != nil {
+		log.Printf("queue %s: rebalance group %q: %v", q.name, m.opts.group, err)
+	}
+}
+
+// rebalance spreads the partitions evenly over the members of a group in
+// the order they joined: partition i goes to member i modulo their number.
+// Partitions are taken away from their previous owners before they are
+// handed to new ones, so that no partition has two owners at a time. The
+// caller must hold q.mu.
+func (q *Queue) rebalance(group string) error {
+	members := q.shared[group]
+	owner := func(i int) *member { return members[i%len(members)] }
+
+	for _, m := range members {
+		for i, ok := range m.attached {
+			if ok && owner(i) != m {
+				q.detachMember(m, i)
+			}
+		}
+	}
+	for i := range q.parts {
+		if m := owner(i); !m.attached[i] {
+			if err := q.attachMember(m, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendBatchPartitions is SendBatch for partitioned queues. Without atomic
+// the messages are added in order until one does not fit its partition.
+func (q *Queue) sendBatchPartitions(msgs []Message, atomic bool) ([]Message, error) {
+	byPart := make(map[*Queue][]int)
+	for i, msg := range msgs {
+		p := q.partitionFor(msg)
+		byPart[p] = append(byPart[p], i)
+	}
+	shares := make([]share, 0, len(byPart))
+	for p, idx := range byPart {
+		shares = append(shares, share{q: p, idx: idx})
+	}
+
+	return publish(shares, msgs, atomic)
+}
+
+func (q *Queue) scheduledPartitions() []ScheduledMessage {
+	var list []ScheduledMessage
+	for _, p := range q.parts {
+		list = append(list, p.Scheduled()...)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].DeliverAt.Before(list[j].DeliverAt) })
+
+	return list
+}
+
+func (q *Queue) cancelPartitions(id string) error {
+	for _, p := range q.parts {
+		if err := p.Cancel(id); err != ErrNotScheduled {
+			return err
+		}
+	}
+	return ErrNotScheduled
+}
+
+// settlePartitions hands each delivery tag to the partition that issued it.
+func (q *Queue) settlePartitions(tags []uint64, settle func(p *Queue, tags []uint64) error) error {
+	byPart := make(map[*Queue][]uint64)
+	for _, tag := range tags {
+		p := q.partitionOf(tag)
+		byPart[p] = append(byPart[p], tag)
+	}
+
+	var err error
+	for p, tags := range byPart {
+		if e := settle(p, tags); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (q *Queue) deleteGroupPartitions(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if name == DefaultGroup {
+		return ErrGroupNotFound
+	}
+	if len(q.shared[name]) > 0 {
+		return ErrGroupInUse
+	}
+
+	err := ErrGroupNotFound
+	for _, p := range q.parts {
+		switch e := p.DeleteGroup(name); e {
+		case nil:
+			if err == ErrGroupNotFound {
+				err = nil
+			}
+		case ErrGroupNotFound:
+		default:
+			err = e
+		}
+	}
+	return err
+}
+
+func (q *Queue) infoPartitions() QueueInfo {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	info := QueueInfo{
+		QueueConfig: q.cfg,
+		Subscribers: len(q.members),
+		Partitions:  make([]PartitionInfo, len(q.parts)),
+	}
+	groups := make(map[string]struct{})
+	for i, p := range q.parts {
+		pi := p.Info()
+		info.Messages += pi.Messages
+		info.Retained += pi.Retained
+		info.NextOffset += pi.NextOffset
+		info.Scheduled += pi.Scheduled
+		info.Penalized = append(info.Penalized, pi.Penalized...)
+		for _, name := range pi.Groups {
+			groups[name] = struct{}{}
+		}
+
+		info.Partitions[i] = PartitionInfo{
+			Partition:  i,
+			Messages:   pi.Messages,
+			Retained:   pi.Retained,
+			NextOffset: pi.NextOffset,
+		}
+	}
+	for name := range groups {
+		info.Groups = append(info.Groups, name)
+	}
+	sort.Strings(info.Groups)
+
+	for _, m := range q.members {
+		for i, ok := range m.attached {
+			if ok {
+				info.Partitions[i].Subscribers = append(info.Partitions[i].Subscribers, m.id)
+			}
+		}
+	}
+	for i := range info.Partitions {
+		subs := info.Partitions[i].Subscribers
+		sort.Slice(subs, func(a, b int) bool { return subs[a] < subs[b] })
+	}
+
+	return info
+}
+
+// closePartitions closes every partition and then ends the subscriptions.
+func (q *Queue) closePartitions() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return
+	default:
+		close(q.done)
+	}
+
+	for _, p := range q.parts {
+		p.Close()
+	}
+	for sub := range q.members {
+		delete(q.members, sub)
+		close(sub)
+	}
+	q.shared = make(map[string][]*member)
+}
@@ -0,0 +1,201 @@
+package broker
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/IgorLem99/simple_broker/internal/config"
+)
+
+func keyed(s, key string) Message {
+	msg := text(s)
+	msg.Headers = map[string]string{HeaderPartitionKey: key}
+	return msg
+}
+
+func owners(q *Queue) [][]uint64 {
+	var list [][]uint64
+	for _, p := range q.Info().Partitions {
+		list = append(list, p.Subscribers)
+	}
+	return list
+}
+
+func TestQueue_Partitions(t *testing.T) {
+	t.Run("same key keeps order within a partition", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, Partitions: 4})
+		defer q.Close()
+
+		sub, _ := q.Subscribe()
+		keys := []string{"a", "b", "c", "d"}
+		for i := 0; i < 20; i++ {
+			key := keys[i%len(keys)]
+			if _, err := q.Send(keyed(fmt.Sprintf("%s%d", key, i/len(keys)), key)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+
+		got := make(map[string][]string)
+		partitions := make(map[string]map[int]bool)
+		for i := 0; i < 20; i++ {
+			d := receive(t, sub)
+			key := d.Message.Headers[HeaderPartitionKey]
+			got[key] = append(got[key], textOf(d.Message))
+			if partitions[key] == nil {
+				partitions[key] = make(map[int]bool)
+			}
+			partitions[key][d.Message.Partition] = true
+		}
+
+		for _, key := range keys {
+			var want []string
+			for i := 0; i < 5; i++ {
+				want = append(want, fmt.Sprintf("%s%d", key, i))
+			}
+			if !reflect.DeepEqual(got[key], want) {
+				t.Errorf("key %s: expected %v, got %v", key, want, got[key])
+			}
+			if len(partitions[key]) != 1 {
+				t.Errorf("key %s: expected one partition, got %v", key, partitions[key])
+			}
+		}
+
+		if info := q.Info(); info.NextOffset != 20 || len(info.Partitions) != 4 {
+			t.Errorf("expected 20 messages over 4 partitions, got %d over %d", info.NextOffset, len(info.Partitions))
+		}
+	})
+
+	t.Run("work subscribers share partitions", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 3, Partitions: 4, DeliveryMode: config.DeliveryWork})
+		defer q.Close()
+
+		sub1, _ := q.Subscribe()
+		id1, _ := q.SubscriberID(sub1)
+		if got, want := owners(q), [][]uint64{{id1}, {id1}, {id1}, {id1}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected owners %v, got %v", want, got)
+		}
+
+		sub2, _ := q.Subscribe()
+		id2, _ := q.SubscriberID(sub2)
+		if got, want := owners(q), [][]uint64{{id1}, {id2}, {id1}, {id2}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected owners %v, got %v", want, got)
+		}
+
+		// A broadcast subscriber would get every partition, but a named
+		// group shares them among its members.
+		billing, _ := q.Subscribe(WithGroup("billing"))
+		idb, _ := q.SubscriberID(billing)
+		if got, want := owners(q), [][]uint64{{id1, idb}, {id2, idb}, {id1, idb}, {id2, idb}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected owners %v, got %v", want, got)
+		}
+
+		msg, err := q.Send(keyed("m1", "k"))
+		if err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		owner := sub1
+		if msg.Partition%2 == 1 {
+			owner = sub2
+		}
+		if d := receive(t, owner); textOf(d.Message) != "m1" {
+			t.Errorf("expected m1, got %v", textOf(d.Message))
+		}
+		receive(t, billing)
+
+		q.Unsubscribe(sub1)
+		if got, want := owners(q), [][]uint64{{id2, idb}, {id2, idb}, {id2, idb}, {id2, idb}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected owners %v, got %v", want, got)
+		}
+
+		if _, err := q.Send(keyed("m2", "k")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if d := receive(t, sub2); textOf(d.Message) != "m2" {
+			t.Errorf("expected m2, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("ack routes tags to partitions", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, Partitions: 3, RequireAck: true})
+		defer q.Close()
+
+		sub, _ := q.Subscribe()
+		for i := 0; i < 6; i++ {
+			if _, err := q.Send(keyed("m", fmt.Sprint(i))); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+
+		var tags []uint64
+		for i := 0; i < 6; i++ {
+			d := receive(t, sub)
+			if q.partitionOf(d.Tag).partition != d.Message.Partition {
+				t.Errorf("tag %d: expected partition %d", d.Tag, d.Message.Partition)
+			}
+			tags = append(tags, d.Tag)
+		}
+		if err := q.Ack(tags...); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		waitFor(t, func() bool { return q.Info().Messages == 0 }, "expected all messages to be acknowledged")
+
+		if err := q.Ack(tags[0]); err != ErrUnknownDelivery {
+			t.Errorf("expected error %v, got %v", ErrUnknownDelivery, err)
+		}
+	})
+
+	t.Run("offsets are per partition", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, Partitions: 2})
+		defer q.Close()
+
+		if _, err := q.Subscribe(FromOffset(0)); err != ErrPartitionedOffset {
+			t.Errorf("expected error %v, got %v", ErrPartitionedOffset, err)
+		}
+	})
+
+	t.Run("atomic batch spans partitions", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 1, Partitions: 2})
+		defer q.Close()
+
+		msgs := []Message{keyed("m1", "a"), keyed("m2", "a")}
+		if _, err := q.SendBatch(msgs, true); err != ErrQueueFull {
+			t.Fatalf("expected error %v, got %v", ErrQueueFull, err)
+		}
+		if n := q.Info().NextOffset; n != 0 {
+			t.Fatalf("expected nothing to be sent, got %d messages", n)
+		}
+
+		sent, err := q.SendBatch(msgs, false)
+		if err != ErrQueueFull || len(sent) != 1 || textOf(sent[0]) != "m1" {
+			t.Fatalf("expected m1 and error %v, got %v and %v", ErrQueueFull, sent, err)
+		}
+	})
+}
+
+func TestQueue_DurablePartitions(t *testing.T) {
+	dir := t.TempDir()
+	qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Partitions: 3, Durable: true}
+
+	q, err := OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := q.Send(keyed(fmt.Sprint(i), "k")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	q.Close()
+
+	q, err = OpenQueue(qCfg, dir)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	defer q.Close()
+
+	sub, _ := q.Subscribe()
+	if got := receiveAll(t, sub, 6); !reflect.DeepEqual(got, []string{"0", "1", "2", "3", "4", "5"}) {
+		t.Errorf("expected [0 1 2 3 4 5], got %v", got)
+	}
+}
@@ -0,0 +1,77 @@
+package broker
+
+import "time"
+
+// drain moves the entries g has not seen yet into its priority levels. The
+// caller must hold q.mu.
+func (q *Queue) drain(g *group) {
+	for ; g.cursor < q.next; g.cursor++ {
+		if e := q.at(g.cursor); !e.removed {
+			g.enqueue(e)
+		}
+	}
+}
+
+func (g *group) enqueue(e *entry) {
+	g.levels[e.msg.Priority] = append(g.levels[e.msg.Priority], e)
+}
+
+func (g *group) unqueue(e *entry) {
+	if g.levels == nil {
+		return
+	}
+	level := g.levels[e.msg.Priority]
+	for i, queued := range level {
+		if queued == e {
+			g.levels[e.msg.Priority] = append(level[:i], level[i+1:]...)
+			return
+		}
+	}
+}
+
+func (g *group) isQueued(e *entry) bool {
+	for _, queued := range g.levels[e.msg.Priority] {
+		if queued == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *group) queued() bool {
+	for _, level := range g.levels {
+		if len(level) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dequeue removes the entry to dispatch next: the oldest of the highest
+// priority. With aging a message gains a level for every period it waits,
+// up to the highest, where the older message wins, so low priorities are
+// not starved.
+func (g *group) dequeue(aging time.Duration, now time.Time) *entry {
+	top := len(g.levels) - 1
+	best := -1
+	bestPriority := -1
+	for i, level := range g.levels {
+		if len(level) == 0 {
+			continue
+		}
+		e := level[0]
+		p := i
+		if aging > 0 {
+			p = min(i+int(now.Sub(e.msg.Timestamp)/aging), top)
+		}
+		if p > bestPriority || p == bestPriority && e.offset < g.levels[best][0].offset {
+			best, bestPriority = i, p
+		}
+	}
+
+	e := g.levels[best][0]
+	g.levels[best][0] = nil
+	g.levels[best] = g.levels[best][1:]
+
+	return e
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sendPriority(t *testing.T, q *Queue, s string, priority int) {
+	t.Helper()
+	msg := text(s)
+	msg.Priority = priority
+	if _, err := q.Send(msg); err != nil {
+		t.Fatalf("failed to send %q: %v", s, err)
+	}
+}
+
+func TestQueue_Priority(t *testing.T) {
+	t.Run("highest first, FIFO within a level", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, PriorityLevels: 3})
+		defer q.Close()
+
+		sendPriority(t, q, "low", 0)
+		sendPriority(t, q, "high1", 2)
+		sendPriority(t, q, "mid", 1)
+		sendPriority(t, q, "high2", 9)
+
+		sub, _ := q.Subscribe()
+		want := []string{"high1", "high2", "mid", "low"}
+		if got := receiveAll(t, sub, 4); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("aging", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, PriorityLevels: 3, PriorityAging: config.Duration(20 * time.Millisecond)})
+		defer q.Close()
+
+		sendPriority(t, q, "old", 0)
+		time.Sleep(50 * time.Millisecond)
+		sendPriority(t, q, "urgent", 2)
+
+		sub, _ := q.Subscribe()
+		want := []string{"old", "urgent"}
+		if got := receiveAll(t, sub, 2); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("durable", func(t *testing.T) {
+		dir := t.TempDir()
+		qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Durable: true, PriorityLevels: 2}
+
+		q, err := OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to open queue: %v", err)
+		}
+		sendPriority(t, q, "low", 0)
+		sendPriority(t, q, "high", 1)
+		q.Close()
+
+		q, err = OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to reopen queue: %v", err)
+		}
+		defer q.Close()
+
+		sub, _ := q.Subscribe()
+		want := []string{"high", "low"}
+		if got := receiveAll(t, sub, 2); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	})
+}
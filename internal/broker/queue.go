@@ -0,0 +1,727 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/filter"
+	"github.com/IgorLem99/simple_broker/internal/wal"
+)
+
+// entry is a message accepted by Send. refs counts the consumer groups that
+// have not finished with it yet; once it drops to zero the entry no longer
+// takes up space in the queue. A removed entry is skipped by every group.
+type entry struct {
+	offset  uint64
+	msg     Message
+	seq     uint64
+	refs    int
+	removed bool
+}
+
+type Queue struct {
+	mu     sync.RWMutex
+	cond   *sync.Cond
+	cfg    config.QueueConfig
+	name   string
+	size   int
+	maxSub int
+	log    []*entry
+	bytes  int64
+	next   uint64
+	live   int
+	groups map[string]*group
+	subs   map[Subscriber]*subscriber
+
+	wal  *wal.Log
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// ephemeral holds the private groups of subscribers that asked for a
+	// starting position without naming a group.
+	ephemeral map[*group]struct{}
+
+	work       bool
+	leastBusy  bool
+	requireAck bool
+	visibility time.Duration
+	inflight   map[uint64]*delivery
+	nextTag    uint64
+	tagStride  uint64
+	nextSub    uint64
+	buffer     int
+	slow       string
+	penalties  []*Penalty
+	retention  retention
+	ttl        time.Duration
+	priorities int
+	aging      time.Duration
+
+	scheduled schedule
+	byID      map[string]*scheduled
+	wake      chan struct{}
+
+	dedup dedup
+
+	deadLetterQueue string
+	maxDeliveries   int
+	lookup          func(name string) (*Queue, error)
+
+	// A partitioned queue passes messages on to the queues in parts, which
+	// know their index as partition. members are the subscribers of the
+	// partitioned queue and shared the ones that share partitions, by
+	// group.
+	parts     []*Queue
+	partition int
+	members   map[Subscriber]*member
+	shared    map[string][]*member
+	spread    atomic.Uint64
+
+	// A partition calls notify when it has messages to take. The
+	// partitioned queue then closes arrival, which Receive waits on.
+	notify    func()
+	arrivalMu sync.Mutex
+	arrival   chan struct{}
+}
+
+// NewQueue creates a queue. With more than one partition in cfg, messages
+// are spread over that many queues by their partition key.
+func NewQueue(cfg config.QueueConfig) *Queue {
+	if cfg.Partitions > 1 {
+		q, _ := newPartitions(cfg, func(_ int, pc config.QueueConfig) (*Queue, error) {
+			return NewQueue(pc), nil
+		})
+		return q
+	}
+
+	q := newQueue(cfg)
+	q.run()
+	return q
+}
+
+// OpenQueue creates a durable queue whose messages are written to a log in
+// dir before Send returns. Messages that were not delivered before the log
+// was last closed are restored.
+func OpenQueue(cfg config.QueueConfig, dir string) (*Queue, error) {
+	if cfg.Partitions > 1 {
+		return openPartitions(cfg, dir)
+	}
+
+	policy, err := wal.ParseSyncPolicy(cfg.Fsync)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := wal.Open(dir, wal.Options{
+		SegmentSize:  cfg.SegmentSize,
+		Sync:         policy,
+		SyncInterval: time.Duration(cfg.FsyncInterval),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := newQueue(cfg)
+	q.wal = l
+	if err := q.replay(); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("replay queue %s: %w", cfg.Name, err)
+	}
+
+	q.run()
+	return q, nil
+}
+
+func newQueue(cfg config.QueueConfig) *Queue {
+	q := &Queue{
+		cfg:        cfg,
+		name:       cfg.Name,
+		size:       cfg.Size,
+		maxSub:     cfg.MaxSub,
+		log:        make([]*entry, 0, cfg.Size),
+		groups:     make(map[string]*group),
+		subs:       make(map[Subscriber]*subscriber),
+		ephemeral:  make(map[*group]struct{}),
+		byID:       make(map[string]*scheduled),
+		dedup:      newDedup(time.Duration(cfg.DedupWindow)),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		work:       cfg.DeliveryMode == config.DeliveryWork,
+		leastBusy:  cfg.WorkDispatch == config.DispatchLeastBusy,
+		requireAck: cfg.RequireAck,
+		visibility: time.Duration(cfg.VisibilityTimeout),
+		buffer:     cfg.SubscriberBuffer,
+		slow:       cfg.SlowConsumerPolicy,
+		inflight:   make(map[uint64]*delivery),
+		tagStride:  1,
+		retention: retention{
+			messages: cfg.RetentionMessages,
+			bytes:    cfg.RetentionBytes,
+			age:      time.Duration(cfg.RetentionAge),
+		},
+		ttl:             time.Duration(cfg.MessageTTL),
+		priorities:      cfg.PriorityLevels,
+		aging:           time.Duration(cfg.PriorityAging),
+		deadLetterQueue: cfg.DeadLetterQueue,
+		maxDeliveries:   cfg.MaxDeliveries,
+	}
+	if q.visibility <= 0 {
+		q.visibility = DefaultVisibilityTimeout
+	}
+	if q.buffer <= 0 {
+		q.buffer = DefaultSubscriberBuffer
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.groups[DefaultGroup] = newGroup(DefaultGroup, q.work, q.priorities)
+	return q
+}
+
+func (q *Queue) run() {
+	for _, g := range q.groups {
+		q.wg.Add(1)
+		go q.dispatch(g)
+	}
+
+	q.wg.Add(2)
+	go q.sweep()
+	go q.runSchedule()
+}
+
+func (q *Queue) closing() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	group   string
+	offset  *uint64
+	offsets map[int]uint64
+	since   time.Time
+	filter  *filter.Filter
+}
+
+// WithGroup joins the named consumer group. Every group receives all
+// messages of the queue, and within a group each message goes to one member.
+func WithGroup(name string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.group = name
+	}
+}
+
+// FromOffset starts the subscription at the given offset. Without a group
+// the subscriber gets a private group that first streams the retained
+// messages from there on and then follows new ones. With a group the offset
+// only applies if the group does not exist yet.
+func FromOffset(offset uint64) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.offset = &offset
+	}
+}
+
+// FromOffsets starts every partition listed in offsets at its offset there
+// and the others at the oldest message not consumed yet. It follows the
+// same rules as FromOffset; a queue without partitions counts as partition
+// 0.
+func FromOffsets(offsets map[int]uint64) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.offsets = offsets
+	}
+}
+
+// Since starts the subscription at the first retained message sent at or
+// after t. It follows the same rules as FromOffset.
+func Since(t time.Time) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.since = t
+	}
+}
+
+// WithFilter only sends the subscriber messages that match f. Fields are
+// looked up in the message headers first, then among the top-level fields
+// of a JSON object payload. A message that no member of a group matches is
+// skipped by the group.
+func WithFilter(f *filter.Filter) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.filter = f
+	}
+}
+
+func (q *Queue) Subscribe(opts ...SubscribeOption) (Subscriber, error) {
+	var o subscribeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if q.parts != nil {
+		return q.subscribePartitions(o)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	sub := make(Subscriber)
+	if err := q.attach(sub, 0, o, nil); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// attach subscribes ch with options o. Unless id is given the subscriber
+// gets the next one. If disconnect is set, the caller owns ch: the queue
+// calls disconnect instead of closing ch when the slow consumer policy
+// disconnects the subscriber, and leaves ch open when it is closed. The
+// caller must hold q.mu.
+func (q *Queue) attach(ch Subscriber, id uint64, o subscribeOptions, disconnect func()) error {
+	if len(q.subs) >= q.maxSub {
+		return ErrTooManySub
+	}
+
+	g, err := q.joinGroup(o)
+	if err != nil {
+		return err
+	}
+
+	if id == 0 {
+		q.nextSub++
+		id = q.nextSub
+	}
+	s := &subscriber{
+		id:         id,
+		ch:         ch,
+		group:      g,
+		filter:     o.filter,
+		gone:       make(chan struct{}),
+		signal:     make(chan struct{}, 1),
+		disconnect: disconnect,
+	}
+	q.subs[ch] = s
+	g.members = append(g.members, s)
+	q.cond.Broadcast()
+
+	s.sending.Add(1)
+	q.wg.Add(1)
+	go q.pump(s)
+
+	return nil
+}
+
+func (q *Queue) Unsubscribe(sub Subscriber) {
+	if q.parts != nil {
+		q.unsubscribePartitions(sub)
+		return
+	}
+
+	if q.drop(sub) {
+		close(sub)
+	}
+}
+
+// drop removes the subscriber of ch and reports whether there was one. It
+// returns once the subscriber stopped sending on ch.
+func (q *Queue) drop(ch Subscriber) bool {
+	q.mu.Lock()
+	s, ok := q.subs[ch]
+	if ok {
+		q.detach(s)
+	}
+	q.mu.Unlock()
+
+	if ok {
+		// Wait for an in-flight delivery to give up before the channel
+		// it may be sending on is closed.
+		s.sending.Wait()
+	}
+	return ok
+}
+
+// Send adds msg to the queue and returns it with the ID, offset and
+// timestamp assigned. If a message with the same ID was sent within the
+// dedup window, msg is dropped and the ID, offset and timestamp of that
+// message are returned with ErrDuplicate.
+func (q *Queue) Send(msg Message) (Message, error) {
+	if q.parts != nil {
+		return q.partitionFor(msg).Send(msg)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closing() {
+		return Message{}, ErrQueueClosed
+	}
+	if dup, ok := q.dedup.seen(msg.ID, time.Now()); ok {
+		return dup, ErrDuplicate
+	}
+
+	return q.send(msg)
+}
+
+// forward is Send without deduplication, for messages that are moved
+// between queues with their ID.
+func (q *Queue) forward(msg Message) (Message, error) {
+	if q.parts != nil {
+		return q.partitionFor(msg).forward(msg)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closing() {
+		return Message{}, ErrQueueClosed
+	}
+
+	return q.send(msg)
+}
+
+// SendContext is Send that waits for room while the queue is full. It
+// returns ErrQueueFull if there is still none when ctx is done.
+func (q *Queue) SendContext(ctx context.Context, msg Message) (Message, error) {
+	if q.parts != nil {
+		return q.partitionFor(msg).SendContext(ctx, msg)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closing() {
+			return Message{}, ErrQueueClosed
+		}
+		if dup, ok := q.dedup.seen(msg.ID, time.Now()); ok {
+			return dup, ErrDuplicate
+		}
+		if q.room() > 0 || ctx.Err() != nil {
+			return q.send(msg)
+		}
+		q.cond.Wait()
+	}
+}
+
+// send is Send for callers that hold q.mu.
+func (q *Queue) send(msg Message) (Message, error) {
+	if q.room() == 0 {
+		return Message{}, ErrQueueFull
+	}
+
+	msg = q.stamp(msg, q.next)
+	var seq uint64
+	if q.wal != nil {
+		var err error
+		if seq, err = q.appendRecord(record{Op: opSend, Msg: &msg}); err != nil {
+			return Message{}, err
+		}
+	}
+	q.add(msg, seq)
+
+	return msg, nil
+}
+
+// SendBatch adds msgs to the queue with a single write to its log. If
+// atomic is set either all of them are added or, when the queue lacks room
+// for all of them, none. Otherwise as many as fit are added in order. It
+// returns the messages that were added, and ErrQueueFull if that is not all
+// of them. Duplicates within the dedup window are not added; the messages
+// they duplicate are returned in their place.
+func (q *Queue) SendBatch(msgs []Message, atomic bool) ([]Message, error) {
+	if q.parts != nil {
+		return q.sendBatchPartitions(msgs, atomic)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closing() {
+		return nil, ErrQueueClosed
+	}
+
+	return q.sendBatch(msgs, atomic)
+}
+
+// sendBatch is SendBatch for callers that hold q.mu.
+func (q *Queue) sendBatch(msgs []Message, atomic bool) ([]Message, error) {
+	now := time.Now()
+	room := q.room()
+	sent := make([]Message, 0, len(msgs))
+	var added []Message
+	batch := make(map[string]Message)
+	for _, msg := range msgs {
+		if dup, ok := q.dedup.seen(msg.ID, now); ok {
+			sent = append(sent, dup)
+			continue
+		}
+		if dup, ok := batch[msg.ID]; ok {
+			sent = append(sent, dup)
+			continue
+		}
+		if len(added) == room {
+			if atomic {
+				return nil, ErrQueueFull
+			}
+			break
+		}
+
+		msg = q.stamp(msg, q.next+uint64(len(added)))
+		added = append(added, msg)
+		sent = append(sent, msg)
+		if q.dedup.window > 0 {
+			batch[msg.ID] = msg
+		}
+	}
+
+	var seq uint64
+	if q.wal != nil && len(added) > 0 {
+		var err error
+		if seq, err = q.appendRecord(record{Op: opBatch, Msgs: added}); err != nil {
+			return nil, err
+		}
+	}
+	for _, msg := range added {
+		q.add(msg, seq)
+	}
+
+	if len(sent) < len(msgs) {
+		return sent, ErrQueueFull
+	}
+	return sent, nil
+}
+
+// room returns how many more messages fit in the queue, whose size
+// scheduled messages take up as well. The caller must hold q.mu.
+func (q *Queue) room() int {
+	return max(q.size-q.live-len(q.scheduled), 0)
+}
+
+// stamp assigns what Send assigns to msg, giving it the offset passed in.
+func (q *Queue) stamp(msg Message, offset uint64) Message {
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+	msg.Offset = offset
+	msg.Partition = q.partition
+	msg.Timestamp = time.Now().UTC()
+	msg.Priority = min(max(msg.Priority, 0), max(q.priorities-1, 0))
+	if q.ttl > 0 {
+		expires := msg.Timestamp.Add(q.ttl)
+		if msg.ExpiresAt == nil || expires.Before(*msg.ExpiresAt) {
+			msg.ExpiresAt = &expires
+		}
+	}
+	return msg
+}
+
+// add appends a stamped message, written to the log as record seq, and
+// hands it to every group. The caller must hold q.mu.
+func (q *Queue) add(msg Message, seq uint64) {
+	e := &entry{offset: msg.Offset, msg: msg, seq: seq}
+	q.next++
+	q.log = append(q.log, e)
+	q.bytes += int64(len(msg.Payload))
+	for range q.groups {
+		q.claim(e)
+	}
+	for range q.ephemeral {
+		q.claim(e)
+	}
+	q.dedup.add(msg)
+	q.announce()
+}
+
+// claim marks e as needed by one more consumer group. The caller must hold
+// q.mu.
+func (q *Queue) claim(e *entry) {
+	if e.refs == 0 {
+		q.live++
+	}
+	e.refs++
+}
+
+// release marks e as finished by one consumer group. The caller must hold
+// q.mu.
+func (q *Queue) release(e *entry) {
+	e.refs--
+	if e.refs > 0 {
+		return
+	}
+	q.live--
+	q.trim()
+	q.cond.Broadcast()
+}
+
+// remove takes e away from every group that still holds it and reports
+// whether any did. Deliveries in flight can still be acknowledged but are
+// not sent again. The caller must hold q.mu.
+func (q *Queue) remove(e *entry) bool {
+	if e.removed {
+		return false
+	}
+	e.removed = true
+	live := e.refs > 0
+
+	if q.wal != nil {
+		if _, err := q.appendRecord(record{Op: opRemove, Offset: e.offset}); err != nil {
+			log.Printf("queue %s: remove message: %v", q.name, err)
+		}
+	}
+
+	release := func(g *group) {
+		if !q.holds(g, e) {
+			return
+		}
+		delete(g.pending, e)
+		delete(g.attempts, e)
+		for i, it := range g.retry {
+			if it.entry == e {
+				g.retry = append(g.retry[:i], g.retry[i+1:]...)
+				break
+			}
+		}
+		g.unqueue(e)
+		if e.offset >= g.claimed {
+			q.release(e)
+		}
+	}
+	for _, g := range q.groups {
+		release(g)
+	}
+	for g := range q.ephemeral {
+		release(g)
+	}
+	q.cond.Broadcast()
+
+	return live
+}
+
+// at returns the entry with the given offset, which must still be in the
+// log. The caller must hold q.mu.
+func (q *Queue) at(offset uint64) *entry {
+	return q.log[offset-q.log[0].offset]
+}
+
+// head returns the offset of the oldest entry in the log, which may have
+// been consumed already and only be kept for retention. The caller must
+// hold q.mu.
+func (q *Queue) head() uint64 {
+	if len(q.log) == 0 {
+		return q.next
+	}
+	return q.log[0].offset
+}
+
+// firstLive returns the offset of the oldest entry some group still needs.
+// The caller must hold q.mu.
+func (q *Queue) firstLive() uint64 {
+	for _, e := range q.log {
+		if e.refs > 0 {
+			return e.offset
+		}
+	}
+	return q.next
+}
+
+// QueueInfo describes a queue and what it currently holds. Messages counts
+// the messages some group has not finished with, Retained the ones only
+// kept for replay.
+type QueueInfo struct {
+	config.QueueConfig
+	Messages    int       `json:"messages"`
+	Retained    int       `json:"retained"`
+	NextOffset  uint64    `json:"next_offset"`
+	Scheduled   int       `json:"scheduled"`
+	Subscribers int       `json:"subscribers"`
+	Groups      []string  `json:"groups,omitempty"`
+	Penalized   []Penalty `json:"penalized,omitempty"`
+
+	// Partitions describes each partition of a partitioned queue, whose
+	// other figures add up those of the partitions.
+	Partitions []PartitionInfo `json:"partitions,omitempty"`
+}
+
+func (q *Queue) Info() QueueInfo {
+	if q.parts != nil {
+		return q.infoPartitions()
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	info := QueueInfo{
+		QueueConfig: q.cfg,
+		Messages:    q.live,
+		Retained:    len(q.log) - q.live,
+		NextOffset:  q.next,
+		Scheduled:   len(q.scheduled),
+		Subscribers: len(q.subs),
+	}
+	for name := range q.groups {
+		if name != DefaultGroup {
+			info.Groups = append(info.Groups, name)
+		}
+	}
+	sort.Strings(info.Groups)
+	for _, p := range q.penalties {
+		info.Penalized = append(info.Penalized, *p)
+	}
+
+	return info
+}
+
+func (q *Queue) Close() {
+	if q.parts != nil {
+		q.closePartitions()
+		return
+	}
+
+	q.mu.Lock()
+
+	select {
+	case <-q.done:
+		q.mu.Unlock()
+		return
+	default:
+		close(q.done)
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for tag, d := range q.inflight {
+		d.timer.Stop()
+		delete(q.inflight, tag)
+	}
+
+	for sub, s := range q.subs {
+		delete(q.subs, sub)
+		if s.disconnect == nil {
+			close(sub)
+		}
+	}
+
+	if q.wal != nil {
+		if err := q.wal.Close(); err != nil {
+			log.Printf("queue %s: close log: %v", q.name, err)
+		}
+	}
+}
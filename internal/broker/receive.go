@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+// Receive takes up to max messages from the queue without subscribing. If
+// none are there it waits until one is sent or ctx is done, in which case
+// it returns none and no error. The consumer joins the group given by opts
+// only while it takes messages, sharing them with the group's subscribers;
+// without a group it takes from the default group as a competing consumer.
+// Positions apply to named groups that do not exist yet, filters do not
+// apply. On queues that require acknowledgements the deliveries carry tags
+// as usual.
+func (q *Queue) Receive(ctx context.Context, max int, opts ...SubscribeOption) ([]Delivery, error) {
+	var o subscribeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.group == DefaultGroup {
+		o.offset, o.since = nil, time.Time{}
+	}
+	if max <= 0 {
+		return nil, nil
+	}
+
+	if q.parts != nil {
+		return q.receivePartitions(ctx, max, o)
+	}
+	return q.receive(ctx, max, o)
+}
+
+func (q *Queue) receive(ctx context.Context, max int, o subscribeOptions) ([]Delivery, error) {
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		ds, expired, err := q.pull(o, max)
+		if len(expired) > 0 {
+			q.mu.Unlock()
+			for _, msg := range expired {
+				q.publishDeadLetter(msg, ReasonExpired)
+			}
+			q.mu.Lock()
+		}
+		if err != nil || len(ds) > 0 || ctx.Err() != nil {
+			return ds, err
+		}
+		if len(expired) == 0 {
+			q.cond.Wait()
+		}
+	}
+}
+
+// pull takes up to max messages for a consumer with options o the way
+// dispatch sends them to a subscriber. It also returns the expired messages
+// it removed on the way, which the caller has to dead-letter once it
+// released q.mu. The caller must hold q.mu.
+func (q *Queue) pull(o subscribeOptions, max int) ([]Delivery, []Message, error) {
+	g, err := q.joinGroup(o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Redeliveries of what s took go to whoever is next, as s is not a
+	// subscriber of the queue.
+	s := &subscriber{group: g}
+	now := time.Now()
+	var ds []Delivery
+	var expired []Message
+	for len(ds) < max && q.waiting(g) {
+		it := q.take(g)
+		if it.msg.expired(now) {
+			if q.remove(it.entry) {
+				expired = append(expired, it.msg)
+			}
+			q.undispatch(g, it.entry)
+			continue
+		}
+
+		d := Delivery{Redelivered: it.redelivered, Message: it.msg}
+		if q.requireAck {
+			g.attempts[it.entry]++
+			q.logDelivery(g, it.entry)
+			d.Tag = q.track(g, it.entry, s)
+		}
+		q.complete(&dispatchState{group: g, it: it, left: 1}, true)
+		ds = append(ds, d)
+	}
+
+	return ds, expired, nil
+}
+
+// receivePartitions is Receive for partitioned queues. It takes messages
+// from every partition, starting with a different one each time, and waits
+// for any of them to get some.
+func (q *Queue) receivePartitions(ctx context.Context, max int, o subscribeOptions) ([]Delivery, error) {
+	noWait, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for {
+		arrival := q.arrived()
+
+		var ds []Delivery
+		start := int(q.spread.Add(1))
+		for i := range q.parts {
+			p := q.parts[(start+i)%len(q.parts)]
+			got, err := p.receive(noWait, max-len(ds), o)
+			ds = append(ds, got...)
+			if err != nil {
+				return ds, err
+			}
+			if len(ds) == max {
+				break
+			}
+		}
+		if len(ds) > 0 || ctx.Err() != nil {
+			return ds, nil
+		}
+
+		select {
+		case <-arrival:
+		case <-ctx.Done():
+		case <-q.done:
+			return nil, ErrQueueClosed
+		}
+	}
+}
+
+// arrived returns a channel that is closed once a partition has messages to
+// take.
+func (q *Queue) arrived() <-chan struct{} {
+	q.arrivalMu.Lock()
+	defer q.arrivalMu.Unlock()
+
+	if q.arrival == nil {
+		q.arrival = make(chan struct{})
+	}
+	return q.arrival
+}
+
+func (q *Queue) notifyArrival() {
+	q.arrivalMu.Lock()
+	defer q.arrivalMu.Unlock()
+
+	if q.arrival != nil {
+		close(q.arrival)
+		q.arrival = nil
+	}
+}
+
+// announce wakes the dispatchers and receivers waiting for messages to
+// take. The caller must hold q.mu.
+func (q *Queue) announce() {
+	q.cond.Broadcast()
+	if q.notify != nil {
+		q.notify()
+	}
+}
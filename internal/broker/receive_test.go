@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/config"
+)
+
+func texts(ds []Delivery) []string {
+	var list []string
+	for _, d := range ds {
+		list = append(list, textOf(d.Message))
+	}
+	return list
+}
+
+func TestQueue_Receive(t *testing.T) {
+	t.Run("takes what is there", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+		defer q.Close()
+
+		for _, msg := range []string{"m1", "m2", "m3"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ds, err := q.Receive(ctx, 2)
+		if err != nil || !reflect.DeepEqual(texts(ds), []string{"m1", "m2"}) {
+			t.Fatalf("expected [m1 m2], got %v and %v", texts(ds), err)
+		}
+		ds, err = q.Receive(ctx, 2)
+		if err != nil || !reflect.DeepEqual(texts(ds), []string{"m3"}) {
+			t.Fatalf("expected [m3], got %v and %v", texts(ds), err)
+		}
+		if info := q.Info(); info.Messages != 0 {
+			t.Errorf("expected no messages left, got %d", info.Messages)
+		}
+	})
+
+	t.Run("waits for a message", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+		defer q.Close()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = q.Send(text("m1"))
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		ds, err := q.Receive(ctx, 10)
+		if err != nil || !reflect.DeepEqual(texts(ds), []string{"m1"}) {
+			t.Fatalf("expected [m1], got %v and %v", texts(ds), err)
+		}
+	})
+
+	t.Run("gives up when ctx is done", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+		defer q.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if ds, err := q.Receive(ctx, 10); err != nil || len(ds) != 0 {
+			t.Fatalf("expected nothing, got %v and %v", texts(ds), err)
+		}
+	})
+
+	t.Run("shares a group with subscribers", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+		defer q.Close()
+
+		for _, msg := range []string{"m1", "m2"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+
+		ds, err := q.Receive(context.Background(), 1, WithGroup("billing"))
+		if err != nil || !reflect.DeepEqual(texts(ds), []string{"m1"}) {
+			t.Fatalf("expected [m1], got %v and %v", texts(ds), err)
+		}
+		sub, _ := q.Subscribe(WithGroup("billing"))
+		if d := receive(t, sub); textOf(d.Message) != "m2" {
+			t.Errorf("expected m2, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("acknowledgements", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, RequireAck: true, VisibilityTimeout: config.Duration(50 * time.Millisecond)})
+		defer q.Close()
+
+		if _, err := q.Send(text("m1")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		ds, err := q.Receive(context.Background(), 1)
+		if err != nil || len(ds) != 1 || ds[0].Tag == 0 {
+			t.Fatalf("expected a tagged delivery, got %+v and %v", ds, err)
+		}
+
+		// Unacknowledged, it comes back after the visibility timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		again, err := q.Receive(ctx, 1)
+		if err != nil || len(again) != 1 || !again[0].Redelivered {
+			t.Fatalf("expected a redelivery, got %+v and %v", again, err)
+		}
+		if err := q.Ack(again[0].Tag); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if info := q.Info(); info.Messages != 0 {
+			t.Errorf("expected no messages left, got %d", info.Messages)
+		}
+	})
+
+	t.Run("closed queue", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			q.Close()
+		}()
+		if _, err := q.Receive(context.Background(), 1); err != ErrQueueClosed {
+			t.Fatalf("expected error %v, got %v", ErrQueueClosed, err)
+		}
+	})
+
+	t.Run("partitions", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, Partitions: 4})
+		defer q.Close()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = q.Send(keyed("m1", "k"))
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		ds, err := q.Receive(ctx, 10)
+		if err != nil || !reflect.DeepEqual(texts(ds), []string{"m1"}) {
+			t.Fatalf("expected [m1], got %v and %v", texts(ds), err)
+		}
+	})
+}
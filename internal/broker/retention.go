@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"sort"
+	"time"
+)
+
+// retention limits how many messages that every group has finished with
+// are kept around for subscribers that start at an earlier position. With
+// no limit set nothing is kept.
+type retention struct {
+	messages int
+	bytes    int64
+	age      time.Duration
+}
+
+func (r retention) enabled() bool {
+	return r.messages > 0 || r.bytes > 0 || r.age > 0
+}
+
+// keep reports whether e may stay at the head of a log of count entries
+// that take up bytes.
+func (r retention) keep(e *entry, count int, bytes int64, now time.Time) bool {
+	switch {
+	case !r.enabled():
+		return false
+	case r.messages > 0 && count > r.messages:
+		return false
+	case r.bytes > 0 && bytes > r.bytes:
+		return false
+	case r.age > 0 && now.Sub(e.msg.Timestamp) > r.age:
+		return false
+	default:
+		return true
+	}
+}
+
+// trim drops entries from the head of the log that no group needs and
+// that are outside the retention limits. The caller must hold q.mu.
+func (q *Queue) trim() {
+	now := time.Now()
+	n := 0
+	for n < len(q.log) {
+		e := q.log[n]
+		if e.refs > 0 || q.retention.keep(e, len(q.log)-n, q.bytes, now) {
+			break
+		}
+		q.bytes -= int64(len(e.msg.Payload))
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	clear(q.log[:n])
+	q.log = q.log[n:]
+
+	// Groups reading from retention skip what was dropped.
+	head := q.head()
+	for _, g := range q.groups {
+		g.cursor = max(g.cursor, head)
+	}
+	for g := range q.ephemeral {
+		g.cursor = max(g.cursor, head)
+	}
+
+	q.compact()
+}
+
+// position returns the offset a new group created with o starts at and
+// whether o asked for one explicitly. The caller must hold q.mu.
+func (q *Queue) position(o subscribeOptions) (uint64, bool) {
+	offset, ok := o.offsets[q.partition]
+	switch {
+	case o.offset != nil:
+		offset = *o.offset
+	case ok:
+		// The partition has an offset of its own.
+	case !o.since.IsZero():
+		i := sort.Search(len(q.log), func(i int) bool {
+			return !q.log[i].msg.Timestamp.Before(o.since)
+		})
+		offset = q.next
+		if i < len(q.log) {
+			offset = q.log[i].offset
+		}
+	case o.offsets != nil:
+		offset = q.firstLive()
+	default:
+		return q.firstLive(), false
+	}
+
+	return min(max(offset, q.head()), q.next), true
+}
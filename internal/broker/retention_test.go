@@ -0,0 +1,263 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"reflect"
+	"testing"
+	"time"
+)
+
+// consume subscribes to the default group and receives n messages.
+func consume(t *testing.T, q *Queue, n int) {
+	t.Helper()
+	sub, _ := q.Subscribe()
+	for i := 0; i < n; i++ {
+		receive(t, sub)
+	}
+	waitFor(t, func() bool {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		return q.live == 0
+	}, "expected every message to be consumed")
+	q.Unsubscribe(sub)
+}
+
+func receiveAll(t *testing.T, sub Subscriber, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		got = append(got, textOf(receive(t, sub).Message))
+	}
+	return got
+}
+
+func TestQueue_Replay(t *testing.T) {
+	t.Run("from offset", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 2, MaxSub: 2, RetentionMessages: 10})
+		defer q.Close()
+
+		for _, msg := range []string{"m0", "m1"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+		consume(t, q, 2)
+
+		// Retained messages do not take up space.
+		if _, err := q.Send(text("m2")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		sub, err := q.Subscribe(FromOffset(1))
+		if err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+		if got := receiveAll(t, sub, 2); !reflect.DeepEqual(got, []string{"m1", "m2"}) {
+			t.Errorf("expected [m1 m2], got %v", got)
+		}
+
+		if _, err := q.Send(text("m3")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if d := receive(t, sub); textOf(d.Message) != "m3" {
+			t.Errorf("expected m3, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("since", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2, RetentionMessages: 10})
+		defer q.Close()
+
+		if _, err := q.Send(text("m0")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		m1, err := q.Send(text("m1"))
+		if err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		consume(t, q, 2)
+
+		sub, _ := q.Subscribe(Since(m1.Timestamp))
+		if d := receive(t, sub); textOf(d.Message) != "m1" {
+			t.Errorf("expected m1, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("offset before retention starts at head", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2, RetentionMessages: 1})
+		defer q.Close()
+
+		for _, msg := range []string{"m0", "m1"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+		consume(t, q, 2)
+
+		sub, _ := q.Subscribe(FromOffset(0))
+		if d := receive(t, sub); textOf(d.Message) != "m1" {
+			t.Errorf("expected m1, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("named group only uses the position when created", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2, RetentionMessages: 10})
+		defer q.Close()
+
+		for _, msg := range []string{"m0", "m1"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+
+		sub, _ := q.Subscribe(WithGroup("audit"), FromOffset(1))
+		if d := receive(t, sub); textOf(d.Message) != "m1" {
+			t.Errorf("expected m1, got %v", textOf(d.Message))
+		}
+		q.Unsubscribe(sub)
+
+		sub, _ = q.Subscribe(WithGroup("audit"), FromOffset(0))
+		select {
+		case d := <-sub:
+			t.Errorf("unexpected message %v", textOf(d.Message))
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("private group is dropped on unsubscribe", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 1, MaxSub: 2})
+		defer q.Close()
+
+		sub, _ := q.Subscribe(FromOffset(0))
+		q.Unsubscribe(sub)
+
+		if _, err := q.Send(text("m0")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		consume(t, q, 1)
+	})
+}
+
+func TestQueue_Retention(t *testing.T) {
+	t.Run("messages", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, RetentionMessages: 2})
+		defer q.Close()
+
+		for _, msg := range []string{"m0", "m1", "m2"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+		consume(t, q, 3)
+
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		if q.head() != 1 {
+			t.Errorf("expected head 1, got %d", q.head())
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, RetentionBytes: 8})
+		defer q.Close()
+
+		// Each payload is a 4 byte JSON string.
+		for _, msg := range []string{"m0", "m1", "m2"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+		consume(t, q, 3)
+
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		if q.head() != 1 || q.bytes != 8 {
+			t.Errorf("expected head 1 with 8 bytes, got %d with %d bytes", q.head(), q.bytes)
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1, RetentionAge: config.Duration(30 * time.Millisecond)})
+		defer q.Close()
+
+		if _, err := q.Send(text("m0")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		consume(t, q, 1)
+
+		waitFor(t, func() bool {
+			q.mu.RLock()
+			defer q.mu.RUnlock()
+			return len(q.log) == 0
+		}, "expected m0 to expire from retention")
+	})
+
+	t.Run("durable", func(t *testing.T) {
+		dir := t.TempDir()
+		qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Durable: true, RetentionMessages: 10}
+
+		q, err := OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to open queue: %v", err)
+		}
+		if _, err := q.Send(text("m0")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		consume(t, q, 1)
+		q.Close()
+
+		q, err = OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to reopen queue: %v", err)
+		}
+		defer q.Close()
+
+		sub, _ := q.Subscribe(FromOffset(0))
+		if d := receive(t, sub); textOf(d.Message) != "m0" {
+			t.Errorf("expected m0, got %v", textOf(d.Message))
+		}
+	})
+
+	t.Run("durable group", func(t *testing.T) {
+		dir := t.TempDir()
+		qCfg := config.QueueConfig{Size: 3, MaxSub: 1, Durable: true, RetentionMessages: 10}
+
+		q, err := OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to open queue: %v", err)
+		}
+		for _, msg := range []string{"m0", "m1", "m2"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+		consume(t, q, 3)
+		sub, err := q.Subscribe(WithGroup("audit"), FromOffset(0))
+		if err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+		receiveAll(t, sub, 2)
+		q.Close()
+
+		// The group read the consumed messages from retention, so they still
+		// take up no space after a restart, and it goes on where it stopped.
+		q, err = OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to reopen queue: %v", err)
+		}
+		defer q.Close()
+
+		if info := q.Info(); info.Messages != 0 {
+			t.Errorf("expected no messages, got %d", info.Messages)
+		}
+		if _, err := q.Send(text("m3")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		sub, _ = q.Subscribe(WithGroup("audit"))
+		if got := receiveAll(t, sub, 2); !reflect.DeepEqual(got, []string{"m2", "m3"}) {
+			t.Errorf("expected [m2 m3], got %v", got)
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package broker
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	ErrNotScheduled     = errors.New("message not scheduled")
+	ErrAlreadyScheduled = errors.New("message already scheduled")
+)
+
+// scheduleRetry is how long a due message waits before it is tried again
+// when the queue is full.
+const scheduleRetry = 100 * time.Millisecond
+
+// ScheduledMessage is a message waiting to be sent at DeliverAt.
+type ScheduledMessage struct {
+	ID        string            `json:"id"`
+	DeliverAt time.Time         `json:"deliver_at"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   json.RawMessage   `json:"payload"`
+}
+
+type scheduled struct {
+	msg   Message
+	at    time.Time
+	seq   uint64
+	index int
+}
+
+// schedule is a min-heap of scheduled messages ordered by due time.
+type schedule []*scheduled
+
+func (s schedule) Len() int           { return len(s) }
+func (s schedule) Less(i, j int) bool { return s[i].at.Before(s[j].at) }
+
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].index = i
+	s[j].index = j
+}
+
+func (s *schedule) Push(x any) {
+	item := x.(*scheduled)
+	item.index = len(*s)
+	*s = append(*s, item)
+}
+
+func (s *schedule) Pop() any {
+	old := *s
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*s = old[:len(old)-1]
+	return item
+}
+
+// Schedule holds msg back until at and then sends it. It returns msg with
+// its ID assigned. A time that is not in the future sends msg right away.
+// Scheduled messages count against the size of the queue, so it returns
+// ErrQueueFull once the queue holds that many, scheduled or not.
+func (q *Queue) Schedule(msg Message, at time.Time) (Message, error) {
+	if q.parts != nil {
+		return q.partitionFor(msg).Schedule(msg, at)
+	}
+	if !at.After(time.Now()) {
+		return q.Send(msg)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closing() {
+		return Message{}, ErrQueueClosed
+	}
+
+	if dup, ok := q.dedup.seen(msg.ID, time.Now()); ok {
+		return dup, ErrDuplicate
+	}
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+	if _, ok := q.byID[msg.ID]; ok {
+		return Message{}, ErrAlreadyScheduled
+	}
+	if q.room() == 0 {
+		return Message{}, ErrQueueFull
+	}
+
+	s := &scheduled{msg: msg, at: at}
+	if q.wal != nil {
+		seq, err := q.appendRecord(record{Op: opSchedule, Msg: &msg, At: &at})
+		if err != nil {
+			return Message{}, err
+		}
+		s.seq = seq
+	}
+
+	heap.Push(&q.scheduled, s)
+	q.byID[msg.ID] = s
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return msg, nil
+}
+
+// Scheduled returns the messages waiting to be sent, the next one first.
+func (q *Queue) Scheduled() []ScheduledMessage {
+	if q.parts != nil {
+		return q.scheduledPartitions()
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	list := make([]ScheduledMessage, len(q.scheduled))
+	for i, s := range q.scheduled {
+		list[i] = ScheduledMessage{ID: s.msg.ID, DeliverAt: s.at, Headers: s.msg.Headers, Payload: s.msg.Payload}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeliverAt.Before(list[j].DeliverAt) })
+
+	return list
+}
+
+// Cancel drops a scheduled message before it is sent.
+func (q *Queue) Cancel(id string) error {
+	if q.parts != nil {
+		return q.cancelPartitions(id)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s, ok := q.byID[id]
+	if !ok {
+		return ErrNotScheduled
+	}
+
+	if q.wal != nil {
+		if _, err := q.appendRecord(record{Op: opUnschedule, ID: id}); err != nil {
+			return err
+		}
+	}
+	q.unschedule(s)
+
+	return nil
+}
+
+// unschedule takes s off the schedule. The caller must hold q.mu.
+func (q *Queue) unschedule(s *scheduled) {
+	heap.Remove(&q.scheduled, s.index)
+	delete(q.byID, s.msg.ID)
+}
+
+func (q *Queue) runSchedule() {
+	defer q.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-timer.C:
+		case <-q.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		q.mu.Lock()
+		wait := q.sendDue(time.Now())
+		q.mu.Unlock()
+		timer.Reset(wait)
+	}
+}
+
+// sendDue sends the scheduled messages that are due and returns how long to
+// wait for the next one. The caller must hold q.mu.
+func (q *Queue) sendDue(now time.Time) time.Duration {
+	for len(q.scheduled) > 0 {
+		s := q.scheduled[0]
+		if s.at.After(now) {
+			return s.at.Sub(now)
+		}
+
+		// The message takes over the room it kept while scheduled, unless
+		// the queue holds more than its size, as it may after a restart
+		// with a smaller one.
+		if q.live >= q.size {
+			return scheduleRetry
+		}
+
+		// One record both sends and unschedules the message, so that a
+		// crash cannot leave it sent and still scheduled.
+		msg := q.stamp(s.msg, q.next)
+		var seq uint64
+		if q.wal != nil {
+			var err error
+			if seq, err = q.appendRecord(record{Op: opSend, Msg: &msg, ID: s.msg.ID}); err != nil {
+				log.Printf("queue %s: send scheduled message %s: %v", q.name, s.msg.ID, err)
+				return scheduleRetry
+			}
+		}
+		q.unschedule(s)
+		q.add(msg, seq)
+	}
+
+	return time.Hour
+}
@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"testing"
+	"time"
+)
+
+func TestQueue_Schedule(t *testing.T) {
+	t.Run("delivered when due", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+		defer q.Close()
+
+		sub, _ := q.Subscribe()
+		start := time.Now()
+		if _, err := q.Schedule(text("later"), start.Add(100*time.Millisecond)); err != nil {
+			t.Fatalf("failed to schedule: %v", err)
+		}
+		if _, err := q.Schedule(text("now"), start.Add(-time.Second)); err != nil {
+			t.Fatalf("failed to schedule: %v", err)
+		}
+
+		if d := receive(t, sub); textOf(d.Message) != "now" {
+			t.Errorf("expected now, got %v", textOf(d.Message))
+		}
+		if d := receive(t, sub); textOf(d.Message) != "later" {
+			t.Errorf("expected later, got %v", textOf(d.Message))
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("expected delivery after 100ms, got %v", elapsed)
+		}
+	})
+
+	t.Run("list and cancel", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 1})
+		defer q.Close()
+
+		at := time.Now().Add(time.Hour)
+		second, _ := q.Schedule(text("second"), at.Add(time.Minute))
+		first, _ := q.Schedule(text("first"), at)
+		if _, err := q.Schedule(first, at); err != ErrAlreadyScheduled {
+			t.Fatalf("expected error %v, got %v", ErrAlreadyScheduled, err)
+		}
+
+		list := q.Scheduled()
+		if len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID || !list[0].DeliverAt.Equal(at) {
+			t.Fatalf("unexpected schedule: %+v", list)
+		}
+
+		if err := q.Cancel(first.ID); err != nil {
+			t.Fatalf("failed to cancel: %v", err)
+		}
+		if err := q.Cancel(first.ID); err != ErrNotScheduled {
+			t.Fatalf("expected error %v, got %v", ErrNotScheduled, err)
+		}
+		if list := q.Scheduled(); len(list) != 1 || list[0].ID != second.ID {
+			t.Errorf("unexpected schedule: %+v", list)
+		}
+	})
+
+	t.Run("counts against size", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 2, MaxSub: 1})
+		defer q.Close()
+
+		at := time.Now().Add(time.Hour)
+		if _, err := q.Send(text("sent")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if _, err := q.Schedule(text("first"), at); err != nil {
+			t.Fatalf("failed to schedule: %v", err)
+		}
+		if _, err := q.Schedule(text("second"), at); err != ErrQueueFull {
+			t.Errorf("expected error %v, got %v", ErrQueueFull, err)
+		}
+		// The scheduled message keeps its room from sends too.
+		if _, err := q.Send(text("second")); err != ErrQueueFull {
+			t.Errorf("expected error %v, got %v", ErrQueueFull, err)
+		}
+		if _, err := q.SendBatch([]Message{text("second")}, false); err != ErrQueueFull {
+			t.Errorf("expected error %v, got %v", ErrQueueFull, err)
+		}
+	})
+
+	t.Run("durable", func(t *testing.T) {
+		dir := t.TempDir()
+		qCfg := config.QueueConfig{Size: 10, MaxSub: 1, Durable: true, SegmentSize: 64}
+
+		q, err := OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to open queue: %v", err)
+		}
+		kept, _ := q.Schedule(text("kept"), time.Now().Add(200*time.Millisecond))
+		cancelled, _ := q.Schedule(text("cancelled"), time.Now().Add(200*time.Millisecond))
+		if err := q.Cancel(cancelled.ID); err != nil {
+			t.Fatalf("failed to cancel: %v", err)
+		}
+		// Delivering other messages compacts the log around the schedule.
+		for _, msg := range []string{"m1", "m2"} {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+		consume(t, q, 2)
+		q.Close()
+
+		q, err = OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to reopen queue: %v", err)
+		}
+		defer q.Close()
+
+		if list := q.Scheduled(); len(list) != 1 || list[0].ID != kept.ID {
+			t.Fatalf("unexpected schedule after restart: %+v", list)
+		}
+		sub, _ := q.Subscribe()
+		if d := receive(t, sub); d.Message.ID != kept.ID {
+			t.Errorf("expected %s, got %+v", kept.ID, d.Message)
+		}
+		q.Close()
+
+		// Once sent the message is no longer scheduled.
+		q, err = OpenQueue(qCfg, dir)
+		if err != nil {
+			t.Fatalf("failed to reopen queue: %v", err)
+		}
+		defer q.Close()
+		if list := q.Scheduled(); len(list) != 0 {
+			t.Errorf("expected an empty schedule, got %+v", list)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package broker
+
+import (
+	"log"
+	"sync"
+
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/filter"
+)
+
+// DefaultSubscriberBuffer is the number of deliveries that can wait for a
+// subscriber before the slow consumer policy applies.
+const DefaultSubscriberBuffer = 16
+
+// maxPenalties bounds the number of penalized subscribers a queue reports.
+const maxPenalties = 100
+
+type subscriber struct {
+	id      uint64
+	ch      Subscriber
+	group   *group
+	filter  *filter.Filter
+	gone    chan struct{}
+	sending sync.WaitGroup
+	unacked int
+
+	// buf holds the deliveries waiting for the subscriber to receive them.
+	// signal wakes its pump when buf was empty.
+	buf     []queued
+	signal  chan struct{}
+	penalty *Penalty
+
+	// disconnect is set for subscribers of a partition. It ends the
+	// subscription to the partitioned queue, which owns ch.
+	disconnect func()
+}
+
+type queued struct {
+	d  Delivery
+	st *dispatchState
+}
+
+// Penalty records how the slow consumer policy treated a subscriber that
+// fell behind.
+type Penalty struct {
+	Subscriber   uint64 `json:"subscriber"`
+	Group        string `json:"group,omitempty"`
+	Dropped      int    `json:"dropped"`
+	Disconnected bool   `json:"disconnected,omitempty"`
+}
+
+// SubscriberID returns the ID the queue uses for sub, for example in its
+// list of penalized subscribers.
+func (q *Queue) SubscriberID(sub Subscriber) (uint64, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.parts != nil {
+		m, ok := q.members[sub]
+		if !ok {
+			return 0, false
+		}
+		return m.id, true
+	}
+
+	s, ok := q.subs[sub]
+	if !ok {
+		return 0, false
+	}
+	return s.id, true
+}
+
+// offer puts a delivery into the buffer of s. If the buffer is full the
+// slow consumer policy decides: wait for room, drop the oldest or the new
+// delivery, or disconnect s. A dropped delivery counts as received; on
+// queues that require acknowledgements it is redelivered once its
+// visibility timeout expires. The caller must hold q.mu.
+func (q *Queue) offer(s *subscriber, qd queued) {
+	for len(s.buf) >= q.buffer {
+		if q.subs[s.ch] != s || q.closing() {
+			q.fail(qd)
+			return
+		}
+
+		switch q.slow {
+		case config.SlowDropNewest:
+			q.penalize(s).Dropped++
+			q.complete(qd.st, true)
+			return
+		case config.SlowDropOldest:
+			old := s.buf[0]
+			s.buf[0] = queued{}
+			s.buf = s.buf[1:]
+			q.penalize(s).Dropped++
+			q.complete(old.st, true)
+		case config.SlowDisconnect:
+			q.penalize(s).Disconnected = true
+			log.Printf("queue %s: disconnect slow subscriber %d", q.name, s.id)
+			q.fail(qd)
+			q.detach(s)
+			go func() {
+				s.sending.Wait()
+				if s.disconnect != nil {
+					s.disconnect()
+				} else {
+					close(s.ch)
+				}
+			}()
+			return
+		default:
+			q.cond.Wait()
+		}
+	}
+
+	s.buf = append(s.buf, qd)
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// fail records that a delivery did not reach its subscriber. The caller
+// must hold q.mu.
+func (q *Queue) fail(qd queued) {
+	if q.requireAck {
+		q.untrack(qd.d.Tag)
+	}
+	q.complete(qd.st, false)
+}
+
+// penalize returns the penalty record of s, creating it if needed. The
+// caller must hold q.mu.
+func (q *Queue) penalize(s *subscriber) *Penalty {
+	if s.penalty == nil {
+		s.penalty = &Penalty{Subscriber: s.id, Group: s.group.name}
+		q.penalties = append(q.penalties, s.penalty)
+		if len(q.penalties) > maxPenalties {
+			q.penalties[0] = nil
+			q.penalties = q.penalties[1:]
+		}
+	}
+	return s.penalty
+}
+
+// detach removes s from the queue. Deliveries still in its buffer go back
+// to its group. The caller must hold q.mu and close s.ch once s.sending is
+// done.
+func (q *Queue) detach(s *subscriber) {
+	delete(q.subs, s.ch)
+	s.group.leave(s)
+	close(s.gone)
+
+	// Fail the newest first so that the redeliveries keep their order.
+	for i := len(s.buf) - 1; i >= 0; i-- {
+		q.fail(s.buf[i])
+	}
+	s.buf = nil
+
+	if s.group.ephemeral {
+		q.dropGroup(s.group)
+	}
+	q.cond.Broadcast()
+}
+
+// pump hands the buffered deliveries of s to its channel one by one.
+func (q *Queue) pump(s *subscriber) {
+	defer q.wg.Done()
+	defer s.sending.Done()
+
+	for {
+		q.mu.Lock()
+		if len(s.buf) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-s.signal:
+				continue
+			case <-s.gone:
+				return
+			case <-q.done:
+				return
+			}
+		}
+		qd := s.buf[0]
+		s.buf[0] = queued{}
+		s.buf = s.buf[1:]
+		// A dispatcher may be waiting for room.
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		sent := false
+		select {
+		case s.ch <- qd.d:
+			sent = true
+		case <-s.gone:
+		case <-q.done:
+		}
+
+		q.mu.Lock()
+		if sent {
+			q.complete(qd.st, true)
+		} else {
+			q.fail(qd)
+		}
+		q.mu.Unlock()
+
+		if !sent {
+			return
+		}
+	}
+}
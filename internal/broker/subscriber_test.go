@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+
+	"reflect"
+	"testing"
+	"time"
+)
+
+// slowQueue returns a queue with a fast subscriber that received msgs and a
+// slow one that has not read anything yet.
+func slowQueue(t *testing.T, policy string, msgs ...string) (*Queue, Subscriber) {
+	t.Helper()
+	q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2, SubscriberBuffer: 1, SlowConsumerPolicy: policy})
+
+	fast, _ := q.Subscribe()
+	slow, _ := q.Subscribe()
+	for _, msg := range msgs {
+		if _, err := q.Send(text(msg)); err != nil {
+			t.Fatalf("failed to send %q: %v", msg, err)
+		}
+		if d := receive(t, fast); textOf(d.Message) != msg {
+			t.Fatalf("fast: expected %v, got %v", msg, textOf(d.Message))
+		}
+		if msg == msgs[0] {
+			waitPumped(t, q, slow)
+		}
+	}
+	return q, slow
+}
+
+// waitPumped waits until the pump of sub took everything from its buffer.
+func waitPumped(t *testing.T, q *Queue, sub Subscriber) {
+	t.Helper()
+	waitFor(t, func() bool {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		return len(q.subs[sub].buf) == 0
+	}, "expected the buffer to be drained")
+}
+
+func penalty(q *Queue) Penalty {
+	info := q.Info()
+	if len(info.Penalized) == 0 {
+		return Penalty{}
+	}
+	return info.Penalized[0]
+}
+
+func TestQueue_SlowConsumerPolicy(t *testing.T) {
+	msgs := []string{"m1", "m2", "m3", "m4", "m5"}
+
+	t.Run("drop newest", func(t *testing.T) {
+		q, slow := slowQueue(t, config.SlowDropNewest, msgs...)
+		defer q.Close()
+
+		id, _ := q.SubscriberID(slow)
+		if p := penalty(q); p.Subscriber != id || p.Dropped != 3 {
+			t.Errorf("expected subscriber %d to be penalized for 3 drops, got %+v", id, p)
+		}
+		// One delivery waits in the pump, one in the buffer.
+		if got := receiveAll(t, slow, 2); !reflect.DeepEqual(got, []string{"m1", "m2"}) {
+			t.Errorf("expected [m1 m2], got %v", got)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		q, slow := slowQueue(t, config.SlowDropOldest, msgs...)
+		defer q.Close()
+
+		if p := penalty(q); p.Dropped != 3 {
+			t.Errorf("expected 3 drops, got %+v", p)
+		}
+		if got := receiveAll(t, slow, 2); !reflect.DeepEqual(got, []string{"m1", "m5"}) {
+			t.Errorf("expected [m1 m5], got %v", got)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		q, slow := slowQueue(t, config.SlowDisconnect, msgs...)
+		defer q.Close()
+
+		if p := penalty(q); !p.Disconnected {
+			t.Errorf("expected the slow subscriber to be disconnected, got %+v", p)
+		}
+		for range slow {
+		}
+		if n := q.Info().Subscribers; n != 1 {
+			t.Errorf("expected 1 subscriber, got %d", n)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		q := NewQueue(config.QueueConfig{Size: 10, MaxSub: 2, SubscriberBuffer: 1})
+		defer q.Close()
+
+		fast, _ := q.Subscribe()
+		slow, _ := q.Subscribe()
+		for _, msg := range msgs[:4] {
+			if _, err := q.Send(text(msg)); err != nil {
+				t.Fatalf("failed to send %q: %v", msg, err)
+			}
+			if msg == msgs[0] {
+				waitPumped(t, q, slow)
+			}
+		}
+
+		// The slow subscriber holds m1 in its pump and m2 in its buffer, so
+		// m3 has to wait for room before m4 can go out.
+		if got := receiveAll(t, fast, 3); !reflect.DeepEqual(got, []string{"m1", "m2", "m3"}) {
+			t.Errorf("expected [m1 m2 m3], got %v", got)
+		}
+		select {
+		case d := <-fast:
+			t.Fatalf("expected the slow subscriber to hold back %v", textOf(d.Message))
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		receive(t, slow)
+		if d := receive(t, fast); textOf(d.Message) != "m4" {
+			t.Errorf("expected m4, got %v", textOf(d.Message))
+		}
+		if p := penalty(q); p != (Penalty{}) {
+			t.Errorf("expected no penalty, got %+v", p)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrEmptyTx = errors.New("transaction has no messages")
+
+// TxMessage is a message of a transaction together with the queue it is
+// sent to.
+type TxMessage struct {
+	Queue string `json:"queue"`
+	Message
+}
+
+// Tx is a set of messages that Publish sends to their queues together.
+type Tx struct {
+	Messages []TxMessage `json:"messages"`
+}
+
+// Publish sends the messages of tx to their queues, either all of them or,
+// if a queue is missing, closed or lacks room for its share, none. It
+// returns the messages in the order of tx with what Send assigns, or for
+// duplicates the messages they duplicate.
+//
+// The queues are locked in name order while room is checked and the
+// messages are added. A crash while they are written to the logs of durable
+// queues may leave the transaction applied to some of them only.
+func (b *Broker) Publish(tx Tx) ([]Message, error) {
+	if len(tx.Messages) == 0 {
+		return nil, ErrEmptyTx
+	}
+
+	byQueue := make(map[*Queue][]int)
+	msgs := make([]Message, len(tx.Messages))
+	for i, m := range tx.Messages {
+		q, err := b.GetQueue(m.Queue)
+		if err != nil {
+			return nil, err
+		}
+		if q.parts != nil {
+			q = q.partitionFor(m.Message)
+		}
+		byQueue[q] = append(byQueue[q], i)
+		msgs[i] = m.Message
+	}
+
+	shares := make([]share, 0, len(byQueue))
+	for q, idx := range byQueue {
+		shares = append(shares, share{q: q, idx: idx})
+	}
+
+	return publish(shares, msgs, true)
+}
+
+// share holds the positions of the messages that go to one queue, or one
+// partition of a partitioned queue.
+type share struct {
+	q   *Queue
+	idx []int
+}
+
+// publish sends the messages of every share to its queue. With atomic it
+// sends either all messages or none. Otherwise it sends msgs in order until
+// one does not fit its queue and returns ErrQueueFull with the ones before.
+func publish(shares []share, msgs []Message, atomic bool) ([]Message, error) {
+	sort.Slice(shares, func(i, j int) bool {
+		a, b := shares[i].q, shares[j].q
+		return a.name < b.name || a.name == b.name && a.partition < b.partition
+	})
+
+	for _, sh := range shares {
+		sh.q.mu.Lock()
+		defer sh.q.mu.Unlock()
+	}
+
+	for _, sh := range shares {
+		if sh.q.closing() {
+			return nil, ErrQueueClosed
+		}
+	}
+
+	n := len(msgs)
+	room := make(map[*Queue]int, len(shares))
+	for _, sh := range shares {
+		room[sh.q] = sh.q.room()
+		if atomic && room[sh.q] < len(sh.idx) {
+			return nil, ErrQueueFull
+		}
+	}
+	if !atomic {
+		// Duplicates count against the room as well, which may stop
+		// short of what would fit.
+		owner := make([]*Queue, len(msgs))
+		for _, sh := range shares {
+			for _, k := range sh.idx {
+				owner[k] = sh.q
+			}
+		}
+		for i, q := range owner {
+			if room[q] == 0 {
+				n = i
+				break
+			}
+			room[q]--
+		}
+	}
+
+	sent := make([]Message, len(msgs))
+	first := make([]uint64, len(shares))
+	for i, sh := range shares {
+		first[i] = sh.q.next
+		var batch []Message
+		for _, k := range sh.idx {
+			if k < n {
+				batch = append(batch, msgs[k])
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		added, err := sh.q.sendBatch(batch, true)
+		if err != nil {
+			for j, prev := range shares[:i] {
+				for _, k := range prev.idx {
+					// Duplicates were not added and keep the original.
+					if k < n && sent[k].Offset >= first[j] {
+						prev.q.remove(prev.q.at(sent[k].Offset))
+						prev.q.dedup.forget(sent[k])
+					}
+				}
+			}
+			return nil, err
+		}
+		for j, m := range added {
+			sent[sh.idx[j]] = m
+		}
+	}
+
+	if n < len(msgs) {
+		return sent[:n], ErrQueueFull
+	}
+	return sent, nil
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/wal"
+
+	"testing"
+	"time"
+)
+
+func TestBroker_Publish(t *testing.T) {
+	b, err := New(&config.Config{Queues: []config.QueueConfig{
+		{Name: "orders", Size: 2, MaxSub: 1},
+		{Name: "audit", Size: 3, MaxSub: 1},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	defer b.Close()
+	orders, _ := b.GetQueue("orders")
+	audit, _ := b.GetQueue("audit")
+
+	sent, err := b.Publish(Tx{Messages: []TxMessage{
+		{Queue: "orders", Message: text("o1")},
+		{Queue: "audit", Message: text("a1")},
+		{Queue: "audit", Message: text("a2")},
+	}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(sent) != 3 || textOf(sent[0]) != "o1" || sent[1].Offset != 0 || sent[2].Offset != 1 || sent[2].ID == "" {
+		t.Fatalf("unexpected messages sent: %+v", sent)
+	}
+
+	tests := []struct {
+		name string
+		tx   Tx
+		err  error
+	}{
+		{"queue full", Tx{Messages: []TxMessage{{Queue: "orders", Message: text("o2")}, {Queue: "audit", Message: text("a3")}, {Queue: "audit", Message: text("a4")}}}, ErrQueueFull},
+		{"queue not found", Tx{Messages: []TxMessage{{Queue: "orders", Message: text("o2")}, {Queue: "unknown", Message: text("u1")}}}, ErrQueueNotFound},
+		{"empty", Tx{}, ErrEmptyTx},
+	}
+	for _, tt := range tests {
+		if _, err := b.Publish(tt.tx); err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	if info := orders.Info(); info.Messages != 1 || info.NextOffset != 1 {
+		t.Errorf("orders: expected 1 message, got %d with next offset %d", info.Messages, info.NextOffset)
+	}
+	if info := audit.Info(); info.Messages != 2 || info.NextOffset != 2 {
+		t.Errorf("audit: expected 2 messages, got %d with next offset %d", info.Messages, info.NextOffset)
+	}
+
+	sub, _ := audit.Subscribe()
+	if got := receiveAll(t, sub, 2); got[0] != "a1" || got[1] != "a2" {
+		t.Errorf("audit: expected [a1 a2], got %v", got)
+	}
+}
+
+func TestBroker_PublishRollback(t *testing.T) {
+	b, err := New(&config.Config{DataDir: t.TempDir(), Queues: []config.QueueConfig{
+		{Name: "a", Size: 10, MaxSub: 1, DedupWindow: config.Duration(time.Minute)},
+		{Name: "b", Size: 10, MaxSub: 1, Durable: true},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	defer b.Close()
+	qa, _ := b.GetQueue("a")
+	qb, _ := b.GetQueue("b")
+
+	tx := Tx{Messages: []TxMessage{
+		{Queue: "a", Message: Message{ID: "m1", Payload: []byte(`1`)}},
+		{Queue: "b", Message: Message{ID: "m2", Payload: []byte(`2`)}},
+	}}
+
+	// Failing to write the log of b rolls back what went to a.
+	_ = qb.wal.Close()
+	if _, err := b.Publish(tx); err != wal.ErrClosed {
+		t.Fatalf("expected error %v, got %v", wal.ErrClosed, err)
+	}
+	if qb.wal, err = wal.Open(t.TempDir(), wal.Options{}); err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+
+	// The retry is not taken for a duplicate of the rolled back messages.
+	sent, err := b.Publish(tx)
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if sent[0].Offset != 1 {
+		t.Errorf("expected m1 at offset 1, got %d", sent[0].Offset)
+	}
+	if info := qa.Info(); info.Messages != 1 {
+		t.Errorf("a: expected 1 message, got %d", info.Messages)
+	}
+	if again, err := b.Publish(tx); err != nil || again[0].Offset != 1 || qa.Info().Messages != 1 {
+		t.Errorf("expected the committed messages to be deduplicated, got %+v and %v", again, err)
+	}
+}
@@ -2,18 +2,202 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
+	"time"
+)
+
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(v) * time.Millisecond)
+	case string:
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dur)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+
+	return nil
+}
+
+const (
+	DeliveryBroadcast = "broadcast"
+	DeliveryWork      = "work"
+
+	DispatchRoundRobin = "round_robin"
+	DispatchLeastBusy  = "least_busy"
+
+	MaxPriorityLevels = 256
+	MaxPartitions     = 1024
+
+	SlowBlock      = "block"
+	SlowDropOldest = "drop_oldest"
+	SlowDropNewest = "drop_newest"
+	SlowDisconnect = "disconnect"
 )
 
 type QueueConfig struct {
-	Name   string `json:"name"`
-	Size   int    `json:"size"`
-	MaxSub int    `json:"max_sub"`
+	Name          string   `json:"name"`
+	Size          int      `json:"size"`
+	MaxSub        int      `json:"max_sub"`
+	Durable       bool     `json:"durable,omitempty"`
+	Fsync         string   `json:"fsync,omitempty"`
+	FsyncInterval Duration `json:"fsync_interval,omitempty"`
+	SegmentSize   int64    `json:"segment_size,omitempty"`
+
+	RequireAck        bool     `json:"require_ack,omitempty"`
+	VisibilityTimeout Duration `json:"visibility_timeout,omitempty"`
+
+	DeliveryMode string `json:"delivery_mode,omitempty"`
+	WorkDispatch string `json:"work_dispatch,omitempty"`
+
+	RetentionMessages int      `json:"retention_messages,omitempty"`
+	RetentionBytes    int64    `json:"retention_bytes,omitempty"`
+	RetentionAge      Duration `json:"retention_age,omitempty"`
+
+	DeadLetterQueue string `json:"dead_letter_queue,omitempty"`
+	MaxDeliveries   int    `json:"max_deliveries,omitempty"`
+
+	MessageTTL Duration `json:"message_ttl,omitempty"`
+
+	PriorityLevels int      `json:"priority_levels,omitempty"`
+	PriorityAging  Duration `json:"priority_aging,omitempty"`
+
+	SubscriberBuffer   int    `json:"subscriber_buffer,omitempty"`
+	SlowConsumerPolicy string `json:"slow_consumer_policy,omitempty"`
+
+	DedupWindow Duration `json:"dedup_window,omitempty"`
+
+	Partitions int `json:"partitions,omitempty"`
+}
+
+func (c QueueConfig) Validate() error {
+	if c.Name == "" || c.Name == "." || c.Name == ".." || strings.ContainsAny(c.Name, `/\`) {
+		return fmt.Errorf("invalid queue name %q", c.Name)
+	}
+
+	switch c.DeliveryMode {
+	case "", DeliveryBroadcast, DeliveryWork:
+	default:
+		return fmt.Errorf("queue %s: unknown delivery mode %q", c.Name, c.DeliveryMode)
+	}
+
+	switch c.WorkDispatch {
+	case "", DispatchRoundRobin, DispatchLeastBusy:
+	default:
+		return fmt.Errorf("queue %s: unknown work dispatch %q", c.Name, c.WorkDispatch)
+	}
+
+	switch c.SlowConsumerPolicy {
+	case "", SlowBlock, SlowDropOldest, SlowDropNewest, SlowDisconnect:
+	default:
+		return fmt.Errorf("queue %s: unknown slow consumer policy %q", c.Name, c.SlowConsumerPolicy)
+	}
+	if c.SubscriberBuffer < 0 {
+		return fmt.Errorf("queue %s: subscriber buffer must not be negative", c.Name)
+	}
+
+	if c.RetentionMessages < 0 || c.RetentionBytes < 0 || c.RetentionAge < 0 {
+		return fmt.Errorf("queue %s: retention limits must not be negative", c.Name)
+	}
+
+	if c.DeadLetterQueue == c.Name {
+		return fmt.Errorf("queue %s: dead letter queue must be another queue", c.Name)
+	}
+	if c.MaxDeliveries < 0 {
+		return fmt.Errorf("queue %s: max deliveries must not be negative", c.Name)
+	}
+	if c.MessageTTL < 0 {
+		return fmt.Errorf("queue %s: message ttl must not be negative", c.Name)
+	}
+	if c.PriorityLevels < 0 || c.PriorityLevels > MaxPriorityLevels {
+		return fmt.Errorf("queue %s: priority levels must be between 0 and %d", c.Name, MaxPriorityLevels)
+	}
+	if c.PriorityAging < 0 {
+		return fmt.Errorf("queue %s: priority aging must not be negative", c.Name)
+	}
+	if c.DedupWindow < 0 {
+		return fmt.Errorf("queue %s: dedup window must not be negative", c.Name)
+	}
+	if c.Partitions < 0 || c.Partitions > MaxPartitions {
+		return fmt.Errorf("queue %s: partitions must be between 0 and %d", c.Name, MaxPartitions)
+	}
+	if c.MaxDeliveries > 0 && !c.RequireAck {
+		return fmt.Errorf("queue %s: max deliveries requires acknowledgements", c.Name)
+	}
+
+	return nil
+}
+
+// ExchangeConfig describes a topic exchange. A message published to it
+// with a routing key goes to every queue with a matching binding.
+type ExchangeConfig struct {
+	Name     string          `json:"name"`
+	Bindings []BindingConfig `json:"bindings,omitempty"`
+}
+
+// BindingConfig binds a queue to an exchange. Pattern is a routing key
+// whose dot-separated words may be "*", which matches one word, or "#",
+// which matches any number of words.
+type BindingConfig struct {
+	Queue   string `json:"queue"`
+	Pattern string `json:"pattern"`
+}
+
+func (c ExchangeConfig) Validate() error {
+	if c.Name == "" || strings.ContainsAny(c.Name, `/\`) {
+		return fmt.Errorf("invalid exchange name %q", c.Name)
+	}
+
+	for _, b := range c.Bindings {
+		if err := b.Validate(); err != nil {
+			return fmt.Errorf("exchange %s: %w", c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c BindingConfig) Validate() error {
+	if c.Queue == "" {
+		return fmt.Errorf("binding %q: missing queue", c.Pattern)
+	}
+	if c.Pattern == "" {
+		return fmt.Errorf("binding to %s: missing pattern", c.Queue)
+	}
+	for _, word := range strings.Split(c.Pattern, ".") {
+		if word == "" || (len(word) > 1 && strings.ContainsAny(word, "*#")) {
+			return fmt.Errorf("binding to %s: invalid pattern %q", c.Queue, c.Pattern)
+		}
+	}
+
+	return nil
 }
 
 type Config struct {
-	Queues []QueueConfig `json:"queues"`
-	Addr   string        `json:"addr"`
+	Queues    []QueueConfig    `json:"queues"`
+	Exchanges []ExchangeConfig `json:"exchanges,omitempty"`
+	Addr      string           `json:"addr"`
+	TCPAddr   string           `json:"tcp_addr,omitempty"`
+	StompAddr string           `json:"stomp_addr,omitempty"`
+	MQTTAddr  string           `json:"mqtt_addr,omitempty"`
+	DataDir   string           `json:"data_dir"`
 }
 
 func Load(path string) (*Config, error) {
@@ -28,5 +212,16 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	for _, qc := range cfg.Queues {
+		if err := qc.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, ec := range cfg.Exchanges {
+		if err := ec.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	return &cfg, nil
 }
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestLoad(t *testing.T) {
@@ -18,10 +20,18 @@ func TestLoad(t *testing.T) {
 			{
 				"name": "test_queue_2",
 				"size": 50,
-				"max_sub": 5
+				"max_sub": 5,
+				"durable": true,
+				"fsync": "interval",
+				"fsync_interval": "2s",
+				"segment_size": 1024
 			}
 		],
-		"addr": "localhost:9090"
+		"addr": "localhost:9090",
+		"tcp_addr": "localhost:9091",
+		"stomp_addr": "localhost:61613",
+		"mqtt_addr": "localhost:1883",
+		"data_dir": "/var/lib/broker"
 	}`)
 	tmpfile, err := os.CreateTemp("", "test_config.json")
 	if err != nil {
@@ -46,9 +56,21 @@ func TestLoad(t *testing.T) {
 		expectedCfg := &Config{
 			Queues: []QueueConfig{
 				{Name: "test_queue_1", Size: 100, MaxSub: 10},
-				{Name: "test_queue_2", Size: 50, MaxSub: 5},
+				{
+					Name:          "test_queue_2",
+					Size:          50,
+					MaxSub:        5,
+					Durable:       true,
+					Fsync:         "interval",
+					FsyncInterval: Duration(2 * time.Second),
+					SegmentSize:   1024,
+				},
 			},
-			Addr: "localhost:9090",
+			Addr:      "localhost:9090",
+			TCPAddr:   "localhost:9091",
+			StompAddr: "localhost:61613",
+			MQTTAddr:  "localhost:1883",
+			DataDir:   "/var/lib/broker",
 		}
 
 		if !reflect.DeepEqual(cfg, expectedCfg) {
@@ -86,3 +108,97 @@ func TestLoad(t *testing.T) {
 		}
 	})
 }
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	var qc QueueConfig
+	if err := json.Unmarshal([]byte(`{"fsync_interval": "250ms"}`), &qc); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if time.Duration(qc.FsyncInterval) != 250*time.Millisecond {
+		t.Errorf("expected 250ms, got %v", time.Duration(qc.FsyncInterval))
+	}
+
+	if err := json.Unmarshal([]byte(`{"fsync_interval": 1500}`), &qc); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if time.Duration(qc.FsyncInterval) != 1500*time.Millisecond {
+		t.Errorf("expected numbers to be read as milliseconds, got %v", time.Duration(qc.FsyncInterval))
+	}
+
+	if err := json.Unmarshal([]byte(`{"fsync_interval": "soon"}`), &qc); err == nil {
+		t.Error("expected an error for invalid duration")
+	}
+}
+
+func TestQueueConfig_Validate(t *testing.T) {
+	valid := []QueueConfig{
+		{Name: "q"},
+		{Name: "q", DeliveryMode: DeliveryBroadcast},
+		{Name: "q", DeliveryMode: DeliveryWork, WorkDispatch: DispatchLeastBusy},
+		{Name: "q", RetentionMessages: 100, RetentionBytes: 1 << 20, RetentionAge: Duration(time.Hour)},
+		{Name: "q", RequireAck: true, MaxDeliveries: 3, DeadLetterQueue: "dlq"},
+		{Name: "q", PriorityLevels: 10, PriorityAging: Duration(time.Second)},
+		{Name: "q", SubscriberBuffer: 100, SlowConsumerPolicy: SlowDisconnect},
+		{Name: "q", DedupWindow: Duration(time.Minute)},
+		{Name: "q", Partitions: 8},
+	}
+	for _, qc := range valid {
+		if err := qc.Validate(); err != nil {
+			t.Errorf("%+v: expected no error, got %v", qc, err)
+		}
+	}
+
+	invalid := []QueueConfig{
+		{Name: "q", DeliveryMode: "multicast"},
+		{Name: "q", WorkDispatch: "random"},
+		{Name: "q", RetentionMessages: -1},
+		{Name: ""},
+		{Name: ".."},
+		{Name: "a/b"},
+		{Name: "q", DeadLetterQueue: "q"},
+		{Name: "q", MaxDeliveries: 3},
+		{Name: "q", MessageTTL: Duration(-time.Second)},
+		{Name: "q", PriorityLevels: MaxPriorityLevels + 1},
+		{Name: "q", SlowConsumerPolicy: "ignore"},
+		{Name: "q", SubscriberBuffer: -1},
+		{Name: "q", DedupWindow: Duration(-time.Minute)},
+		{Name: "q", Partitions: -1},
+		{Name: "q", Partitions: MaxPartitions + 1},
+	}
+	for _, qc := range invalid {
+		if err := qc.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", qc)
+		}
+	}
+}
+
+func TestExchangeConfig_Validate(t *testing.T) {
+	valid := []ExchangeConfig{
+		{Name: "events"},
+		{Name: "events", Bindings: []BindingConfig{
+			{Queue: "q", Pattern: "orders.eu.created"},
+			{Queue: "q", Pattern: "orders.*.created"},
+			{Queue: "q", Pattern: "orders.#"},
+			{Queue: "q", Pattern: "#"},
+		}},
+	}
+	for _, ec := range valid {
+		if err := ec.Validate(); err != nil {
+			t.Errorf("%+v: expected no error, got %v", ec, err)
+		}
+	}
+
+	invalid := []ExchangeConfig{
+		{Name: ""},
+		{Name: "a/b"},
+		{Name: "events", Bindings: []BindingConfig{{Pattern: "orders.#"}}},
+		{Name: "events", Bindings: []BindingConfig{{Queue: "q"}}},
+		{Name: "events", Bindings: []BindingConfig{{Queue: "q", Pattern: "orders..created"}}},
+		{Name: "events", Bindings: []BindingConfig{{Queue: "q", Pattern: "orders.eu*"}}},
+	}
+	for _, ec := range invalid {
+		if err := ec.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", ec)
+		}
+	}
+}
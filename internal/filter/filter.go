@@ -0,0 +1,375 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Lookup returns the value of a field, which is a string, a float64, a bool
+// or nil, and whether the field exists.
+type Lookup func(name string) (any, bool)
+
+// Filter is a parsed filter expression such as
+//
+//	type = 'order' AND (amount > 100 OR priority IN ('high', 'urgent'))
+//
+// Expressions compare fields with literals using =, !=, <>, <, <=, >, >=
+// and IN, and combine comparisons with AND, OR, NOT and parentheses.
+// Keywords are case-insensitive. Literals are single-quoted strings, in
+// which a quote is written twice, numbers, and true or false. Field names
+// may contain letters, digits, '_', '-' and '.', or be double-quoted.
+//
+// A comparison with a missing field, or with a value that does not have the
+// type of the literal, is false. Strings are compared with number literals
+// as numbers if they parse as one, and with true and false if they are
+// "true" or "false".
+type Filter struct {
+	src  string
+	root node
+}
+
+func Parse(src string) (*Filter, error) {
+	p := &parser{lex: lexer{src: src}}
+	p.next()
+
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+
+	return &Filter{src: src, root: root}, nil
+}
+
+// Match reports whether the fields returned by lookup satisfy f.
+func (f *Filter) Match(lookup Lookup) bool {
+	return f.root.eval(lookup)
+}
+
+func (f *Filter) String() string {
+	return f.src
+}
+
+type node interface {
+	eval(lookup Lookup) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(lookup Lookup) bool { return n.left.eval(lookup) && n.right.eval(lookup) }
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(lookup Lookup) bool { return n.left.eval(lookup) || n.right.eval(lookup) }
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(lookup Lookup) bool { return !n.operand.eval(lookup) }
+
+type compareNode struct {
+	field string
+	op    string
+	value any
+}
+
+func (n compareNode) eval(lookup Lookup) bool {
+	v, ok := lookup(n.field)
+	if !ok {
+		return false
+	}
+
+	c, ok := compare(v, n.value)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "=":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type inNode struct {
+	field  string
+	values []any
+}
+
+func (n inNode) eval(lookup Lookup) bool {
+	v, ok := lookup(n.field)
+	if !ok {
+		return false
+	}
+
+	for _, value := range n.values {
+		if c, ok := compare(v, value); ok && c == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compare orders the field value v against the literal lit and reports
+// whether the two can be compared at all. Booleans only compare as equal or
+// not, with false before true.
+func compare(v, lit any) (int, bool) {
+	switch lit := lit.(type) {
+	case float64:
+		var f float64
+		switch v := v.(type) {
+		case float64:
+			f = v
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(v, 64); err != nil {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+		switch {
+		case f < lit:
+			return -1, true
+		case f > lit:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(s, lit), true
+	case bool:
+		var b bool
+		switch v := v.(type) {
+		case bool:
+			b = v
+		case string:
+			if v != "true" && v != "false" {
+				return 0, false
+			}
+			b = v == "true"
+		default:
+			return 0, false
+		}
+		switch {
+		case b == lit:
+			return 0, true
+		case lit:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// maxDepth bounds how deeply parentheses and NOTs may nest, so that a
+// hostile expression cannot exhaust the stack of the parser.
+const maxDepth = 64
+
+type parser struct {
+	lex   lexer
+	tok   token
+	err   error
+	depth int
+}
+
+// enter descends into a nested expression; the caller calls leave once done.
+func (p *parser) enter() error {
+	if p.depth++; p.depth > maxDepth {
+		return p.errorf("expression nested more than %d levels deep", maxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() { p.depth-- }
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("filter: %s at offset %d", fmt.Sprintf(format, args...), p.tok.pos)
+}
+
+func (p *parser) keyword(word string) bool {
+	return p.tok.kind == tokIdent && !p.tok.quoted && strings.EqualFold(p.tok.text, word)
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		p.next()
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (node, error) {
+	if p.keyword("NOT") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		p.next()
+		operand, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	if p.tok.kind == tokLParen {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ) instead of %s", p.tok)
+		}
+		p.next()
+		return n, nil
+	}
+
+	if p.tok.kind != tokIdent || (!p.tok.quoted && isKeyword(p.tok.text)) {
+		return nil, p.errorf("expected a field instead of %s", p.tok)
+	}
+	field := p.tok.text
+	p.next()
+
+	if p.keyword("IN") {
+		p.next()
+		return p.in(field)
+	}
+
+	if p.tok.kind != tokOp {
+		return nil, p.errorf("expected an operator instead of %s", p.tok)
+	}
+	op := p.tok.text
+	p.next()
+
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := value.(bool); ok && op != "=" && op != "!=" && op != "<>" {
+		return nil, p.errorf("booleans cannot be compared with %s", op)
+	}
+
+	return compareNode{field: field, op: op, value: value}, nil
+}
+
+func (p *parser) in(field string) (node, error) {
+	if p.tok.kind != tokLParen {
+		return nil, p.errorf("expected ( instead of %s", p.tok)
+	}
+	p.next()
+
+	n := inNode{field: field}
+	for {
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		n.values = append(n.values, value)
+
+		switch p.tok.kind {
+		case tokComma:
+			p.next()
+		case tokRParen:
+			p.next()
+			return n, nil
+		default:
+			return nil, p.errorf("expected , or ) instead of %s", p.tok)
+		}
+	}
+}
+
+func (p *parser) literal() (any, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	var value any
+	switch {
+	case p.tok.kind == tokString:
+		value = p.tok.text
+	case p.tok.kind == tokNumber:
+		f, err := strconv.ParseFloat(p.tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", p.tok.text)
+		}
+		value = f
+	case p.keyword("true"):
+		value = true
+	case p.keyword("false"):
+		value = false
+	default:
+		return nil, p.errorf("expected a value instead of %s", p.tok)
+	}
+	p.next()
+
+	return value, nil
+}
+
+func isKeyword(s string) bool {
+	switch strings.ToUpper(s) {
+	case "AND", "OR", "NOT", "IN", "TRUE", "FALSE":
+		return true
+	}
+	return false
+}
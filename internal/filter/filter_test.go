@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilter_Match(t *testing.T) {
+	fields := map[string]any{
+		"type":         "order",
+		"amount":       150.0,
+		"count":        "3",
+		"express":      true,
+		"flag":         "false",
+		"region.name":  "eu",
+		"content-type": "application/json",
+		"note":         nil,
+	}
+	lookup := func(name string) (any, bool) {
+		v, ok := fields[name]
+		return v, ok
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"type = 'order' AND amount > 100", true},
+		{"type = 'order' AND amount > 200", false},
+		{"type = 'refund' OR amount >= 150", true},
+		{"type <> 'order'", false},
+		{"type != 'refund'", true},
+		{"NOT type = 'refund'", true},
+		{"not (type = 'order' and amount < 100)", true},
+		{"count = 3 AND count < 10.5", true},
+		{"count > '10'", true},
+		{"express = true AND flag = false", true},
+		{"amount = 'order'", false},
+		{"missing = 1", false},
+		{"missing != 1", false},
+		{"NOT missing = 1", true},
+		{"note = 'x'", false},
+		{"type IN ('refund', 'order')", true},
+		{"amount IN (1, 2)", false},
+		{"region.name = 'eu' AND content-type = 'application/json'", true},
+		{`"content-type" = 'application/json'`, true},
+		{"amount > -1 AND amount < 1000.5", true},
+		{"type = 'order' OR missing = 1 AND amount < 0", true},
+		{"(type = 'order' OR missing = 1) AND amount < 0", false},
+	}
+	for _, tt := range tests {
+		f, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match(lookup); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"type",
+		"type =",
+		"type = order",
+		"type = 'order",
+		"= 'order'",
+		"type = 'order' AND",
+		"(type = 'order'",
+		"type = 'order')",
+		"type IN 'order'",
+		"type IN ('order'",
+		"express > true",
+		"amount ! 1",
+		"amount = 1.2.3",
+		"and = 1",
+		"type = 'order' #",
+		strings.Repeat("(", 1<<20),
+		strings.Repeat("NOT ", 100) + "a = 1",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestParse_Depth(t *testing.T) {
+	// Nesting up to the limit is fine.
+	expr := strings.Repeat("(NOT ", maxDepth/2) + "type = 'order'" + strings.Repeat(")", maxDepth/2)
+	f, err := Parse(expr)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	lookup := func(name string) (any, bool) { return "order", name == "type" }
+	if !f.Match(lookup) {
+		t.Error("expected an even number of NOTs to match")
+	}
+
+	if _, err := Parse("(" + expr + ")"); err == nil {
+		t.Error("expected nesting past the limit to fail")
+	}
+}
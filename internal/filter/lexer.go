@@ -0,0 +1,141 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	quoted bool
+	pos    int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return fmt.Sprintf("'%s'", strings.ReplaceAll(t.text, "'", "''"))
+	case tokIdent:
+		if t.quoted {
+			return fmt.Sprintf("%q", t.text)
+		}
+	}
+	return t.text
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && isSpace(l.src[l.pos]) {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}, nil
+	case c == ',':
+		l.pos++
+		return token{kind: tokComma, text: ",", pos: start}, nil
+	case c == '=':
+		l.pos++
+		return token{kind: tokOp, text: "=", pos: start}, nil
+	case c == '!' || c == '<' || c == '>':
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '=' || (c == '<' && l.src[l.pos] == '>')) {
+			l.pos++
+		}
+		op := l.src[start:l.pos]
+		if op == "!" {
+			return token{}, fmt.Errorf("filter: unexpected ! at offset %d", start)
+		}
+		return token{kind: tokOp, text: op, pos: start}, nil
+	case c == '\'':
+		text, err := l.quoted('\'')
+		return token{kind: tokString, text: text, pos: start}, err
+	case c == '"':
+		text, err := l.quoted('"')
+		return token{kind: tokIdent, text: text, quoted: true, pos: start}, err
+	case c == '-' || c == '.' || isDigit(c):
+		l.pos++
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+	if !unicode.IsLetter(r) && r != '_' {
+		return token{}, fmt.Errorf("filter: unexpected %q at offset %d", r, start)
+	}
+	l.pos += size
+	for l.pos < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			break
+		}
+		l.pos += size
+	}
+	return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+}
+
+// quoted reads text enclosed in q, in which q is written twice.
+func (l *lexer) quoted(q byte) (string, error) {
+	start := l.pos
+	l.pos++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		if c != q {
+			b.WriteByte(c)
+			continue
+		}
+		if l.pos < len(l.src) && l.src[l.pos] == q {
+			b.WriteByte(q)
+			l.pos++
+			continue
+		}
+		return b.String(), nil
+	}
+
+	return "", fmt.Errorf("filter: unterminated %c at offset %d", q, start)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+)
+
+// sseHeartbeat is how often an idle event stream gets a comment, so that
+// proxies do not close it.
+const sseHeartbeat = 15 * time.Second
+
+// getEvents streams a subscription as server-sent events. The ID of every
+// event is the offset of its message; a client that reconnects with
+// Last-Event-ID resumes after it. On partitioned queues offsets are per
+// partition, so the ID lists the last offset seen of every partition, as in
+// "0:7,2:3". Takes the query parameters of postSubscription.
+func (h *Handler) getEvents(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	opts, err := subscribeOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	partitioned := len(q.Info().Partitions) > 0
+	seen := make(map[int]uint64)
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if seen, err = parseEventID(v, partitioned); err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %q", v), http.StatusBadRequest)
+			return
+		}
+		next := make(map[int]uint64, len(seen))
+		for p, offset := range seen {
+			next[p] = offset + 1
+		}
+		opts = append(opts, broker.FromOffsets(next))
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, err := q.Subscribe(opts...)
+	if err != nil {
+		subscribeError(w, err)
+		return
+	}
+	defer q.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if id, ok := q.SubscriberID(sub); ok {
+		w.Header().Set("X-Subscriber-Id", strconv.FormatUint(id, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case d, ok := <-sub:
+			if !ok {
+				return
+			}
+			var v any = d
+			if d.Tag == 0 {
+				v = d.Message
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				return
+			}
+			id := strconv.FormatUint(d.Message.Offset, 10)
+			if partitioned {
+				seen[d.Message.Partition] = d.Message.Offset
+				id = eventID(seen)
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", id, data); err != nil {
+				return
+			}
+			heartbeat.Reset(sseHeartbeat)
+		}
+		f.Flush()
+	}
+}
+
+// eventID lists the offsets of a partitioned queue by partition.
+func eventID(offsets map[int]uint64) string {
+	parts := make([]int, 0, len(offsets))
+	for p := range offsets {
+		parts = append(parts, p)
+	}
+	sort.Ints(parts)
+
+	var sb strings.Builder
+	for i, p := range parts {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%d:%d", p, offsets[p])
+	}
+	return sb.String()
+}
+
+// parseEventID reads an event ID written by getEvents. The ID of a queue
+// without partitions is the offset of partition 0.
+func parseEventID(v string, partitioned bool) (map[int]uint64, error) {
+	offsets := make(map[int]uint64)
+	if !partitioned {
+		offset, err := strconv.ParseUint(v, 10, 64)
+		offsets[0] = offset
+		return offsets, err
+	}
+	for _, part := range strings.Split(v, ",") {
+		p, offset, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, errors.New("missing partition")
+		}
+		i, err := strconv.Atoi(p)
+		if err != nil || i < 0 {
+			return nil, errors.New("invalid partition")
+		}
+		if offsets[i], err = strconv.ParseUint(offset, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return offsets, nil
+}
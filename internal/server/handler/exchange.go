@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+)
+
+// serveExchanges handles /exchanges and everything below it.
+func (h *Handler) serveExchanges(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.broker.Exchanges())
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		h.putExchange(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		h.getExchange(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		h.deleteExchange(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "bindings" && r.Method == http.MethodPost:
+		h.postBinding(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "bindings" && r.Method == http.MethodDelete:
+		h.deleteBinding(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "messages" && r.Method == http.MethodPost:
+		h.postExchangeMessage(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// exchangeError writes err for a failed exchange request.
+func exchangeError(w http.ResponseWriter, err error) {
+	switch err {
+	case broker.ErrExchangeNotFound, broker.ErrQueueNotFound, broker.ErrBindingNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case broker.ErrExchangeExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case broker.ErrUnroutable:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case broker.ErrQueueFull:
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case broker.ErrQueueClosed:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) putExchange(w http.ResponseWriter, r *http.Request, name string) {
+	var ec config.ExchangeConfig
+	if err := json.NewDecoder(r.Body).Decode(&ec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ec.Name = name
+
+	if err := ec.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ec, err := h.broker.CreateExchange(ec)
+	if err != nil {
+		exchangeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ec)
+}
+
+func (h *Handler) getExchange(w http.ResponseWriter, r *http.Request, name string) {
+	ec, err := h.broker.GetExchange(name)
+	if err != nil {
+		exchangeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ec)
+}
+
+func (h *Handler) deleteExchange(w http.ResponseWriter, r *http.Request, name string) {
+	if err := h.broker.DeleteExchange(name); err != nil {
+		exchangeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) postBinding(w http.ResponseWriter, r *http.Request, name string) {
+	var bc config.BindingConfig
+	if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bc.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.broker.Bind(name, bc); err != nil {
+		exchangeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteBinding removes the binding given by the queue and pattern query
+// parameters.
+func (h *Handler) deleteBinding(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	bc := config.BindingConfig{Queue: query.Get("queue"), Pattern: query.Get("pattern")}
+
+	if err := h.broker.Unbind(name, bc); err != nil {
+		exchangeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postExchangeMessage publishes a message with the routing key given in
+// X-Routing-Key to the queues bound to the exchange.
+func (h *Handler) postExchangeMessage(w http.ResponseWriter, r *http.Request, name string) {
+	key := r.Header.Get("X-Routing-Key")
+	if key == "" {
+		http.Error(w, "missing X-Routing-Key", http.StatusBadRequest)
+		return
+	}
+	msg, err := readMessage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sent, err := h.broker.Route(name, key, msg)
+	if err != nil {
+		exchangeError(w, err)
+		return
+	}
+
+	resp := txResponse{Results: make([]txResult, len(sent))}
+	for i, m := range sent {
+		resp.Results[i] = txResult{Queue: m.Queue, ID: m.ID, Offset: m.Offset}
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
@@ -1,11 +1,21 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/filter"
 )
 
 type Handler struct {
@@ -17,25 +27,148 @@ func New(b *broker.Broker) *Handler {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/transactions" && r.Method == http.MethodPost {
+		h.postTransaction(w, r)
+		return
+	}
+
 	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
+	if len(parts) >= 2 && parts[1] == "exchanges" {
+		h.serveExchanges(w, r, parts[2:])
+		return
+	}
+	if len(parts) < 2 || parts[1] != "queues" {
 		http.NotFound(w, r)
 		return
 	}
 
+	if len(parts) < 4 {
+		h.serveQueues(w, r, parts[2:])
+		return
+	}
+
 	queueName := parts[2]
 	action := parts[3]
 
 	switch {
 	case r.Method == http.MethodPost && action == "messages":
 		h.postMessage(w, r, queueName)
+	case r.Method == http.MethodGet && action == "messages":
+		h.getMessages(w, r, queueName)
+	case r.Method == http.MethodPost && action == "messages:batch":
+		h.postBatch(w, r, queueName)
 	case r.Method == http.MethodPost && action == "subscriptions":
 		h.postSubscription(w, r, queueName)
+	case r.Method == http.MethodGet && action == "events":
+		h.getEvents(w, r, queueName)
+	case r.Method == http.MethodGet && action == "ws":
+		h.serveWebSocket(w, r, queueName)
+	case r.Method == http.MethodPost && action == "acks":
+		h.postAcks(w, r, queueName)
+	case r.Method == http.MethodPost && action == "nacks":
+		h.postNacks(w, r, queueName)
+	case r.Method == http.MethodPost && action == "redrive":
+		h.postRedrive(w, r, queueName)
+	case r.Method == http.MethodDelete && action == "groups" && len(parts) == 5:
+		h.deleteGroup(w, r, queueName, parts[4])
+	case r.Method == http.MethodGet && action == "scheduled" && len(parts) == 4:
+		h.listScheduled(w, r, queueName)
+	case r.Method == http.MethodDelete && action == "scheduled" && len(parts) == 5:
+		h.cancelScheduled(w, r, queueName, parts[4])
 	default:
 		http.NotFound(w, r)
 	}
 }
 
+// serveQueues handles /queues and /queues/{name}.
+func (h *Handler) serveQueues(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		h.listQueues(w)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		h.putQueue(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		h.getQueue(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		h.deleteQueue(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) listQueues(w http.ResponseWriter) {
+	queues := h.broker.Queues()
+	infos := make([]broker.QueueInfo, len(queues))
+	for i, q := range queues {
+		infos[i] = q.Info()
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *Handler) putQueue(w http.ResponseWriter, r *http.Request, queueName string) {
+	var qc config.QueueConfig
+	if err := json.NewDecoder(r.Body).Decode(&qc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qc.Name = queueName
+
+	if err := qc.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if qc.Size <= 0 || qc.MaxSub <= 0 {
+		http.Error(w, "size and max_sub must be positive", http.StatusBadRequest)
+		return
+	}
+
+	q, err := h.broker.CreateQueue(qc)
+	if err != nil {
+		if err == broker.ErrQueueExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, q.Info())
+}
+
+func (h *Handler) getQueue(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, q.Info())
+}
+
+func (h *Handler) deleteQueue(w http.ResponseWriter, r *http.Request, queueName string) {
+	if err := h.broker.DeleteQueue(queueName); err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
 func (h *Handler) postMessage(w http.ResponseWriter, r *http.Request, queueName string) {
 	q, err := h.broker.GetQueue(queueName)
 	if err != nil {
@@ -47,14 +180,43 @@ func (h *Handler) postMessage(w http.ResponseWriter, r *http.Request, queueName
 		return
 	}
 
-	var msg broker.Message
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+	deliverAt, err := deliveryTime(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait, err := publishWait(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg, err := readMessage(r)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := q.Send(msg); err != nil {
+	if !deliverAt.IsZero() && deliverAt.After(time.Now()) {
+		h.scheduleMessage(w, q, msg, deliverAt)
+		return
+	}
+
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		msg, err = q.SendContext(ctx, msg)
+	} else {
+		msg, err = q.Send(msg)
+	}
+	if err != nil {
+		if err == broker.ErrDuplicate {
+			writeJSON(w, http.StatusOK, publishResponse{ID: msg.ID, Offset: msg.Offset, Partition: msg.Partition})
+			return
+		}
 		if err == broker.ErrQueueFull {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		if err == broker.ErrQueueFull || err == broker.ErrQueueClosed {
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
@@ -62,10 +224,64 @@ func (h *Handler) postMessage(w http.ResponseWriter, r *http.Request, queueName
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, http.StatusAccepted, publishResponse{ID: msg.ID, Offset: msg.Offset, Partition: msg.Partition})
 }
 
-func (h *Handler) postSubscription(w http.ResponseWriter, r *http.Request, queueName string) {
+// readMessage reads a message from the request body, which holds the
+// payload, and the X-Header-*, X-TTL, X-Expires-At and X-Priority headers.
+// The message ID, which queues with a dedup window use to drop duplicates,
+// is taken from Idempotency-Key or X-Message-Id. X-Partition-Key sets the
+// partition key header.
+func readMessage(r *http.Request) (broker.Message, error) {
+	var err error
+	msg := broker.Message{Headers: messageHeaders(r.Header)}
+	if key := r.Header.Get("X-Partition-Key"); key != "" {
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[broker.HeaderPartitionKey] = key
+	}
+	msg.ID = r.Header.Get("Idempotency-Key")
+	if msg.ID == "" {
+		msg.ID = r.Header.Get("X-Message-Id")
+	}
+	if msg.ExpiresAt, err = messageExpiry(r.Header); err != nil {
+		return broker.Message{}, err
+	}
+	if v := r.Header.Get("X-Priority"); v != "" {
+		if msg.Priority, err = strconv.Atoi(v); err != nil || msg.Priority < 0 {
+			return broker.Message{}, fmt.Errorf("invalid X-Priority %q", v)
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg.Payload); err != nil {
+		return broker.Message{}, err
+	}
+
+	return msg, nil
+}
+
+type publishResponse struct {
+	ID        string `json:"id"`
+	Offset    uint64 `json:"offset"`
+	Partition int    `json:"partition,omitempty"`
+}
+
+// batchResult is the outcome of one message of a batch. Error is set for
+// messages that were not accepted.
+type batchResult struct {
+	ID     string `json:"id,omitempty"`
+	Offset uint64 `json:"offset"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// postBatch publishes a JSON array of messages, or one message per line if
+// the body is NDJSON. Messages use the envelope subscribers receive. Unless
+// ?mode=best_effort is given, either all messages are accepted or none.
+func (h *Handler) postBatch(w http.ResponseWriter, r *http.Request, queueName string) {
 	q, err := h.broker.GetQueue(queueName)
 	if err != nil {
 		if err == broker.ErrQueueNotFound {
@@ -76,17 +292,291 @@ func (h *Handler) postSubscription(w http.ResponseWriter, r *http.Request, queue
 		return
 	}
 
-	sub, err := q.Subscribe()
+	var atomic bool
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "atomic":
+		atomic = true
+	case "best_effort":
+	default:
+		http.Error(w, fmt.Sprintf("invalid mode %q", mode), http.StatusBadRequest)
+		return
+	}
+
+	msgs, err := decodeBatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sent, err := q.SendBatch(msgs, atomic)
+	if err != nil && (atomic || err != broker.ErrQueueFull) {
+		switch err {
+		case broker.ErrQueueFull:
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case broker.ErrQueueClosed:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := batchResponse{Results: make([]batchResult, len(msgs))}
+	for i := range msgs {
+		if i < len(sent) {
+			resp.Results[i] = batchResult{ID: sent[i].ID, Offset: sent[i].Offset}
+		} else {
+			resp.Results[i] = batchResult{Error: err.Error()}
+		}
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// decodeBatch reads the messages of a batch request.
+func decodeBatch(r *http.Request) ([]broker.Message, error) {
+	var msgs []broker.Message
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson":
+		dec := json.NewDecoder(r.Body)
+		for {
+			var msg broker.Message
+			if err := dec.Decode(&msg); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+		}
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	for i, msg := range msgs {
+		if len(msg.Payload) == 0 {
+			return nil, fmt.Errorf("message %d has no payload", i)
+		}
+	}
+	return msgs, nil
+}
+
+type txResult struct {
+	Queue  string `json:"queue"`
+	ID     string `json:"id"`
+	Offset uint64 `json:"offset"`
+}
+
+type txResponse struct {
+	Results []txResult `json:"results"`
+}
+
+// postTransaction publishes messages to several queues, either all of them
+// or none.
+func (h *Handler) postTransaction(w http.ResponseWriter, r *http.Request) {
+	var tx broker.Tx
+	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, m := range tx.Messages {
+		if len(m.Payload) == 0 {
+			http.Error(w, fmt.Sprintf("message %d has no payload", i), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sent, err := h.broker.Publish(tx)
 	if err != nil {
-		if err == broker.ErrTooManySub {
+		switch err {
+		case broker.ErrEmptyTx:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case broker.ErrQueueNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case broker.ErrQueueFull:
+			w.Header().Set("Retry-After", retryAfter)
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case broker.ErrQueueClosed:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := txResponse{Results: make([]txResult, len(sent))}
+	for i, msg := range sent {
+		resp.Results[i] = txResult{Queue: tx.Messages[i].Queue, ID: msg.ID, Offset: msg.Offset}
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+type scheduleResponse struct {
+	ID        string    `json:"id"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+func (h *Handler) scheduleMessage(w http.ResponseWriter, q *broker.Queue, msg broker.Message, at time.Time) {
+	msg, err := q.Schedule(msg, at)
+	if err != nil {
+		switch err {
+		case broker.ErrDuplicate:
+			writeJSON(w, http.StatusOK, publishResponse{ID: msg.ID, Offset: msg.Offset, Partition: msg.Partition})
+		case broker.ErrAlreadyScheduled:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case broker.ErrQueueFull:
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case broker.ErrQueueClosed:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, scheduleResponse{ID: msg.ID, DeliverAt: at})
+}
+
+// retryAfter is the Retry-After value, in seconds, sent when a message is
+// rejected because the queue is full.
+const retryAfter = "1"
+
+// publishWait reads how long a publish may wait for room in a full queue,
+// from either the wait query parameter, a duration such as "5s" or a number
+// of milliseconds, or a "Prefer: wait=5" header in seconds.
+func publishWait(r *http.Request) (time.Duration, error) {
+	if v := r.URL.Query().Get("wait"); v != "" {
+		wait, err := parseDuration(v)
+		if err != nil || wait < 0 {
+			return 0, fmt.Errorf("invalid wait %q", v)
+		}
+		return wait, nil
+	}
+
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.FieldsFunc(v, func(c rune) bool { return c == ',' || c == ';' }) {
+			name, value, _ := strings.Cut(strings.TrimSpace(pref), "=")
+			if !strings.EqualFold(name, "wait") {
+				continue
+			}
+			secs, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || secs < 0 {
+				return 0, fmt.Errorf("invalid Prefer wait %q", value)
+			}
+			return time.Duration(secs) * time.Second, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// deliveryTime reads when a message should be delivered from either
+// X-Deliver-At, an RFC 3339 time, or X-Delay-Ms, a number of milliseconds.
+// It returns the zero time for immediate delivery.
+func deliveryTime(h http.Header) (time.Time, error) {
+	if v := h.Get("X-Deliver-At"); v != "" {
+		at, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid X-Deliver-At %q", v)
+		}
+		return at, nil
+	}
+
+	if v := h.Get("X-Delay-Ms"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms < 0 {
+			return time.Time{}, fmt.Errorf("invalid X-Delay-Ms %q", v)
+		}
+		return time.Now().Add(time.Duration(ms) * time.Millisecond), nil
+	}
+
+	return time.Time{}, nil
+}
+
+// headerPrefix marks request headers that are copied into the message
+// headers, e.g. "X-Header-Type: order" becomes {"type": "order"}.
+const headerPrefix = "X-Header-"
+
+func messageHeaders(h http.Header) map[string]string {
+	var headers map[string]string
+	for key, values := range h {
+		if !strings.HasPrefix(key, headerPrefix) || len(key) == len(headerPrefix) {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.ToLower(key[len(headerPrefix):])] = values[0]
+	}
+	return headers
+}
+
+// messageExpiry reads the expiry of a message from either X-TTL, a duration
+// such as "30s" or a number of milliseconds, or X-Expires-At, an RFC 3339
+// time.
+func messageExpiry(h http.Header) (*time.Time, error) {
+	if v := h.Get("X-TTL"); v != "" {
+		ttl, err := parseDuration(v)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid X-TTL %q", v)
+		}
+		expires := time.Now().Add(ttl)
+		return &expires, nil
+	}
+
+	if v := h.Get("X-Expires-At"); v != "" {
+		expires, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Expires-At %q", v)
+		}
+		return &expires, nil
+	}
+
+	return nil, nil
+}
+
+// parseDuration accepts a Go duration or a number of milliseconds, like
+// durations in the configuration.
+func parseDuration(v string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(v)
+}
+
+func (h *Handler) postSubscription(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
 			return
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	opts, err := subscribeOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub, err := q.Subscribe(opts...)
+	if err != nil {
+		subscribeError(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	if id, ok := q.SubscriberID(sub); ok {
+		w.Header().Set("X-Subscriber-Id", strconv.FormatUint(id, 10))
+	}
 	w.WriteHeader(http.StatusOK)
 
 	for {
@@ -94,11 +584,15 @@ func (h *Handler) postSubscription(w http.ResponseWriter, r *http.Request, queue
 		case <-r.Context().Done():
 			q.Unsubscribe(sub)
 			return
-		case msg, ok := <-sub:
+		case d, ok := <-sub:
 			if !ok {
 				return
 			}
-			if err := json.NewEncoder(w).Encode(msg); err != nil {
+			var v any = d
+			if d.Tag == 0 {
+				v = d.Message
+			}
+			if err := json.NewEncoder(w).Encode(v); err != nil {
 				q.Unsubscribe(sub)
 				return
 			}
@@ -108,3 +602,202 @@ func (h *Handler) postSubscription(w http.ResponseWriter, r *http.Request, queue
 		}
 	}
 }
+
+// subscribeError writes err for a failed subscription.
+func subscribeError(w http.ResponseWriter, err error) {
+	switch err {
+	case broker.ErrTooManySub, broker.ErrQueueClosed:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case broker.ErrPartitionedOffset:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func subscribeOptions(query url.Values) ([]broker.SubscribeOption, error) {
+	opts := []broker.SubscribeOption{broker.WithGroup(query.Get("group"))}
+
+	if v := query.Get("from_offset"); v != "" {
+		offset, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from_offset %q", v)
+		}
+		opts = append(opts, broker.FromOffset(offset))
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since %q", v)
+		}
+		opts = append(opts, broker.Since(since))
+	}
+	if v := query.Get("filter"); v != "" {
+		f, err := filter.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, broker.WithFilter(f))
+	}
+
+	return opts, nil
+}
+
+type ackRequest struct {
+	Tags []uint64 `json:"tags"`
+}
+
+func (h *Handler) postAcks(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var req ackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := q.Ack(req.Tags...); err != nil {
+		switch err {
+		case broker.ErrAckDisabled:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case broker.ErrUnknownDelivery:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type nackRequest struct {
+	Tags    []uint64 `json:"tags"`
+	Requeue bool     `json:"requeue"`
+}
+
+func (h *Handler) postNacks(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var req nackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := q.Nack(req.Requeue, req.Tags...); err != nil {
+		switch err {
+		case broker.ErrAckDisabled:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case broker.ErrUnknownDelivery:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type redriveResponse struct {
+	Moved int `json:"moved"`
+}
+
+func (h *Handler) postRedrive(w http.ResponseWriter, r *http.Request, queueName string) {
+	moved, err := h.broker.Redrive(queueName)
+	if err != nil {
+		switch err {
+		case broker.ErrQueueNotFound:
+			http.NotFound(w, r)
+		case broker.ErrNoDeadLetterQueue:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case broker.ErrQueueFull, broker.ErrQueueClosed:
+			http.Error(w, fmt.Sprintf("moved %d messages: %v", moved, err), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, redriveResponse{Moved: moved})
+}
+
+func (h *Handler) listScheduled(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, q.Scheduled())
+}
+
+func (h *Handler) cancelScheduled(w http.ResponseWriter, r *http.Request, queueName, id string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := q.Cancel(id); err != nil {
+		if err == broker.ErrNotScheduled {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) deleteGroup(w http.ResponseWriter, r *http.Request, queueName, group string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := q.DeleteGroup(group); err != nil {
+		switch err {
+		case broker.ErrGroupNotFound:
+			http.NotFound(w, r)
+		case broker.ErrGroupInUse:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
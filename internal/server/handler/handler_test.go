@@ -3,34 +3,210 @@ package handler
 import (
 	"github.com/IgorLem99/simple_broker/internal/broker"
 	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/websocket"
 
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 )
 
+func newBroker(t *testing.T, cfg *config.Config) *broker.Broker {
+	t.Helper()
+	b, err := broker.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+	return b
+}
+
 func TestHandler_PostMessage(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
-		b := broker.New(cfg)
+		b := newBroker(t, cfg)
 		defer b.Close()
 		h := New(b)
 
 		body := strings.NewReader(`{"key": "value"}`)
 		req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", body)
+		req.Header.Set("X-Header-Type", "order")
 		rr := httptest.NewRecorder()
 		h.ServeHTTP(rr, req)
 
 		if status := rr.Code; status != http.StatusAccepted {
 			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusAccepted)
 		}
+
+		var resp publishResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+		}
+		if resp.ID == "" || resp.Offset != 0 {
+			t.Errorf("handler returned unexpected response: %+v", resp)
+		}
+
+		q, _ := b.GetQueue("q1")
+		sub, _ := q.Subscribe()
+		select {
+		case d := <-sub:
+			if d.Message.ID != resp.ID || d.Message.Headers["type"] != "order" || string(d.Message.Payload) != `{"key": "value"}` {
+				t.Errorf("unexpected message in queue: %+v", d.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	})
+
+	t.Run("partition key", func(t *testing.T) {
+		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 2, MaxSub: 1, Partitions: 4}}}
+		b := newBroker(t, cfg)
+		defer b.Close()
+		h := New(b)
+
+		var resps []publishResponse
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"m"`))
+			req.Header.Set("X-Partition-Key", "customer-7")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+			}
+
+			var resp publishResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+			}
+			resps = append(resps, resp)
+		}
+
+		if resps[0].Partition != resps[1].Partition || resps[0].Offset != 0 || resps[1].Offset != 1 {
+			t.Errorf("expected offsets 0 and 1 in one partition, got %+v", resps)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 2, MaxSub: 1}}}
+		b := newBroker(t, cfg)
+		defer b.Close()
+		h := New(b)
+
+		tests := []struct {
+			header string
+			value  string
+			status int
+		}{
+			{"X-TTL", "60000", http.StatusAccepted},
+			{"X-Expires-At", time.Now().Add(time.Minute).Format(time.RFC3339), http.StatusAccepted},
+			{"X-TTL", "soon", http.StatusBadRequest},
+			{"X-Expires-At", "tomorrow", http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"hello"`))
+			req.Header.Set(tt.header, tt.value)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("%s: %s: handler returned wrong status code: got %v want %v", tt.header, tt.value, status, tt.status)
+			}
+		}
+
+		q, _ := b.GetQueue("q1")
+		sub, _ := q.Subscribe()
+		select {
+		case d := <-sub:
+			if d.Message.ExpiresAt == nil || time.Until(*d.Message.ExpiresAt) <= 0 {
+				t.Errorf("expected the message to expire in the future, got %v", d.Message.ExpiresAt)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	})
+
+	t.Run("dedup", func(t *testing.T) {
+		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 10, MaxSub: 1, DedupWindow: config.Duration(time.Minute)}}}
+		b := newBroker(t, cfg)
+		defer b.Close()
+		h := New(b)
+
+		tests := []struct {
+			header string
+			value  string
+			status int
+			offset uint64
+		}{
+			{"Idempotency-Key", "k1", http.StatusAccepted, 0},
+			{"Idempotency-Key", "k1", http.StatusOK, 0},
+			{"X-Message-Id", "k1", http.StatusOK, 0},
+			{"X-Message-Id", "k2", http.StatusAccepted, 1},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"hello"`))
+			req.Header.Set(tt.header, tt.value)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Errorf("%s %s: handler returned wrong status code: got %v want %v", tt.header, tt.value, rr.Code, tt.status)
+			}
+			var resp publishResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+			}
+			if resp.ID != tt.value || resp.Offset != tt.offset {
+				t.Errorf("%s %s: handler returned unexpected response: %+v", tt.header, tt.value, resp)
+			}
+		}
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 2, MaxSub: 1, PriorityLevels: 2}}}
+		b := newBroker(t, cfg)
+		defer b.Close()
+		h := New(b)
+
+		for _, tt := range []struct {
+			priority string
+			status   int
+		}{
+			{"", http.StatusAccepted},
+			{"1", http.StatusAccepted},
+			{"urgent", http.StatusBadRequest},
+			{"-1", http.StatusBadRequest},
+		} {
+			req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"`+tt.priority+`"`))
+			if tt.priority != "" {
+				req.Header.Set("X-Priority", tt.priority)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("%q: handler returned wrong status code: got %v want %v", tt.priority, status, tt.status)
+			}
+		}
+
+		q, _ := b.GetQueue("q1")
+		sub, _ := q.Subscribe()
+		select {
+		case d := <-sub:
+			if d.Message.Priority != 1 {
+				t.Errorf("expected the priority message first, got %+v", d.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
 	})
 
 	t.Run("queue not found", func(t *testing.T) {
-		b := broker.New(&config.Config{})
+		b := newBroker(t, &config.Config{})
 		defer b.Close()
 		h := New(b)
 
@@ -46,12 +222,12 @@ func TestHandler_PostMessage(t *testing.T) {
 
 	t.Run("queue full", func(t *testing.T) {
 		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
-		b := broker.New(cfg)
+		b := newBroker(t, cfg)
 		defer b.Close()
 		h := New(b)
 
 		q, _ := b.GetQueue("q1")
-		if err := q.Send("first message"); err != nil {
+		if _, err := q.Send(broker.Message{Payload: json.RawMessage(`"first message"`)}); err != nil {
 			t.Fatalf("failed to fill queue: %v", err)
 		}
 
@@ -63,11 +239,64 @@ func TestHandler_PostMessage(t *testing.T) {
 		if status := rr.Code; status != http.StatusServiceUnavailable {
 			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusServiceUnavailable)
 		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Error("handler did not set Retry-After")
+		}
+	})
+
+	t.Run("wait for room", func(t *testing.T) {
+		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
+		b := newBroker(t, cfg)
+		defer b.Close()
+		h := New(b)
+
+		q, _ := b.GetQueue("q1")
+		if _, err := q.Send(broker.Message{Payload: json.RawMessage(`"first message"`)}); err != nil {
+			t.Fatalf("failed to fill queue: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages?wait=20ms", strings.NewReader(`"second"`))
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusServiceUnavailable {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusServiceUnavailable)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("handler returned after %v, expected it to wait", elapsed)
+		}
+
+		sub, _ := q.Subscribe()
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"second"`))
+			req.Header.Set("Prefer", "respond-async, wait=5")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			done <- rr
+		}()
+		<-sub
+
+		select {
+		case rr := <-done:
+			if status := rr.Code; status != http.StatusAccepted {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusAccepted)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for publish")
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/queues/q1/messages?wait=soon", strings.NewReader(`"third"`))
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
 	})
 
 	t.Run("bad request", func(t *testing.T) {
 		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
-		b := broker.New(cfg)
+		b := newBroker(t, cfg)
 		defer b.Close()
 		h := New(b)
 
@@ -82,10 +311,122 @@ func TestHandler_PostMessage(t *testing.T) {
 	})
 }
 
+func TestHandler_PostBatch(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 3, MaxSub: 1}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	post := func(target, contentType, body string) (*httptest.ResponseRecorder, batchResponse) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		var resp batchResponse
+		if rr.Code == http.StatusAccepted {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+			}
+		}
+		return rr, resp
+	}
+
+	rr, resp := post("/queues/q1/messages:batch", "application/json", `[{"payload": 1}, {"id": "two", "headers": {"type": "order"}, "payload": 2}]`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Offset != 0 || resp.Results[1].ID != "two" || resp.Results[1].Offset != 1 {
+		t.Errorf("handler returned unexpected results: %+v", resp.Results)
+	}
+
+	rr, _ = post("/queues/q1/messages:batch", "application/x-ndjson", "{\"payload\": 3}\n{\"payload\": 4}\n")
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	rr, resp = post("/queues/q1/messages:batch?mode=best_effort", "application/x-ndjson; charset=utf-8", "{\"payload\": 3}\n{\"payload\": 4}\n")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Error != "" || resp.Results[0].Offset != 2 || resp.Results[1].Error != broker.ErrQueueFull.Error() {
+		t.Errorf("handler returned unexpected results: %+v", resp.Results)
+	}
+
+	for _, body := range []string{`[]`, `[{"id": "x"}]`, `{"payload": 1}`} {
+		if rr, _ := post("/queues/q1/messages:batch", "application/json", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+	if rr, _ := post("/queues/q1/messages:batch?mode=some", "application/json", `[{"payload": 1}]`); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	q, _ := b.GetQueue("q1")
+	sub, _ := q.Subscribe()
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case d := <-sub:
+			if string(d.Message.Payload) != want {
+				t.Errorf("expected payload %s, got %s", want, d.Message.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+}
+
+func TestHandler_PostTransaction(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{
+		{Name: "orders", Size: 1, MaxSub: 1},
+		{Name: "audit", Size: 2, MaxSub: 1},
+	}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"success", `{"messages": [{"queue": "orders", "payload": 1}, {"queue": "audit", "headers": {"type": "order"}, "payload": 1}]}`, http.StatusAccepted},
+		{"queue full", `{"messages": [{"queue": "orders", "payload": 2}, {"queue": "audit", "payload": 2}]}`, http.StatusServiceUnavailable},
+		{"queue not found", `{"messages": [{"queue": "audit", "payload": 2}, {"queue": "unknown", "payload": 2}]}`, http.StatusNotFound},
+		{"no payload", `{"messages": [{"queue": "audit"}]}`, http.StatusBadRequest},
+		{"empty", `{"messages": []}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/transactions", strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.status)
+		}
+		if tt.status != http.StatusAccepted {
+			continue
+		}
+		var resp txResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+		}
+		if len(resp.Results) != 2 || resp.Results[1].Queue != "audit" || resp.Results[1].ID == "" {
+			t.Errorf("handler returned unexpected results: %+v", resp.Results)
+		}
+	}
+
+	audit, _ := b.GetQueue("audit")
+	if info := audit.Info(); info.Messages != 1 {
+		t.Errorf("expected 1 message in audit, got %d", info.Messages)
+	}
+}
+
 func TestHandler_PostSubscription(t *testing.T) {
 	t.Run("success and message receive", func(t *testing.T) {
 		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
-		b := broker.New(cfg)
+		b := newBroker(t, cfg)
 		defer b.Close()
 		h := New(b)
 
@@ -102,7 +443,7 @@ func TestHandler_PostSubscription(t *testing.T) {
 		time.Sleep(200 * time.Millisecond)
 
 		q, _ := b.GetQueue("q1")
-		if err := q.Send("test message"); err != nil {
+		if _, err := q.Send(broker.Message{Payload: json.RawMessage(`"test message"`)}); err != nil {
 			t.Fatalf("failed to send message: %v", err)
 		}
 
@@ -113,15 +454,21 @@ func TestHandler_PostSubscription(t *testing.T) {
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 		}
+		if id := rr.Header().Get("X-Subscriber-Id"); id != "1" {
+			t.Errorf("handler returned wrong subscriber id: got %q want %q", id, "1")
+		}
 
-		expected := "\"test message\"\n"
-		if rr.Body.String() != expected {
-			t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+		var msg broker.Message
+		if err := json.Unmarshal(rr.Body.Bytes(), &msg); err != nil {
+			t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+		}
+		if string(msg.Payload) != `"test message"` || msg.ID == "" || msg.Offset != 0 {
+			t.Errorf("handler returned unexpected message: %+v", msg)
 		}
 	})
 
 	t.Run("queue not found", func(t *testing.T) {
-		b := broker.New(&config.Config{})
+		b := newBroker(t, &config.Config{})
 		defer b.Close()
 		h := New(b)
 
@@ -136,7 +483,7 @@ func TestHandler_PostSubscription(t *testing.T) {
 
 	t.Run("too many subscribers", func(t *testing.T) {
 		cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
-		b := broker.New(cfg)
+		b := newBroker(t, cfg)
 		defer b.Close()
 		h := New(b)
 
@@ -157,7 +504,7 @@ func TestHandler_NotFound(t *testing.T) {
 	h := New(nil) // No broker needed for this test
 
 	t.Run("invalid method", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/queues/q1/messages", nil)
+		req := httptest.NewRequest(http.MethodPut, "/queues/q1/messages", nil)
 		rr := httptest.NewRecorder()
 		h.ServeHTTP(rr, req)
 
@@ -176,3 +523,678 @@ func TestHandler_NotFound(t *testing.T) {
 		}
 	})
 }
+
+func TestHandler_PostAcks(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{
+		{Name: "acked", Size: 1, MaxSub: 1, RequireAck: true},
+		{Name: "plain", Size: 1, MaxSub: 1},
+	}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	q, _ := b.GetQueue("acked")
+	sub, _ := q.Subscribe()
+	if _, err := q.Send(broker.Message{Payload: json.RawMessage(`"hello"`)}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	var d broker.Delivery
+	select {
+	case d = <-sub:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"success", "/queues/acked/acks", fmt.Sprintf(`{"tags":[%d]}`, d.Tag), http.StatusNoContent},
+		{"unknown tag", "/queues/acked/acks", fmt.Sprintf(`{"tags":[%d]}`, d.Tag), http.StatusNotFound},
+		{"bad request", "/queues/acked/acks", `not json`, http.StatusBadRequest},
+		{"acks disabled", "/queues/plain/acks", `{"tags":[1]}`, http.StatusBadRequest},
+		{"queue not found", "/queues/non-existent/acks", `{"tags":[1]}`, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestHandler_SubscriptionGroup(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/queues/q1/subscriptions?group=billing", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(rr, req)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	del := httptest.NewRequest(http.MethodDelete, "/queues/q1/groups/billing", nil)
+	delRR := httptest.NewRecorder()
+	h.ServeHTTP(delRR, del)
+	if status := delRR.Code; status != http.StatusConflict {
+		t.Errorf("deleting a group in use returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	cancel()
+	<-done
+
+	delRR = httptest.NewRecorder()
+	h.ServeHTTP(delRR, del)
+	if status := delRR.Code; status != http.StatusNoContent {
+		t.Errorf("deleting an idle group returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	delRR = httptest.NewRecorder()
+	h.ServeHTTP(delRR, del)
+	if status := delRR.Code; status != http.StatusNotFound {
+		t.Errorf("deleting a missing group returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestHandler_SubscriptionReplay(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 2, MaxSub: 1, RetentionMessages: 10}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	q, _ := b.GetQueue("q1")
+	for _, payload := range []string{`"m0"`, `"m1"`} {
+		if _, err := q.Send(broker.Message{Payload: json.RawMessage(payload)}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	t.Run("invalid position", func(t *testing.T) {
+		for _, query := range []string{"from_offset=-1", "since=yesterday"} {
+			req := httptest.NewRequest(http.MethodPost, "/queues/q1/subscriptions?"+query, nil)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("%s: handler returned wrong status code: got %v want %v", query, status, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("from offset", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodPost, "/queues/q1/subscriptions?from_offset=1", nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		var msg broker.Message
+		if err := json.Unmarshal(rr.Body.Bytes(), &msg); err != nil {
+			t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+		}
+		if string(msg.Payload) != `"m1"` || msg.Offset != 1 {
+			t.Errorf("handler returned unexpected message: %+v", msg)
+		}
+	})
+}
+
+func TestHandler_Queues(t *testing.T) {
+	b := newBroker(t, &config.Config{DataDir: t.TempDir()})
+	defer b.Close()
+	h := New(b)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"create", http.MethodPut, "/queues/q1", `{"size": 10, "max_sub": 2, "delivery_mode": "work"}`, http.StatusCreated},
+		{"create existing", http.MethodPut, "/queues/q1", `{"size": 10, "max_sub": 2}`, http.StatusConflict},
+		{"create invalid", http.MethodPut, "/queues/q2", `{"size": 10, "max_sub": 2, "delivery_mode": "multicast"}`, http.StatusBadRequest},
+		{"create without size", http.MethodPut, "/queues/q2", `{"max_sub": 2}`, http.StatusBadRequest},
+		{"create bad request", http.MethodPut, "/queues/q2", `not json`, http.StatusBadRequest},
+		{"describe", http.MethodGet, "/queues/q1", "", http.StatusOK},
+		{"describe missing", http.MethodGet, "/queues/q2", "", http.StatusNotFound},
+		{"list", http.MethodGet, "/queues", "", http.StatusOK},
+		{"delete", http.MethodDelete, "/queues/q1", "", http.StatusNoContent},
+		{"delete missing", http.MethodDelete, "/queues/q1", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.status)
+			}
+
+			switch tt.name {
+			case "describe":
+				var info broker.QueueInfo
+				if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+					t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+				}
+				if info.Name != "q1" || info.Size != 10 || info.DeliveryMode != config.DeliveryWork {
+					t.Errorf("handler returned unexpected queue: %+v", info)
+				}
+			case "list":
+				var infos []broker.QueueInfo
+				if err := json.Unmarshal(rr.Body.Bytes(), &infos); err != nil {
+					t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+				}
+				if len(infos) != 1 || infos[0].Name != "q1" {
+					t.Errorf("handler returned unexpected queues: %+v", infos)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_NacksAndRedrive(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{
+		{Name: "src", Size: 1, MaxSub: 1, RequireAck: true, DeadLetterQueue: "dlq"},
+		{Name: "dlq", Size: 1, MaxSub: 1},
+	}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	q, _ := b.GetQueue("src")
+	sub, _ := q.Subscribe()
+	if _, err := q.Send(broker.Message{Payload: json.RawMessage(`"hello"`)}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	var d broker.Delivery
+	select {
+	case d = <-sub:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"nack", "/queues/src/nacks", fmt.Sprintf(`{"tags":[%d]}`, d.Tag), http.StatusNoContent},
+		{"nack unknown tag", "/queues/src/nacks", fmt.Sprintf(`{"tags":[%d]}`, d.Tag), http.StatusNotFound},
+		{"nack bad request", "/queues/src/nacks", `not json`, http.StatusBadRequest},
+		{"redrive", "/queues/src/redrive", "", http.StatusOK},
+		{"redrive without dlq", "/queues/dlq/redrive", "", http.StatusBadRequest},
+		{"redrive queue not found", "/queues/non-existent/redrive", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.status)
+			}
+		})
+	}
+
+	select {
+	case d := <-sub:
+		if string(d.Message.Payload) != `"hello"` {
+			t.Errorf("unexpected redriven message: %+v", d.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for redriven message")
+	}
+}
+
+func TestHandler_Scheduled(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 1, MaxSub: 1}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"later"`))
+	req.Header.Set("X-Delay-Ms", "60000")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusAccepted)
+	}
+	var resp scheduleResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+	}
+
+	// The scheduled message fills the queue.
+	req = httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"later"`))
+	req.Header.Set("X-Delay-Ms", "60000")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != retryAfter {
+		t.Errorf("handler returned wrong status code or Retry-After: got %v %q", status, rr.Header().Get("Retry-After"))
+	}
+
+	for _, header := range []string{"X-Delay-Ms", "X-Deliver-At"} {
+		req := httptest.NewRequest(http.MethodPost, "/queues/q1/messages", strings.NewReader(`"later"`))
+		req.Header.Set(header, "soon")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", header, status, http.StatusBadRequest)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/queues/q1/scheduled", nil))
+	var list []broker.ScheduledMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+	}
+	if len(list) != 1 || list[0].ID != resp.ID || string(list[0].Payload) != `"later"` {
+		t.Errorf("handler returned unexpected schedule: %+v", list)
+	}
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/queues/q1/scheduled/"+resp.ID, nil))
+		if rr.Code != status {
+			t.Errorf("cancel returned wrong status code: got %v want %v", rr.Code, status)
+		}
+	}
+}
+
+func TestHandler_Exchanges(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{
+		{Name: "eu", Size: 10, MaxSub: 1},
+		{Name: "all", Size: 10, MaxSub: 1},
+	}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name   string
+		rr     func() *httptest.ResponseRecorder
+		status int
+	}{
+		{"create", func() *httptest.ResponseRecorder {
+			return do(http.MethodPut, "/exchanges/orders", `{"bindings": [{"queue": "eu", "pattern": "orders.eu.*"}]}`)
+		}, http.StatusCreated},
+		{"create twice", func() *httptest.ResponseRecorder { return do(http.MethodPut, "/exchanges/orders", `{}`) }, http.StatusConflict},
+		{"invalid pattern", func() *httptest.ResponseRecorder {
+			return do(http.MethodPost, "/exchanges/orders/bindings", `{"queue": "all", "pattern": "orders.a#"}`)
+		}, http.StatusBadRequest},
+		{"bind unknown queue", func() *httptest.ResponseRecorder {
+			return do(http.MethodPost, "/exchanges/orders/bindings", `{"queue": "unknown", "pattern": "orders.#"}`)
+		}, http.StatusNotFound},
+		{"bind", func() *httptest.ResponseRecorder {
+			return do(http.MethodPost, "/exchanges/orders/bindings", `{"queue": "all", "pattern": "orders.#"}`)
+		}, http.StatusNoContent},
+		{"publish", func() *httptest.ResponseRecorder {
+			return do(http.MethodPost, "/exchanges/orders/messages", `{"id": 1}`, "X-Routing-Key", "orders.eu.created")
+		}, http.StatusAccepted},
+		{"publish without key", func() *httptest.ResponseRecorder {
+			return do(http.MethodPost, "/exchanges/orders/messages", `{"id": 2}`)
+		}, http.StatusBadRequest},
+		{"unroutable", func() *httptest.ResponseRecorder {
+			return do(http.MethodPost, "/exchanges/orders/messages", `{"id": 2}`, "X-Routing-Key", "payments.done")
+		}, http.StatusUnprocessableEntity},
+		{"unbind", func() *httptest.ResponseRecorder {
+			return do(http.MethodDelete, "/exchanges/orders/bindings?queue=eu&pattern=orders.eu.*", "")
+		}, http.StatusNoContent},
+		{"unbind twice", func() *httptest.ResponseRecorder {
+			return do(http.MethodDelete, "/exchanges/orders/bindings?queue=eu&pattern=orders.eu.*", "")
+		}, http.StatusNotFound},
+		{"describe", func() *httptest.ResponseRecorder { return do(http.MethodGet, "/exchanges/orders", "") }, http.StatusOK},
+		{"list", func() *httptest.ResponseRecorder { return do(http.MethodGet, "/exchanges", "") }, http.StatusOK},
+		{"delete", func() *httptest.ResponseRecorder { return do(http.MethodDelete, "/exchanges/orders", "") }, http.StatusNoContent},
+		{"describe deleted", func() *httptest.ResponseRecorder { return do(http.MethodGet, "/exchanges/orders", "") }, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rr := tt.rr()
+		if rr.Code != tt.status {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v: %s", tt.name, rr.Code, tt.status, rr.Body.String())
+		}
+
+		switch tt.name {
+		case "publish":
+			var resp txResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+			}
+			if len(resp.Results) != 2 || resp.Results[0].Queue != "eu" || resp.Results[1].Queue != "all" {
+				t.Errorf("handler returned unexpected results: %+v", resp.Results)
+			}
+		case "describe":
+			var ec config.ExchangeConfig
+			if err := json.Unmarshal(rr.Body.Bytes(), &ec); err != nil {
+				t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+			}
+			if len(ec.Bindings) != 1 || ec.Bindings[0].Queue != "all" {
+				t.Errorf("handler returned unexpected bindings: %+v", ec.Bindings)
+			}
+		}
+	}
+
+	q, _ := b.GetQueue("all")
+	sub, _ := q.Subscribe()
+	select {
+	case d := <-sub:
+		if d.Message.Headers[broker.HeaderRoutingKey] != "orders.eu.created" {
+			t.Errorf("expected routing key header, got %v", d.Message.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+func TestHandler_SubscriptionFilter(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 2, MaxSub: 1, RetentionMessages: 10}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	q, _ := b.GetQueue("q1")
+	for _, payload := range []string{`{"amount": 50}`, `{"amount": 150}`} {
+		msg := broker.Message{Headers: map[string]string{"type": "order"}, Payload: json.RawMessage(payload)}
+		if _, err := q.Send(msg); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/queues/q1/subscriptions?filter=amount+%3E", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	filter := url.QueryEscape("type = 'order' AND amount > 100")
+	req = httptest.NewRequest(http.MethodPost, "/queues/q1/subscriptions?from_offset=0&filter="+filter, nil).WithContext(ctx)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var msg broker.Message
+	if err := json.Unmarshal(rr.Body.Bytes(), &msg); err != nil {
+		t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+	}
+	if msg.Offset != 1 {
+		t.Errorf("handler returned unexpected message: %+v", msg)
+	}
+}
+
+func TestHandler_WebSocket(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 10, MaxSub: 1, RequireAck: true}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	srv := httptest.NewServer(New(b))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	if _, err := websocket.Dial(wsURL+"/queues/unknown/ws", nil); err == nil {
+		t.Fatal("expected an error for an unknown queue")
+	}
+
+	conn, err := websocket.Dial(wsURL+"/queues/q1/ws", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var pong bool
+	conn.SetPongHandler(func([]byte) { pong = true })
+	if err := conn.Ping(nil); err != nil {
+		t.Fatalf("failed to ping: %v", err)
+	}
+
+	send := func(req string) {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	read := func() map[string]any {
+		t.Helper()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		var v map[string]any
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatalf("invalid message %q: %v", data, err)
+		}
+		return v
+	}
+
+	// The reply and the delivery may come in either order.
+	send(`{"op": "publish", "ref": "1", "message": {"payload": "m1"}}`)
+	var tag float64
+	for i := 0; i < 2; i++ {
+		v := read()
+		switch v["type"] {
+		case "ok":
+			if v["ref"] != "1" || v["id"] == nil || v["offset"] != 0.0 {
+				t.Errorf("unexpected reply %v", v)
+			}
+		case "message":
+			msg, _ := v["message"].(map[string]any)
+			if msg["payload"] != "m1" {
+				t.Errorf("unexpected delivery %v", v)
+			}
+			tag, _ = v["tag"].(float64)
+		default:
+			t.Errorf("unexpected message %v", v)
+		}
+	}
+	if !pong {
+		t.Error("expected a pong")
+	}
+
+	send(fmt.Sprintf(`{"op": "ack", "ref": "2", "tags": [%d]}`, int(tag)))
+	if v := read(); v["type"] != "ok" || v["ref"] != "2" {
+		t.Errorf("unexpected reply %v", v)
+	}
+	send(fmt.Sprintf(`{"op": "ack", "ref": "3", "tags": [%d]}`, int(tag)))
+	if v := read(); v["type"] != "error" || v["error"] != broker.ErrUnknownDelivery.Error() {
+		t.Errorf("unexpected reply %v", v)
+	}
+	send(`{"op": "subscribe"}`)
+	if v := read(); v["type"] != "error" {
+		t.Errorf("unexpected reply %v", v)
+	}
+}
+
+func TestHandler_Events(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 10, MaxSub: 1, RetentionMessages: 10}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	q, _ := b.GetQueue("q1")
+	for _, msg := range []string{`"m0"`, `"m1"`, `"m2"`} {
+		if _, err := q.Send(broker.Message{Payload: json.RawMessage(msg)}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/queues/q1/events", nil)
+	req.Header.Set("Last-Event-ID", "first")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// A client that saw m0 resumes with m1.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req = httptest.NewRequest(http.MethodGet, "/queues/q1/events", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "0")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("handler returned wrong content type: got %q", ct)
+	}
+	events := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n\n"), "\n\n")
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %q", rr.Body.String())
+	}
+	for i, event := range events {
+		var msg broker.Message
+		lines := strings.Split(event, "\n")
+		if len(lines) != 2 || lines[0] != fmt.Sprintf("id: %d", i+1) || json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &msg) != nil {
+			t.Fatalf("unexpected event %q", event)
+		}
+		if want := fmt.Sprintf(`"m%d"`, i+1); string(msg.Payload) != want {
+			t.Errorf("expected payload %s, got %s", want, msg.Payload)
+		}
+	}
+}
+
+func TestHandler_EventsPartitioned(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 10, MaxSub: 1, Partitions: 2, RetentionMessages: 10}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	// Send until both partitions have two messages.
+	q, _ := b.GetQueue("q1")
+	sent := make(map[int][]broker.Message)
+	for i := 0; len(sent[0]) < 2 || len(sent[1]) < 2; i++ {
+		key := fmt.Sprintf("k%d", i)
+		msg, err := q.Send(broker.Message{Payload: json.RawMessage(`"` + key + `"`), Headers: map[string]string{broker.HeaderPartitionKey: key}})
+		if err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+		sent[msg.Partition] = append(sent[msg.Partition], msg)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/queues/q1/events", nil)
+	req.Header.Set("Last-Event-ID", "3")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// A client that saw the first message of partition 0 resumes there, and
+	// gets partition 1 from its oldest message.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req = httptest.NewRequest(http.MethodGet, "/queues/q1/events", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("0:%d", sent[0][0].Offset))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	got := make(map[string]bool)
+	var last string
+	for _, event := range strings.Split(strings.TrimSuffix(rr.Body.String(), "\n\n"), "\n\n") {
+		var msg broker.Message
+		lines := strings.Split(event, "\n")
+		if len(lines) != 2 || json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &msg) != nil {
+			t.Fatalf("unexpected event %q", event)
+		}
+		got[string(msg.Payload)] = true
+		last = strings.TrimPrefix(lines[0], "id: ")
+	}
+	want := map[string]bool{}
+	for _, msg := range append(sent[0][1:], sent[1]...) {
+		want[string(msg.Payload)] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// The last ID holds the position in every partition.
+	end0, end1 := sent[0][len(sent[0])-1], sent[1][len(sent[1])-1]
+	if id := fmt.Sprintf("0:%d,1:%d", end0.Offset, end1.Offset); last != id {
+		t.Errorf("expected last ID %s, got %s", id, last)
+	}
+}
+
+func TestHandler_GetMessages(t *testing.T) {
+	cfg := &config.Config{Queues: []config.QueueConfig{{Name: "q1", Size: 10, MaxSub: 1}}}
+	b := newBroker(t, cfg)
+	defer b.Close()
+	h := New(b)
+
+	for _, target := range []string{"/queues/q1/messages?max=0", "/queues/q1/messages?wait=2m"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", target, status, http.StatusBadRequest)
+		}
+	}
+
+	q, _ := b.GetQueue("q1")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for _, msg := range []string{`"m1"`, `"m2"`} {
+			_, _ = q.Send(broker.Message{Payload: json.RawMessage(msg)})
+		}
+	}()
+
+	get := func(target string) []broker.Message {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+
+		var msgs []broker.Message
+		if err := json.Unmarshal(rr.Body.Bytes(), &msgs); err != nil {
+			t.Fatalf("handler returned invalid body %q: %v", rr.Body.String(), err)
+		}
+		return msgs
+	}
+
+	// The first pull returns once m1 is there, maybe before m2.
+	msgs := get("/queues/q1/messages?max=10&wait=1s")
+	if len(msgs) == 1 {
+		msgs = append(msgs, get("/queues/q1/messages?wait=1s")...)
+	}
+	if len(msgs) != 2 || string(msgs[0].Payload) != `"m1"` || string(msgs[1].Payload) != `"m2"` {
+		t.Fatalf("handler returned unexpected messages: %+v", msgs)
+	}
+	if msgs := get("/queues/q1/messages?wait=50ms"); len(msgs) != 0 {
+		t.Errorf("handler returned unexpected messages: %+v", msgs)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+)
+
+// maxPull bounds the number of messages a pull takes and maxPullWait how
+// long it waits for the first one.
+const (
+	maxPull     = 100
+	maxPullWait = time.Minute
+)
+
+// getMessages takes up to ?max= messages, default one, from the queue and
+// returns them as a JSON array. If there are none it waits up to ?wait= for
+// one; an empty array means none came. ?group= pulls on behalf of a
+// consumer group.
+func (h *Handler) getMessages(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	n := 1
+	if v := query.Get("max"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxPull {
+			http.Error(w, fmt.Sprintf("invalid max %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		if wait, err = parseDuration(v); err != nil || wait < 0 || wait > maxPullWait {
+			http.Error(w, fmt.Sprintf("invalid wait %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	ds, err := q.Receive(ctx, n, broker.WithGroup(query.Get("group")))
+	if err != nil {
+		if err == broker.ErrQueueClosed {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msgs := make([]any, len(ds))
+	for i, d := range ds {
+		msgs[i] = d
+		if d.Tag == 0 {
+			msgs[i] = d.Message
+		}
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
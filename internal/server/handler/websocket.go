@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/websocket"
+)
+
+// wsPingInterval is how often the server pings a WebSocket client. A client
+// that sends nothing, not even a pong, for wsPongWait is disconnected.
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 2 * wsPingInterval
+)
+
+// wsRequest is a message from a WebSocket client. Op is "publish", "ack" or
+// "nack"; the reply carries the same Ref.
+type wsRequest struct {
+	Op      string          `json:"op"`
+	Ref     string          `json:"ref,omitempty"`
+	Message *broker.Message `json:"message,omitempty"`
+	Tags    []uint64        `json:"tags,omitempty"`
+	Requeue bool            `json:"requeue,omitempty"`
+}
+
+// wsReply answers a wsRequest. Type is "ok" or "error"; replies to publish
+// requests carry the ID and offset of the message.
+type wsReply struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"`
+	*publishResponse
+	Error string `json:"error,omitempty"`
+}
+
+// wsDelivery is a message sent to a WebSocket subscriber.
+type wsDelivery struct {
+	Type string `json:"type"`
+	broker.Delivery
+}
+
+// serveWebSocket subscribes a WebSocket client to a queue and publishes,
+// acknowledges and rejects on its behalf. The query parameters are those of
+// postSubscription; ?subscribe=false only publishes.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request, queueName string) {
+	q, err := h.broker.GetQueue(queueName)
+	if err != nil {
+		if err == broker.ErrQueueNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	opts, err := subscribeOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sub broker.Subscriber
+	if r.URL.Query().Get("subscribe") != "false" {
+		if sub, err = q.Subscribe(opts...); err != nil {
+			subscribeError(w, err)
+			return
+		}
+		defer q.Unsubscribe(sub)
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readWebSocket(conn, q)
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			_ = conn.WriteClose(websocket.CloseGoingAway, "")
+			return
+		case <-done:
+			return
+		case <-ping.C:
+			if err := conn.Ping(nil); err != nil {
+				return
+			}
+		case d, ok := <-sub:
+			if !ok {
+				_ = conn.WriteClose(websocket.CloseGoingAway, "subscription ended")
+				return
+			}
+			if err := writeWebSocket(conn, wsDelivery{Type: "message", Delivery: d}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readWebSocket handles the requests of a client until it goes away.
+func readWebSocket(conn *websocket.Conn, q *broker.Queue) {
+	extend := func() { _ = conn.SetReadDeadline(time.Now().Add(wsPongWait)) }
+	extend()
+	conn.SetPongHandler(func([]byte) { extend() })
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		extend()
+
+		var req wsRequest
+		var reply wsReply
+		if err := json.Unmarshal(data, &req); err != nil {
+			reply = wsReply{Type: "error", Error: err.Error()}
+		} else {
+			reply = handleWebSocket(q, req)
+		}
+		reply.Ref = req.Ref
+
+		if err := writeWebSocket(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// handleWebSocket carries out a request. Publishing a duplicate answers
+// with the original message, like postMessage.
+func handleWebSocket(q *broker.Queue, req wsRequest) wsReply {
+	var err error
+	switch req.Op {
+	case "publish":
+		if req.Message == nil || len(req.Message.Payload) == 0 {
+			return wsReply{Type: "error", Error: "message has no payload"}
+		}
+		var msg broker.Message
+		if msg, err = q.Send(*req.Message); err == nil || err == broker.ErrDuplicate {
+			return wsReply{Type: "ok", publishResponse: &publishResponse{ID: msg.ID, Offset: msg.Offset, Partition: msg.Partition}}
+		}
+	case "ack":
+		err = q.Ack(req.Tags...)
+	case "nack":
+		err = q.Nack(req.Requeue, req.Tags...)
+	default:
+		return wsReply{Type: "error", Error: "unknown op " + req.Op}
+	}
+
+	if err != nil {
+		return wsReply{Type: "error", Error: err.Error()}
+	}
+	return wsReply{Type: "ok"}
+}
+
+func writeWebSocket(conn *websocket.Conn, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,114 @@
+package listen
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// WriteWait bounds the time a batch of writes may take.
+const WriteWait = 10 * time.Second
+
+// outgoing is the number of writes a connection queues.
+const outgoing = 256
+
+// Conn is a connection whose writes are queued by Send and written by Run.
+// Writing to the embedded net.Conn directly is only safe before Run
+// starts, e.g. for the reply to a handshake.
+type Conn struct {
+	net.Conn
+	out chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConn(nc net.Conn) *Conn {
+	return &Conn{Conn: nc, out: make(chan []byte, outgoing), done: make(chan struct{})}
+}
+
+// Run writes what is sent as it comes, flushing once nothing else waits,
+// until the connection is closed or End is called. With every set it
+// writes ping whenever nothing else was written for that long or so. The
+// connection is closed when Run returns.
+func (c *Conn) Run(every time.Duration, ping []byte) {
+	defer c.Close()
+
+	var tick <-chan time.Time
+	if every > 0 {
+		ticker := time.NewTicker(every / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	w := bufio.NewWriterSize(c.Conn, 64<<10)
+	wrote := false
+	for {
+		var data []byte
+		select {
+		case <-c.done:
+			return
+		case <-tick:
+			if wrote {
+				wrote = false
+				continue
+			}
+			data = ping
+		case data = <-c.out:
+			if data == nil {
+				_ = c.SetWriteDeadline(time.Now().Add(WriteWait))
+				_ = w.Flush()
+				return
+			}
+			wrote = true
+		}
+
+		_ = c.SetWriteDeadline(time.Now().Add(WriteWait))
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+		if len(c.out) == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Send queues data for writing. It returns false once the connection is
+// closed.
+func (c *Conn) Send(data []byte) bool {
+	if data == nil {
+		data = []byte{}
+	}
+	return c.send(data)
+}
+
+// End has Run write what was sent before and then close the connection.
+func (c *Conn) End() {
+	c.send(nil)
+}
+
+func (c *Conn) send(data []byte) bool {
+	select {
+	case c.out <- data:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Done returns a channel that is closed once the connection is.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection, dropping what was not written yet.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.Conn.Close()
+	})
+	return nil
+}
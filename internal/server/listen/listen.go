@@ -0,0 +1,107 @@
+// Package listen runs the listeners of the protocols the broker speaks
+// over plain TCP. A Server accepts connections and closes them on
+// shutdown; a Conn queues what the protocol sends and writes it from a
+// goroutine of its own, in batches.
+package listen
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+type Server struct {
+	addr  string
+	serve func(*Conn)
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// New returns a server that calls serve for every connection it accepts on
+// addr. serve returns once it is done with the connection.
+func New(addr string, serve func(*Conn)) *Server {
+	return &Server{addr: addr, serve: serve, conns: make(map[*Conn]struct{})}
+}
+
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown is called, after which it
+// returns nil.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		c := NewConn(nc)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = nc.Close()
+			continue
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serve(c)
+			_ = c.Close()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections, closes the open ones and waits for
+// them to finish.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
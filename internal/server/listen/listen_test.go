@@ -0,0 +1,95 @@
+package listen
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// echo writes back every line it reads, and ends the connection after a
+// line "bye".
+func echo(c *Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(0, nil)
+	}()
+	defer func() { <-done }()
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		c.Send([]byte(line))
+		if line == "bye\n" {
+			c.End()
+			return
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := New("", echo)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		nc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { _ = nc.Close() })
+		_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+		return nc, bufio.NewReader(nc)
+	}
+
+	// End writes what was sent before closing.
+	nc, r := dial()
+	_, _ = nc.Write([]byte("hello\nbye\n"))
+	for _, want := range []string{"hello\n", "bye\n"} {
+		if line, err := r.ReadString('\n'); line != want {
+			t.Fatalf("expected %q, got %q and %v", want, line, err)
+		}
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+
+	nc, r = dial()
+	_, _ = nc.Write([]byte("ping\n"))
+	if line, _ := r.ReadString('\n'); line != "ping\n" {
+		t.Fatalf("expected ping, got %q", line)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected Serve to return nil, got %v", err)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestConn_Ping(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	c := NewConn(server)
+	go c.Run(20*time.Millisecond, []byte("."))
+	defer func() { _ = c.Close() }()
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1)
+	if _, err := client.Read(buf); err != nil || buf[0] != '.' {
+		t.Errorf("expected a ping, got %q and %v", buf, err)
+	}
+}
@@ -0,0 +1,41 @@
+// Package listentest starts protocol servers for tests.
+package listentest
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+)
+
+// Server is a protocol server such as the one of package tcp.
+type Server interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+// Start creates a broker with cfg and a server of it, made by newServer,
+// that listens on a local port. It returns the broker and the address.
+// Both are stopped when the test ends.
+func Start[S Server](t testing.TB, cfg *config.Config, newServer func(addr string, b *broker.Broker) S) (*broker.Broker, string) {
+	t.Helper()
+	cfg.DataDir = t.TempDir()
+	b, err := broker.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create broker: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := newServer("", b)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() {
+		_ = srv.Shutdown(context.Background())
+		b.Close()
+	})
+	return b, ln.Addr().String()
+}
@@ -0,0 +1,427 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/server/listen"
+)
+
+// connectWait bounds the time a client may take to send CONNECT.
+const connectWait = 10 * time.Second
+
+var errTooManyInflight = errors.New("too many unacknowledged messages")
+
+type conn struct {
+	*listen.Conn
+	srv *Server
+
+	// ended is closed once the connection let go of its session.
+	ended chan struct{}
+	wg    sync.WaitGroup
+
+	sess *session
+	sub  broker.Subscriber
+	will *will
+
+	// inflight maps the packet IDs of QoS 1 messages sent to the client to
+	// the delivery tags they acknowledge, 0 for retained messages.
+	mu       sync.Mutex
+	inflight map[uint16]uint64
+	nextID   uint16
+}
+
+// will is the message published when a client goes away without
+// DISCONNECT.
+type will struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+func newConn(s *Server, lc *listen.Conn) *conn {
+	return &conn{Conn: lc, srv: s, ended: make(chan struct{}), inflight: make(map[uint16]uint64)}
+}
+
+// serve handles the packets of the client until it disconnects or breaks
+// the protocol.
+func (c *conn) serve() {
+	defer close(c.ended)
+
+	r := bufio.NewReaderSize(c, 64<<10)
+	_ = c.SetReadDeadline(time.Now().Add(connectWait))
+	p, err := readPacket(r)
+	if err != nil || p.typ != packetConnect {
+		_ = c.Close()
+		return
+	}
+	keepAlive, err := c.connect(p)
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+
+	c.wg.Add(2)
+	go func() {
+		defer c.wg.Done()
+		c.Run(0, nil)
+	}()
+	go c.deliver()
+
+	graceful := false
+	defer func() {
+		c.sess.q.Unsubscribe(c.sub)
+		_ = c.Close()
+		c.wg.Wait()
+		c.requeue()
+		c.srv.detach(c)
+		if !graceful && c.will != nil {
+			_ = c.srv.publish(c.will.topic, c.will.payload, c.will.qos, c.will.retain)
+		}
+	}()
+
+	for {
+		// The client has one and a half keep-alive periods to send
+		// something.
+		var deadline time.Time
+		if keepAlive > 0 {
+			deadline = time.Now().Add(keepAlive * 3 / 2)
+		}
+		_ = c.SetReadDeadline(deadline)
+
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.typ {
+		case packetPublish:
+			err = c.handlePublish(p)
+		case packetPuback:
+			err = c.handlePuback(p)
+		case packetSubscribe:
+			err = c.handleSubscribe(p)
+		case packetUnsubscribe:
+			err = c.handleUnsubscribe(p)
+		case packetPingreq:
+			c.Send(newPacket(packetPingresp, 0).packet())
+		case packetDisconnect:
+			graceful = true
+			return
+		case packetPubrec, packetPubrel, packetPubcomp:
+			err = errUnsupported
+		default:
+			err = errMalformed
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// connect handles CONNECT, attaching the client to its session, and
+// answers with CONNACK. It returns the keep-alive period of the client.
+func (c *conn) connect(p packet) (time.Duration, error) {
+	d := &decoder{buf: p.body}
+	name := d.string()
+	level := d.uint8()
+	flags := d.uint8()
+	keepAlive := time.Duration(d.uint16()) * time.Second
+	if d.err != nil || name != "MQTT" || flags&0x01 != 0 {
+		return 0, errMalformed
+	}
+	if level != 4 {
+		return 0, c.refuse(connBadProtocolVersion)
+	}
+
+	clean := flags&0x02 != 0
+	id := d.string()
+	if flags&0x04 != 0 {
+		c.will = &will{topic: d.string(), payload: d.bytes(), qos: min(flags>>3&0x03, 1), retain: flags&0x20 != 0}
+		if d.err == nil && !validTopic(c.will.topic) {
+			return 0, errInvalidTopic
+		}
+	} else if flags&0x38 != 0 {
+		return 0, errMalformed
+	}
+	// There is no authentication; user name and password are skipped.
+	if flags&0x80 != 0 {
+		d.bytes()
+	}
+	if flags&0x40 != 0 {
+		d.bytes()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if !utf8.ValidString(id) || id == "" && !clean {
+		return 0, c.refuse(connIdentifierRejected)
+	}
+	if id == "" {
+		id = newClientID()
+	}
+
+	sess, present, err := c.srv.attach(c, id, clean)
+	if err != nil {
+		return 0, c.refuse(connServerUnavailable)
+	}
+	c.sess = sess
+	if c.sub, err = sess.q.Subscribe(); err != nil {
+		c.srv.detach(c)
+		return 0, c.refuse(connServerUnavailable)
+	}
+
+	e := newPacket(packetConnack, 0)
+	if present {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+	e.uint8(connAccepted)
+	_ = c.SetWriteDeadline(time.Now().Add(listen.WriteWait))
+	if _, err := c.Write(e.packet()); err != nil {
+		c.sess.q.Unsubscribe(c.sub)
+		c.srv.detach(c)
+		return 0, err
+	}
+	return keepAlive, nil
+}
+
+// refuse answers CONNECT with a return code other than accepted. It returns
+// an error for the connection to end with.
+func (c *conn) refuse(code byte) error {
+	e := newPacket(packetConnack, 0)
+	e.uint8(0)
+	e.uint8(code)
+	_ = c.SetWriteDeadline(time.Now().Add(listen.WriteWait))
+	_, _ = c.Write(e.packet())
+	return errors.New("connection refused")
+}
+
+func (c *conn) handlePublish(p packet) error {
+	qos := p.flags & flagQoS >> 1
+	if qos > 1 {
+		return errUnsupported
+	}
+
+	d := &decoder{buf: p.body}
+	topic := d.string()
+	var id uint16
+	if qos == 1 {
+		id = d.uint16()
+	}
+	payload := d.rest()
+	if d.err != nil {
+		return d.err
+	}
+	if !validTopic(topic) {
+		return errInvalidTopic
+	}
+
+	// MQTT 3.1.1 has no negative PUBACK. A QoS 1 message that did not
+	// reach every queue closes the connection instead, and the client
+	// sends it again.
+	if err := c.srv.publish(topic, payload, qos, p.flags&flagRetain != 0); err != nil {
+		return err
+	}
+	if qos == 1 {
+		e := newPacket(packetPuback, 0)
+		e.uint16(id)
+		c.Send(e.packet())
+	}
+	return nil
+}
+
+func (c *conn) handlePuback(p packet) error {
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+
+	c.mu.Lock()
+	tag, ok := c.inflight[id]
+	delete(c.inflight, id)
+	c.mu.Unlock()
+	if ok && tag != 0 {
+		_ = c.sess.q.Ack(tag)
+	}
+	return nil
+}
+
+// handleSubscribe binds the session queue for every topic filter and
+// grants QoS 1 at most. The retained messages of the new subscriptions
+// follow the SUBACK.
+func (c *conn) handleSubscribe(p packet) error {
+	if p.flags != 0x02 {
+		return errMalformed
+	}
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+
+	var codes []byte
+	var granted []string
+	for d.err == nil && len(d.buf) > 0 {
+		filter := d.string()
+		qos := d.uint8()
+		if d.err != nil {
+			break
+		}
+		if qos > 2 {
+			return errMalformed
+		}
+		qos = min(qos, 1)
+
+		bc := config.BindingConfig{Queue: c.sess.queue, Pattern: pattern(filter)}
+		if !validFilter(filter) || c.srv.broker.Bind(Exchange, bc) != nil {
+			codes = append(codes, subackFailure)
+			continue
+		}
+		c.sess.subscribe(filter, qos)
+		codes = append(codes, qos)
+		granted = append(granted, filter)
+	}
+	if d.err != nil || len(codes) == 0 {
+		return errMalformed
+	}
+
+	e := newPacket(packetSuback, 0)
+	e.uint16(id)
+	e.raw(codes)
+	c.Send(e.packet())
+
+	for _, filter := range granted {
+		for _, r := range c.srv.retainedFor(filter) {
+			qos, _ := c.sess.granted(r.topic)
+			if !c.publish(r.topic, r.payload, min(qos, r.qos), true, false, 0) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (c *conn) handleUnsubscribe(p packet) error {
+	if p.flags != 0x02 {
+		return errMalformed
+	}
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+
+	n := 0
+	for d.err == nil && len(d.buf) > 0 {
+		filter := d.string()
+		if d.err != nil {
+			break
+		}
+		_ = c.srv.broker.Unbind(Exchange, config.BindingConfig{Queue: c.sess.queue, Pattern: pattern(filter)})
+		c.sess.unsubscribe(filter)
+		n++
+	}
+	if d.err != nil || n == 0 {
+		return errMalformed
+	}
+
+	e := newPacket(packetUnsuback, 0)
+	e.uint16(id)
+	c.Send(e.packet())
+	return nil
+}
+
+// deliver forwards the deliveries of the session queue with the QoS of the
+// subscriptions they match. If the queue goes away, so does the
+// connection.
+func (c *conn) deliver() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case d, ok := <-c.sub:
+			if !ok {
+				_ = c.Close()
+				return
+			}
+			topic := topicOf(d.Message.Headers[broker.HeaderRoutingKey])
+			qos, ok := c.sess.granted(topic)
+			if !ok {
+				// The client unsubscribed since.
+				_ = c.sess.q.Ack(d.Tag)
+				continue
+			}
+			qos = min(qos, messageQoS(d.Message))
+			if !c.publish(topic, payloadOf(d.Message), qos, false, d.Redelivered, d.Tag) {
+				return
+			}
+		}
+	}
+}
+
+// publish sends a PUBLISH packet. A QoS 1 message acknowledges the delivery
+// with the given tag once the client acknowledges it, a QoS 0 message right
+// away.
+func (c *conn) publish(topic string, payload []byte, qos byte, retain, dup bool, tag uint64) bool {
+	flags := qos << 1
+	if retain {
+		flags |= flagRetain
+	}
+	if dup && qos > 0 {
+		flags |= flagDup
+	}
+
+	e := newPacket(packetPublish, flags)
+	e.string(topic)
+	if qos > 0 {
+		id, err := c.track(tag)
+		if err != nil {
+			_ = c.Close()
+			return false
+		}
+		e.uint16(id)
+	}
+	e.raw(payload)
+	if !c.Send(e.packet()) {
+		return false
+	}
+
+	if qos == 0 && tag != 0 {
+		_ = c.sess.q.Ack(tag)
+	}
+	return true
+}
+
+// track assigns a packet ID to a QoS 1 message.
+func (c *conn) track(tag uint64) (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 0; i < 1<<16; i++ {
+		c.nextID++
+		if _, used := c.inflight[c.nextID]; c.nextID != 0 && !used {
+			c.inflight[c.nextID] = tag
+			return c.nextID, nil
+		}
+	}
+	return 0, errTooManyInflight
+}
+
+// requeue hands the messages the client did not acknowledge back to the
+// session queue, so that they are sent again once it reconnects.
+func (c *conn) requeue() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, tag := range c.inflight {
+		if tag != 0 {
+			_ = c.sess.q.Nack(true, tag)
+		}
+		delete(c.inflight, id)
+	}
+}
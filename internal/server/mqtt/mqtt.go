@@ -0,0 +1,319 @@
+// Package mqtt serves the broker over MQTT 3.1.1 with QoS 0 and 1.
+//
+// Topics are routing keys of the Exchange topic exchange, their levels the
+// words: a message published to "sensors/kitchen" goes to every queue
+// bound to the exchange with a pattern that matches "sensors.kitchen".
+// Every client has a session queue, and its subscriptions are the bindings
+// of that queue, "+" and "#" becoming "*" and "#". Other queues can be
+// bound to MQTT topics the same way, and messages routed through the
+// exchange by other clients reach MQTT subscribers.
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/server/listen"
+)
+
+// Exchange is the topic exchange MQTT topics are routed through. The
+// server creates it unless the configuration does.
+const Exchange = "mqtt"
+
+// Session queues are named after the client ID and hold up to
+// sessionQueueSize messages for it; further messages are dropped for the
+// client until it catches up.
+const (
+	sessionQueuePrefix = "mqtt."
+	sessionQueueSize   = 1000
+)
+
+// Message headers. headerQoS holds the QoS a message was published with,
+// headerEncoding marks payloads that are not JSON, which are kept as a
+// base64 JSON string.
+const (
+	headerQoS      = "qos"
+	headerEncoding = "content-encoding"
+)
+
+type Server struct {
+	*listen.Server
+	broker *broker.Broker
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	retained map[string]retained
+}
+
+// session is the state of a client that outlives its connections if it
+// connects with clean session unset.
+type session struct {
+	id    string
+	queue string
+	q     *broker.Queue
+	clean bool
+	conn  *conn
+
+	mu      sync.Mutex
+	filters map[string]byte
+}
+
+// retained is the last message published with the retain flag on a topic.
+type retained struct {
+	topic   string
+	payload []byte
+	qos     byte
+}
+
+func New(addr string, b *broker.Broker) *Server {
+	s := &Server{
+		broker:   b,
+		sessions: make(map[string]*session),
+		retained: make(map[string]retained),
+	}
+	s.Server = listen.New(addr, func(lc *listen.Conn) { newConn(s, lc).serve() })
+	return s
+}
+
+func (s *Server) Start() error {
+	if err := s.declare(); err != nil {
+		return err
+	}
+	return s.Server.Start()
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+	if err := s.declare(); err != nil {
+		_ = ln.Close()
+		return err
+	}
+	return s.Server.Serve(ln)
+}
+
+// declare creates the Exchange, which Start and Serve do before they accept
+// connections.
+func (s *Server) declare() error {
+	if _, err := s.broker.CreateExchange(config.ExchangeConfig{Name: Exchange}); err != nil && err != broker.ErrExchangeExists {
+		return err
+	}
+	return nil
+}
+
+// attach gives c the session of a client ID and reports whether the
+// session was there before. A client that connects again takes over from
+// its old connection. Sessions of clients that connected with clean
+// session set, now or before, start over.
+func (s *Server) attach(c *conn, id string, clean bool) (*session, bool, error) {
+	s.mu.Lock()
+	var prev *conn
+	if sess := s.sessions[id]; sess != nil {
+		prev, sess.conn = sess.conn, c
+	}
+	s.mu.Unlock()
+	if prev != nil {
+		_ = prev.Close()
+		<-prev.ended
+	}
+
+	s.mu.Lock()
+	sess := s.sessions[id]
+	var stale *session
+	if sess != nil && (clean || sess.clean) {
+		stale, sess = sess, nil
+	}
+	if sess != nil {
+		// The queue may have been deleted in the meantime.
+		if q, err := s.broker.GetQueue(sess.queue); err != nil || q != sess.q {
+			stale, sess = sess, nil
+		}
+	}
+	present := sess != nil
+	if sess == nil {
+		sess = &session{id: id, queue: sessionQueuePrefix + url.PathEscape(id), filters: make(map[string]byte)}
+		s.sessions[id] = sess
+	}
+	sess.conn = c
+	sess.clean = clean
+	s.mu.Unlock()
+
+	if stale != nil {
+		_ = s.broker.DeleteQueue(stale.queue)
+	}
+	if !present {
+		q, err := s.broker.CreateQueue(config.QueueConfig{Name: sess.queue, Size: sessionQueueSize, MaxSub: 1, RequireAck: true})
+		if err != nil {
+			s.mu.Lock()
+			delete(s.sessions, id)
+			s.mu.Unlock()
+			return nil, false, err
+		}
+		sess.q = q
+	}
+	return sess, present, nil
+}
+
+// detach ends the connection of c to its session. The session of a client
+// with clean session set goes away with its queue.
+func (s *Server) detach(c *conn) {
+	sess := c.sess
+	s.mu.Lock()
+	own := sess.conn == c
+	if own {
+		sess.conn = nil
+		if sess.clean {
+			delete(s.sessions, sess.id)
+		}
+	}
+	s.mu.Unlock()
+
+	if own && sess.clean {
+		_ = s.broker.DeleteQueue(sess.queue)
+	}
+}
+
+// publish sends a message to every queue bound to its topic. A QoS 0
+// message is dropped for queues that are full or went away meanwhile. A
+// QoS 1 message goes to all of them or, if one is full, to none, and
+// publish returns ErrQueueFull, so that the client is not told the message
+// was accepted and can send it again without duplicating it. With retain
+// set the message replaces the retained message of the topic, or removes
+// it if the payload is empty.
+func (s *Server) publish(topic string, payload []byte, qos byte, retain bool) error {
+	if retain {
+		s.mu.Lock()
+		if len(payload) == 0 {
+			delete(s.retained, topic)
+		} else {
+			s.retained[topic] = retained{topic: topic, payload: payload, qos: qos}
+		}
+		s.mu.Unlock()
+	}
+
+	key := routingKey(topic)
+	msg := toMessage(key, payload, qos)
+	if qos > 0 {
+		return s.route(key, msg)
+	}
+
+	names, err := s.broker.Bound(Exchange, key)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		q, err := s.broker.GetQueue(name)
+		if err != nil {
+			continue
+		}
+		if _, err := q.Send(msg); err != nil && err != broker.ErrQueueFull && err != broker.ErrQueueClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// route sends msg to all queues bound to key or to none. A queue deleted
+// meanwhile loses its bindings, so routing is tried again without it.
+func (s *Server) route(key string, msg broker.Message) error {
+	for attempt := 1; ; attempt++ {
+		_, err := s.broker.Route(Exchange, key, msg)
+		switch {
+		case err == nil, err == broker.ErrUnroutable:
+			return nil
+		case (err == broker.ErrQueueNotFound || err == broker.ErrQueueClosed) && attempt < 3:
+		default:
+			return err
+		}
+	}
+}
+
+// retainedFor returns the retained messages whose topics match filter.
+func (s *Server) retainedFor(filter string) []retained {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []retained
+	for topic, r := range s.retained {
+		if matches(filter, topic) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func (sess *session) subscribe(filter string, qos byte) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.filters[filter] = qos
+}
+
+func (sess *session) unsubscribe(filter string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	delete(sess.filters, filter)
+}
+
+// granted returns the highest QoS of the subscriptions that match topic,
+// and false if none does.
+func (sess *session) granted(topic string) (byte, bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	var qos byte
+	found := false
+	for filter, q := range sess.filters {
+		if matches(filter, topic) {
+			qos = max(qos, q)
+			found = true
+		}
+	}
+	return qos, found
+}
+
+func toMessage(key string, payload []byte, qos byte) broker.Message {
+	msg := broker.Message{Headers: map[string]string{
+		broker.HeaderRoutingKey: key,
+		headerQoS:               string('0' + qos),
+	}}
+	if json.Valid(payload) {
+		msg.Payload = payload
+	} else {
+		msg.Payload, _ = json.Marshal(base64.StdEncoding.EncodeToString(payload))
+		msg.Headers[headerEncoding] = "base64"
+	}
+	return msg
+}
+
+// payloadOf returns the payload of msg as it was published.
+func payloadOf(msg broker.Message) []byte {
+	if msg.Headers[headerEncoding] == "base64" {
+		var s string
+		if err := json.Unmarshal(msg.Payload, &s); err == nil {
+			if payload, err := base64.StdEncoding.DecodeString(s); err == nil {
+				return payload
+			}
+		}
+	}
+	return msg.Payload
+}
+
+// messageQoS is the QoS msg was published with. Messages from other
+// clients count as QoS 1.
+func messageQoS(msg broker.Message) byte {
+	if msg.Headers[headerQoS] == "0" {
+		return 0
+	}
+	return 1
+}
+
+func newClientID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "auto-" + hex.EncodeToString(b)
+}
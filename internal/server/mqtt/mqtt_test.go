@@ -0,0 +1,339 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/server/listen/listentest"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// connectFlags are the CONNECT flags of a client; a will goes with
+// willTopic.
+type connectFlags struct {
+	clean     bool
+	willTopic string
+	willQoS   byte
+}
+
+// connect dials, sends CONNECT and returns the CONNACK.
+func connect(t *testing.T, addr, id string, flags connectFlags) (*client, packet) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	var f byte
+	if flags.clean {
+		f |= 0x02
+	}
+	if flags.willTopic != "" {
+		f |= 0x04 | flags.willQoS<<3
+	}
+	e := newPacket(packetConnect, 0)
+	e.string("MQTT")
+	e.uint8(4)
+	e.uint8(f)
+	e.uint16(60)
+	e.string(id)
+	if flags.willTopic != "" {
+		e.string(flags.willTopic)
+		e.string("gone")
+	}
+	c.write(e)
+	return c, c.read(packetConnack)
+}
+
+func (c *client) write(e *encoder) {
+	c.t.Helper()
+	if _, err := c.conn.Write(e.packet()); err != nil {
+		c.t.Fatalf("failed to write: %v", err)
+	}
+}
+
+// read reads the next packet and checks its type.
+func (c *client) read(typ byte) packet {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := readPacket(c.r)
+	if err != nil {
+		c.t.Fatalf("failed to read: %v", err)
+	}
+	if p.typ != typ {
+		c.t.Fatalf("expected packet type %d, got %d", typ, p.typ)
+	}
+	return p
+}
+
+func (c *client) publish(topic, payload string, qos byte, retain bool) {
+	c.t.Helper()
+	flags := qos << 1
+	if retain {
+		flags |= flagRetain
+	}
+	e := newPacket(packetPublish, flags)
+	e.string(topic)
+	if qos > 0 {
+		e.uint16(1)
+	}
+	e.raw([]byte(payload))
+	c.write(e)
+	if qos > 0 {
+		c.read(packetPuback)
+	}
+}
+
+// subscribe subscribes to filter and returns the granted QoS.
+func (c *client) subscribe(filter string, qos byte) byte {
+	c.t.Helper()
+	e := newPacket(packetSubscribe, 0x02)
+	e.uint16(7)
+	e.string(filter)
+	e.uint8(qos)
+	c.write(e)
+	d := &decoder{buf: c.read(packetSuback).body}
+	if id := d.uint16(); id != 7 {
+		c.t.Fatalf("expected SUBACK for packet 7, got %d", id)
+	}
+	return d.uint8()
+}
+
+type message struct {
+	topic   string
+	payload string
+	flags   byte
+	id      uint16
+}
+
+func (c *client) receive() message {
+	c.t.Helper()
+	p := c.read(packetPublish)
+	d := &decoder{buf: p.body}
+	m := message{topic: d.string(), flags: p.flags}
+	if p.flags&flagQoS != 0 {
+		m.id = d.uint16()
+	}
+	m.payload = string(d.rest())
+	return m
+}
+
+func (c *client) puback(id uint16) {
+	e := newPacket(packetPuback, 0)
+	e.uint16(id)
+	c.write(e)
+}
+
+func (c *client) disconnect() {
+	c.write(newPacket(packetDisconnect, 0))
+	_ = c.conn.Close()
+}
+
+func TestServer_PublishSubscribe(t *testing.T) {
+	_, addr := listentest.Start(t, &config.Config{}, New)
+	sub, _ := connect(t, addr, "sub", connectFlags{clean: true})
+	pub, _ := connect(t, addr, "pub", connectFlags{clean: true})
+
+	if qos := sub.subscribe("sensors/+/temp", 1); qos != 1 {
+		t.Errorf("expected QoS 1 granted, got %d", qos)
+	}
+	if qos := sub.subscribe("alerts/#", 2); qos != 1 {
+		t.Errorf("expected QoS 2 downgraded to 1, got %d", qos)
+	}
+	if qos := sub.subscribe("bad/#/filter", 0); qos != subackFailure {
+		t.Errorf("expected an invalid filter to fail, got %#x", qos)
+	}
+
+	pub.publish("sensors/kitchen/temp", "21.5", 1, false)
+	pub.publish("sensors/kitchen/humidity", "40", 1, false)
+	pub.publish("alerts/fire/kitchen", "not json", 0, false)
+
+	m := sub.receive()
+	if m.topic != "sensors/kitchen/temp" || m.payload != "21.5" || m.flags&flagQoS != 2 || m.id == 0 {
+		t.Errorf("unexpected message %+v", m)
+	}
+	sub.puback(m.id)
+
+	// The QoS of a message is the lower of the published and granted one.
+	m = sub.receive()
+	if m.topic != "alerts/fire/kitchen" || m.payload != "not json" || m.flags&flagQoS != 0 {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestServer_Retained(t *testing.T) {
+	_, addr := listentest.Start(t, &config.Config{}, New)
+	pub, _ := connect(t, addr, "pub", connectFlags{clean: true})
+	pub.publish("status/door", `"open"`, 1, true)
+	pub.publish("status/window", `"closed"`, 1, true)
+	pub.publish("status/window", "", 1, true)
+
+	sub, _ := connect(t, addr, "sub", connectFlags{clean: true})
+	sub.subscribe("status/+", 0)
+	m := sub.receive()
+	if m.topic != "status/door" || m.payload != `"open"` || m.flags&flagRetain == 0 || m.flags&flagQoS != 0 {
+		t.Errorf("unexpected retained message %+v", m)
+	}
+
+	// Messages that match an established subscription are not marked retained.
+	pub.publish("status/door", `"closed"`, 0, true)
+	if m := sub.receive(); m.payload != `"closed"` || m.flags&flagRetain != 0 {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestServer_Will(t *testing.T) {
+	_, addr := listentest.Start(t, &config.Config{}, New)
+	sub, _ := connect(t, addr, "sub", connectFlags{clean: true})
+	sub.subscribe("clients/#", 1)
+
+	graceful, _ := connect(t, addr, "graceful", connectFlags{clean: true, willTopic: "clients/graceful"})
+	graceful.disconnect()
+	dropped, _ := connect(t, addr, "dropped", connectFlags{clean: true, willTopic: "clients/dropped", willQoS: 1})
+	_ = dropped.conn.Close()
+
+	if m := sub.receive(); m.topic != "clients/dropped" || m.payload != "gone" {
+		t.Errorf("expected the will of the dropped client only, got %+v", m)
+	}
+}
+
+func TestServer_Session(t *testing.T) {
+	b, addr := listentest.Start(t, &config.Config{}, New)
+	c, ack := connect(t, addr, "device", connectFlags{})
+	if ack.body[0] != 0 || ack.body[1] != connAccepted {
+		t.Fatalf("unexpected CONNACK %v", ack.body)
+	}
+	c.subscribe("cmd/device", 1)
+	c.disconnect()
+
+	pub, _ := connect(t, addr, "pub", connectFlags{clean: true})
+	pub.publish("cmd/device", `{"reboot":true}`, 1, false)
+
+	// The session keeps the subscription and the message while offline.
+	c, ack = connect(t, addr, "device", connectFlags{})
+	if ack.body[0] != 1 {
+		t.Errorf("expected session present, got %v", ack.body)
+	}
+	m := c.receive()
+	if m.topic != "cmd/device" || m.payload != `{"reboot":true}` {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	// Unacknowledged messages are sent again, marked as duplicates.
+	_ = c.conn.Close()
+	c, _ = connect(t, addr, "device", connectFlags{})
+	if m := c.receive(); m.payload != `{"reboot":true}` || m.flags&flagDup == 0 {
+		t.Fatalf("expected a duplicate, got %+v", m)
+	}
+
+	// A clean session starts over and leaves nothing behind.
+	c, ack = connect(t, addr, "device", connectFlags{clean: true})
+	if ack.body[0] != 0 {
+		t.Errorf("expected no session present, got %v", ack.body)
+	}
+	c.disconnect()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := b.GetQueue(sessionQueuePrefix + "device"); err != broker.ErrQueueNotFound {
+		t.Errorf("expected the session queue to be deleted, got %v", err)
+	}
+}
+
+func TestServer_Bindings(t *testing.T) {
+	b, addr := listentest.Start(t, &config.Config{
+		Queues: []config.QueueConfig{
+			{Name: "orders", Size: 10, MaxSub: 1},
+			{Name: "all", Size: 10, MaxSub: 1},
+			{Name: "audit", Size: 1, MaxSub: 1},
+		},
+		Exchanges: []config.ExchangeConfig{{Name: Exchange, Bindings: []config.BindingConfig{
+			{Queue: "all", Pattern: "#"},
+			{Queue: "audit", Pattern: "orders.*"},
+		}}},
+	}, New)
+	orders, _ := b.GetQueue("orders")
+	all, _ := b.GetQueue("all")
+	audit, _ := b.GetQueue("audit")
+	c, _ := connect(t, addr, "pub", connectFlags{clean: true})
+
+	// Topics reach queues through bindings only, not by their name.
+	c.publish("orders/eu", `{"id":1}`, 1, false)
+	if info := orders.Info(); info.Messages != 0 {
+		t.Errorf("orders: expected no messages, got %d", info.Messages)
+	}
+	if info := audit.Info(); info.Messages != 1 {
+		t.Errorf("audit: expected 1 message, got %d", info.Messages)
+	}
+
+	// A QoS 0 message is dropped for a full queue.
+	c.publish("orders/us", `{"id":2}`, 0, false)
+	c.write(newPacket(packetPingreq, 0))
+	c.read(packetPingresp)
+
+	// A QoS 1 message is not acknowledged, and the connection is closed.
+	// The other queues do not get it either, so that it is not duplicated
+	// when the client sends it again.
+	e := newPacket(packetPublish, 1<<1)
+	e.string("orders/us")
+	e.uint16(2)
+	e.raw([]byte(`{"id":3}`))
+	c.write(e)
+	if p, err := readPacket(c.r); err == nil {
+		t.Errorf("expected the connection to be closed, got packet type %d", p.typ)
+	}
+	if info := all.Info(); info.Messages != 2 {
+		t.Errorf("all: expected 2 messages, got %d", info.Messages)
+	}
+}
+
+func TestServer_Connect(t *testing.T) {
+	_, addr := listentest.Start(t, &config.Config{}, New)
+
+	if _, ack := connect(t, addr, "", connectFlags{}); ack.body[1] != connIdentifierRejected {
+		t.Errorf("expected an empty client ID without clean session to be rejected, got %v", ack.body)
+	}
+	if _, ack := connect(t, addr, "", connectFlags{clean: true}); ack.body[1] != connAccepted {
+		t.Errorf("expected an empty client ID with clean session to be accepted, got %v", ack.body)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	for _, topic := range []string{"a/b", "a.b/*/#", "/a//", "100%"} {
+		if got := topicOf(routingKey(topic)); got != topic {
+			t.Errorf("expected %q to map back, got %q", topic, got)
+		}
+	}
+	if key := routingKey("a.b/c"); key != "a%2Eb.c" {
+		t.Errorf("unexpected routing key %q", key)
+	}
+	if p := pattern("a/+/#"); p != "a.*.#" {
+		t.Errorf("unexpected pattern %q", p)
+	}
+
+	for _, tc := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/+/c", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"+/+", "/a", true},
+	} {
+		if got := matches(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Packet types.
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// Publish flags.
+const (
+	flagRetain = 0x01
+	flagQoS    = 0x06
+	flagDup    = 0x08
+)
+
+// CONNACK return codes.
+const (
+	connAccepted           = 0
+	connBadProtocolVersion = 1
+	connIdentifierRejected = 2
+	connServerUnavailable  = 3
+)
+
+// subackFailure is the SUBACK return code of a rejected topic filter.
+const subackFailure = 0x80
+
+// maxPacketSize bounds the remaining length of a packet a client may send.
+const maxPacketSize = 16 << 20
+
+var (
+	errPacketSize   = errors.New("invalid packet size")
+	errShortPacket  = errors.New("packet too short")
+	errMalformed    = errors.New("malformed packet")
+	errUnsupported  = errors.New("QoS 2 is not supported")
+	errInvalidTopic = errors.New("invalid topic")
+)
+
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	// The remaining length takes up to four bytes of seven bits each.
+	n, shift := 0, 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, errPacketSize
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, eof(err)
+		}
+		n |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if n > maxPacketSize {
+		return packet{}, errPacketSize
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, eof(err)
+	}
+	return packet{typ: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+// eof turns the end of the stream within a packet into an error.
+func eof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// encoder builds a packet.
+type encoder struct {
+	first byte
+	body  []byte
+}
+
+func newPacket(typ, flags byte) *encoder {
+	return &encoder{first: typ<<4 | flags}
+}
+
+func (e *encoder) uint8(v byte)    { e.body = append(e.body, v) }
+func (e *encoder) uint16(v uint16) { e.body = binary.BigEndian.AppendUint16(e.body, v) }
+func (e *encoder) raw(b []byte)    { e.body = append(e.body, b...) }
+
+func (e *encoder) string(s string) {
+	e.uint16(uint16(len(s)))
+	e.body = append(e.body, s...)
+}
+
+// packet finishes the packet and returns it.
+func (e *encoder) packet() []byte {
+	data := make([]byte, 0, len(e.body)+5)
+	data = append(data, e.first)
+	for n := len(e.body); ; {
+		b := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			b |= 0x80
+		}
+		data = append(data, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(data, e.body...)
+}
+
+// decoder reads the body of a packet. Once the body runs out every read
+// returns a zero value and err is set.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = errShortPacket
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint8() byte {
+	if b := d.next(1); d.err == nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); d.err == nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte { return d.next(int(d.uint16())) }
+
+func (d *decoder) string() string { return string(d.bytes()) }
+
+// rest returns what is left of the body.
+func (d *decoder) rest() []byte {
+	b := d.buf
+	d.buf = nil
+	return b
+}
@@ -0,0 +1,98 @@
+package mqtt
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Topic levels become the words of routing keys. The characters that mean
+// something in routing keys are percent-encoded, and empty levels, which
+// routing keys cannot have, become a lone "%".
+var (
+	levelEscaper   = strings.NewReplacer("%", "%25", ".", "%2E", "*", "%2A", "#", "%23")
+	levelUnescaper = strings.NewReplacer("%25", "%", "%2E", ".", "%2A", "*", "%23", "#")
+)
+
+func escapeLevel(level string) string {
+	if level == "" {
+		return "%"
+	}
+	return levelEscaper.Replace(level)
+}
+
+// routingKey returns the routing key of a topic, e.g. "sensors.kitchen"
+// for "sensors/kitchen".
+func routingKey(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		levels[i] = escapeLevel(level)
+	}
+	return strings.Join(levels, ".")
+}
+
+// topicOf is the inverse of routingKey.
+func topicOf(key string) string {
+	words := strings.Split(key, ".")
+	for i, word := range words {
+		if word == "%" {
+			words[i] = ""
+		} else {
+			words[i] = levelUnescaper.Replace(word)
+		}
+	}
+	return strings.Join(words, "/")
+}
+
+// pattern returns the binding pattern of a topic filter: "+" becomes "*",
+// which matches one word, and "#" stays, matching any number of them.
+func pattern(filter string) string {
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		case "#":
+		default:
+			levels[i] = escapeLevel(level)
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// matches reports whether a topic filter matches a topic. Wildcards at the
+// first level do not match topics starting with "$".
+func matches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i == len(t) || level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func validTopic(topic string) bool {
+	return topic != "" && utf8.ValidString(topic) && !strings.ContainsAny(topic, "+#\x00")
+}
+
+func validFilter(filter string) bool {
+	if filter == "" || !utf8.ValidString(filter) || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && level != "+" && level != "#" {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
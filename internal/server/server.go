@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"net"
 	"net/http"
 
 	"github.com/IgorLem99/simple_broker/internal/broker"
@@ -8,17 +10,36 @@ import (
 )
 
 type Server struct {
-	addr    string
-	handler *handler.Handler
+	addr   string
+	srv    *http.Server
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func New(addr string, b *broker.Broker) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		addr:    addr,
-		handler: handler.New(b),
+		addr: addr,
+		srv: &http.Server{
+			Addr:        addr,
+			Handler:     handler.New(b),
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		},
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
 func (s *Server) Start() error {
-	return http.ListenAndServe(s.addr, s.handler)
+	if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and ends open subscription streams,
+// then waits for in-flight requests to finish.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	return s.srv.Shutdown(ctx)
 }
@@ -0,0 +1,204 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxFrameSize bounds the body of a frame, maxHeaders the number of its
+// headers.
+const (
+	maxFrameSize = 16 << 20
+	maxHeaders   = 128
+)
+
+var (
+	errFrameSize      = errors.New("frame too large")
+	errTooManyHeaders = errors.New("too many headers")
+	errLineTooLong    = errors.New("header line too long")
+)
+
+type frame struct {
+	command string
+	header  map[string]string
+	body    []byte
+}
+
+func newFrame(command string, header ...string) frame {
+	f := frame{command: command, header: make(map[string]string, len(header)/2)}
+	for i := 0; i+1 < len(header); i += 2 {
+		f.header[header[i]] = header[i+1]
+	}
+	return f
+}
+
+// escaped reports whether the header values of f are escaped. CONNECT and
+// CONNECTED frames predate escaping.
+func (f frame) escaped() bool {
+	return f.command != "CONNECT" && f.command != "CONNECTED"
+}
+
+// readFrame reads the next frame. A heart-beat, a bare end of line between
+// frames, is returned as a frame without a command.
+func readFrame(r *bufio.Reader) (frame, error) {
+	line, err := readLine(r)
+	if err != nil || line == "" {
+		return frame{}, err
+	}
+
+	f := frame{command: line, header: make(map[string]string)}
+	for n := 0; ; n++ {
+		line, err := readLine(r)
+		if err != nil {
+			return frame{}, eof(err)
+		}
+		if line == "" {
+			break
+		}
+		if n == maxHeaders {
+			return frame{}, errTooManyHeaders
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return frame{}, fmt.Errorf("invalid header %q", line)
+		}
+		if f.escaped() {
+			if name, err = unescape(name); err != nil {
+				return frame{}, err
+			}
+			if value, err = unescape(value); err != nil {
+				return frame{}, err
+			}
+		}
+		// The first of repeated headers counts.
+		if _, ok := f.header[name]; !ok {
+			f.header[name] = value
+		}
+	}
+
+	if v, ok := f.header["content-length"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return frame{}, fmt.Errorf("invalid content-length %q", v)
+		}
+		if n > maxFrameSize {
+			return frame{}, errFrameSize
+		}
+		f.body = make([]byte, n+1)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return frame{}, eof(err)
+		}
+		if f.body[n] != 0 {
+			return frame{}, errors.New("frame does not end with NUL")
+		}
+		f.body = f.body[:n]
+		return f, nil
+	}
+
+	for {
+		chunk, err := r.ReadSlice(0)
+		f.body = append(f.body, chunk...)
+		if len(f.body) > maxFrameSize+1 {
+			return frame{}, errFrameSize
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return frame{}, eof(err)
+		}
+	}
+	f.body = f.body[:len(f.body)-1]
+	return f, nil
+}
+
+// readLine reads a line without its end of line, which is "\n" or "\r\n".
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return string(line), nil
+}
+
+// eof turns the end of the stream within a frame into an error.
+func eof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// encode returns f on the wire. Frames with a body get a content-length.
+func (f frame) encode() []byte {
+	var b bytes.Buffer
+	b.WriteString(f.command)
+	b.WriteByte('\n')
+
+	if len(f.body) > 0 {
+		f.header["content-length"] = strconv.Itoa(len(f.body))
+	}
+	names := make([]string, 0, len(f.header))
+	for name := range f.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := f.header[name]
+		if f.escaped() {
+			name, value = escaper.Replace(name), escaper.Replace(value)
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+
+	b.WriteByte('\n')
+	b.Write(f.body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		default:
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+	}
+	return b.String(), nil
+}
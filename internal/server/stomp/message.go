@@ -0,0 +1,129 @@
+package stomp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+)
+
+// queuePrefix may precede queue names in destinations.
+const queuePrefix = "/queue/"
+
+// reserved are the headers of SEND and MESSAGE frames that are not copied
+// between frames and message headers.
+var reserved = map[string]bool{
+	"destination":    true,
+	"content-length": true,
+	"content-type":   true,
+	"receipt":        true,
+	"transaction":    true,
+	"subscription":   true,
+	"message-id":     true,
+	"ack":            true,
+	"redelivered":    true,
+}
+
+// queueName returns the queue a destination names.
+func queueName(destination string) (string, error) {
+	name := strings.TrimPrefix(destination, queuePrefix)
+	if name == "" {
+		return "", errors.New("missing destination")
+	}
+	return name, nil
+}
+
+// toMessage turns a SEND frame into a message. A JSON body, or a body of
+// any type without a content-type that is valid JSON, becomes the payload.
+// Text bodies become a JSON string and keep their content-type in the
+// message headers.
+func toMessage(f frame) (broker.Message, error) {
+	msg := broker.Message{Headers: make(map[string]string)}
+	for name, value := range f.header {
+		if !reserved[name] {
+			msg.Headers[name] = value
+		}
+	}
+
+	contentType := f.header["content-type"]
+	switch {
+	case isJSON(contentType) || contentType == "" && json.Valid(f.body):
+		if !json.Valid(f.body) {
+			return broker.Message{}, errors.New("body is not valid JSON")
+		}
+		msg.Payload = f.body
+	case contentType == "" || strings.HasPrefix(contentType, "text/"):
+		if !utf8.Valid(f.body) {
+			return broker.Message{}, errors.New("text body is not valid UTF-8")
+		}
+		if contentType == "" {
+			contentType = "text/plain"
+		}
+		msg.Payload, _ = json.Marshal(string(f.body))
+		msg.Headers["content-type"] = contentType
+	default:
+		return broker.Message{}, fmt.Errorf("unsupported content-type %q", contentType)
+	}
+
+	if len(msg.Headers) == 0 {
+		msg.Headers = nil
+	}
+	return msg, nil
+}
+
+// messageFrame turns a delivery to s into a MESSAGE frame. Messages sent as
+// text get their text back; all others have a JSON body.
+func messageFrame(s *subscription, d broker.Delivery) frame {
+	f := newFrame("MESSAGE",
+		"destination", s.destination,
+		"subscription", s.id,
+		"message-id", d.Message.ID,
+		"content-type", "application/json",
+	)
+	for name, value := range d.Message.Headers {
+		if !reserved[name] {
+			f.header[name] = value
+		}
+	}
+	if !s.auto {
+		f.header["ack"] = ackID(d.Tag, s.queue)
+	}
+	if d.Redelivered {
+		f.header["redelivered"] = "true"
+	}
+
+	f.body = d.Message.Payload
+	if contentType := d.Message.Headers["content-type"]; contentType != "" && !isJSON(contentType) {
+		var text string
+		if err := json.Unmarshal(d.Message.Payload, &text); err == nil {
+			f.header["content-type"] = contentType
+			f.body = []byte(text)
+		}
+	}
+	return f
+}
+
+// ackID identifies a delivery in ACK and NACK frames. Deliveries on queues
+// without acknowledgements have tag 0.
+func ackID(tag uint64, queue string) string {
+	return strconv.FormatUint(tag, 10) + ":" + queue
+}
+
+func parseAckID(id string) (uint64, string, error) {
+	v, name, ok := strings.Cut(id, ":")
+	tag, err := strconv.ParseUint(v, 10, 64)
+	if !ok || err != nil || name == "" {
+		return 0, "", fmt.Errorf("invalid ack id %q", id)
+	}
+	return tag, name, nil
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
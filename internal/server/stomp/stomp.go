@@ -0,0 +1,465 @@
+// Package stomp serves the broker over STOMP 1.2, so that STOMP clients
+// connect without an adapter. Destinations name queues, with or without a
+// /queue/ prefix. Subscriptions acknowledge automatically or, with
+// ack:client-individual, one message at a time.
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/filter"
+	"github.com/IgorLem99/simple_broker/internal/server/listen"
+)
+
+// heartbeat is how often the server offers to send heart-beats and wants
+// to receive them. A client that sends nothing for twice the negotiated
+// period is disconnected.
+const heartbeat = 10 * time.Second
+
+// connectWait bounds the time a client may take to send CONNECT.
+const connectWait = 10 * time.Second
+
+const (
+	ackAuto             = "auto"
+	ackClientIndividual = "client-individual"
+)
+
+var (
+	errSubscriptionExists = errors.New("subscription already exists")
+	errNoSubscription     = errors.New("no such subscription")
+	errNoTransaction      = errors.New("no such transaction")
+	errTransactionExists  = errors.New("transaction already exists")
+)
+
+type Server struct {
+	*listen.Server
+}
+
+func New(addr string, b *broker.Broker) *Server {
+	return &Server{listen.New(addr, func(lc *listen.Conn) { newConn(b, lc).serve() })}
+}
+
+type conn struct {
+	*listen.Conn
+	broker *broker.Broker
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+	wg   sync.WaitGroup
+
+	// txs are the open transactions. Only the reading goroutine uses them.
+	txs map[string]*transaction
+}
+
+type subscription struct {
+	id          string
+	destination string
+	queue       string
+	q           *broker.Queue
+	sub         broker.Subscriber
+	auto        bool
+}
+
+// transaction holds what a client sent and acknowledged within a
+// transaction until it commits.
+type transaction struct {
+	msgs []broker.TxMessage
+	acks []func() error
+}
+
+func newConn(b *broker.Broker, lc *listen.Conn) *conn {
+	return &conn{
+		Conn:   lc,
+		broker: b,
+		subs:   make(map[string]*subscription),
+		txs:    make(map[string]*transaction),
+	}
+}
+
+// serve handles the frames of the client until it disconnects or an error
+// ends the connection.
+func (c *conn) serve() {
+	r := bufio.NewReaderSize(c, 64<<10)
+
+	_ = c.SetReadDeadline(time.Now().Add(connectWait))
+	f, err := readFrame(r)
+	for err == nil && f.command == "" {
+		f, err = readFrame(r)
+	}
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		c.reject(f, errors.New("expected CONNECT"))
+		return
+	}
+	send, recv, err := c.connect(f)
+	if err != nil {
+		c.reject(f, err)
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.Run(send, []byte{'\n'})
+	}()
+
+	defer func() {
+		c.mu.Lock()
+		for id, s := range c.subs {
+			delete(c.subs, id)
+			s.q.Unsubscribe(s.sub)
+		}
+		c.mu.Unlock()
+		// The writer flushes what is left and closes the connection.
+		c.End()
+		c.wg.Wait()
+	}()
+
+	for {
+		var deadline time.Time
+		if recv > 0 {
+			deadline = time.Now().Add(2 * recv)
+		}
+		_ = c.SetReadDeadline(deadline)
+
+		f, err := readFrame(r)
+		if err != nil {
+			var ne net.Error
+			if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &ne) {
+				c.fail(frame{}, err)
+			}
+			return
+		}
+		if f.command == "" {
+			continue
+		}
+		if err := c.handle(f); err != nil {
+			c.fail(f, err)
+			return
+		}
+		if f.command == "DISCONNECT" {
+			return
+		}
+	}
+}
+
+// connect negotiates the version and heart-beating, and answers with
+// CONNECTED. It returns how often the server has to send heart-beats and
+// how often the client does.
+func (c *conn) connect(f frame) (send, recv time.Duration, err error) {
+	supported := false
+	for _, v := range strings.Split(f.header["accept-version"], ",") {
+		supported = supported || strings.TrimSpace(v) == "1.2"
+	}
+	if !supported {
+		return 0, 0, errors.New("supported protocol versions are 1.2")
+	}
+
+	if v := f.header["heart-beat"]; v != "" {
+		cx, cy, ok := strings.Cut(v, ",")
+		canSend, err1 := strconv.Atoi(cx)
+		wants, err2 := strconv.Atoi(cy)
+		if !ok || err1 != nil || err2 != nil || canSend < 0 || wants < 0 {
+			return 0, 0, fmt.Errorf("invalid heart-beat %q", v)
+		}
+		if wants > 0 {
+			send = max(heartbeat, time.Duration(wants)*time.Millisecond)
+		}
+		if canSend > 0 {
+			recv = max(heartbeat, time.Duration(canSend)*time.Millisecond)
+		}
+	}
+
+	ms := strconv.FormatInt(heartbeat.Milliseconds(), 10)
+	reply := newFrame("CONNECTED", "version", "1.2", "heart-beat", ms+","+ms, "server", "simple_broker")
+	_ = c.SetWriteDeadline(time.Now().Add(listen.WriteWait))
+	if _, err := c.Write(reply.encode()); err != nil {
+		return 0, 0, err
+	}
+	return send, recv, nil
+}
+
+// reject answers a failed CONNECT with an ERROR frame and closes the
+// connection.
+func (c *conn) reject(f frame, err error) {
+	reply := errorFrame(f, err)
+	reply.header["version"] = "1.2"
+	_ = c.SetWriteDeadline(time.Now().Add(listen.WriteWait))
+	_, _ = c.Write(reply.encode())
+	_ = c.Close()
+}
+
+// fail sends an ERROR frame for f, after which the connection ends.
+func (c *conn) fail(f frame, err error) {
+	if c.Send(errorFrame(f, err).encode()) {
+		c.End()
+	}
+}
+
+func errorFrame(f frame, err error) frame {
+	reply := newFrame("ERROR", "message", err.Error(), "content-type", "text/plain")
+	if id, ok := f.header["receipt"]; ok {
+		reply.header["receipt-id"] = id
+	}
+	reply.body = []byte(err.Error())
+	return reply
+}
+
+// handle carries out a frame of the client and sends the receipt it asks
+// for.
+func (c *conn) handle(f frame) error {
+	var err error
+	switch f.command {
+	case "SEND":
+		err = c.publish(f)
+	case "SUBSCRIBE":
+		var s *subscription
+		if s, err = c.subscribe(f); err == nil {
+			// Deliveries start after the receipt.
+			defer c.start(s)
+		}
+	case "UNSUBSCRIBE":
+		err = c.unsubscribe(f)
+	case "ACK", "NACK":
+		err = c.ack(f)
+	case "BEGIN":
+		err = c.begin(f)
+	case "COMMIT":
+		err = c.commit(f)
+	case "ABORT":
+		_, err = c.transaction(f)
+		delete(c.txs, f.header["transaction"])
+	case "DISCONNECT":
+	case "CONNECT", "STOMP":
+		err = errors.New("already connected")
+	default:
+		err = fmt.Errorf("unknown command %s", f.command)
+	}
+	if err != nil {
+		return err
+	}
+
+	if id, ok := f.header["receipt"]; ok {
+		c.Send(newFrame("RECEIPT", "receipt-id", id).encode())
+	}
+	return nil
+}
+
+// publish sends a message to the queue of its destination, or adds it to
+// its transaction. Duplicates are accepted like new messages.
+func (c *conn) publish(f frame) error {
+	name, err := queueName(f.header["destination"])
+	if err != nil {
+		return err
+	}
+	msg, err := toMessage(f)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := f.header["transaction"]; ok {
+		tx, err := c.transaction(f)
+		if err != nil {
+			return err
+		}
+		tx.msgs = append(tx.msgs, broker.TxMessage{Queue: name, Message: msg})
+		return nil
+	}
+
+	q, err := c.broker.GetQueue(name)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Send(msg); err != nil && err != broker.ErrDuplicate {
+		return err
+	}
+	return nil
+}
+
+// subscribe subscribes to the queue of a destination. Besides the standard
+// headers it takes group, a consumer group, and selector, a filter.
+func (c *conn) subscribe(f frame) (*subscription, error) {
+	id := f.header["id"]
+	if id == "" {
+		return nil, errors.New("missing subscription id")
+	}
+	name, err := queueName(f.header["destination"])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &subscription{id: id, destination: f.header["destination"], queue: name}
+	switch f.header["ack"] {
+	case "", ackAuto:
+		s.auto = true
+	case ackClientIndividual:
+	default:
+		return nil, fmt.Errorf("unsupported ack mode %q", f.header["ack"])
+	}
+
+	opts := []broker.SubscribeOption{broker.WithGroup(f.header["group"])}
+	if v := f.header["selector"]; v != "" {
+		sel, err := filter.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, broker.WithFilter(sel))
+	}
+
+	if s.q, err = c.broker.GetQueue(name); err != nil {
+		return nil, err
+	}
+	// Deliveries of queues that do not require acknowledgements have
+	// nothing to acknowledge, so client-individual could only mislead.
+	if !s.auto && !s.q.Info().RequireAck {
+		return nil, broker.ErrAckDisabled
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[id]; ok {
+		return nil, errSubscriptionExists
+	}
+	if s.sub, err = s.q.Subscribe(opts...); err != nil {
+		return nil, err
+	}
+	c.subs[id] = s
+	return s, nil
+}
+
+func (c *conn) start(s *subscription) {
+	c.wg.Add(1)
+	go c.deliver(s)
+}
+
+// deliver sends the deliveries of s to the client, acknowledging them right
+// away if s acknowledges automatically. If the broker ends the
+// subscription, the connection ends with an ERROR frame.
+func (c *conn) deliver(s *subscription) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case d, ok := <-s.sub:
+			if !ok {
+				c.mu.Lock()
+				ended := c.subs[s.id] == s
+				c.mu.Unlock()
+				if ended {
+					c.fail(frame{}, fmt.Errorf("subscription %s ended", s.id))
+				}
+				return
+			}
+			if !c.Send(messageFrame(s, d).encode()) {
+				return
+			}
+			if s.auto && d.Tag != 0 {
+				_ = s.q.Ack(d.Tag)
+			}
+		}
+	}
+}
+
+func (c *conn) unsubscribe(f frame) error {
+	id := f.header["id"]
+
+	c.mu.Lock()
+	s, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+	if !ok {
+		return errNoSubscription
+	}
+	s.q.Unsubscribe(s.sub)
+	return nil
+}
+
+// ack acknowledges or rejects a delivery, or does so when its transaction
+// commits. Rejected messages are requeued unless the frame has
+// requeue:false, in which case they are dead-lettered.
+func (c *conn) ack(f frame) error {
+	tag, name, err := parseAckID(f.header["id"])
+	if err != nil {
+		return err
+	}
+
+	apply := func() error {
+		if tag == 0 {
+			return nil
+		}
+		q, err := c.broker.GetQueue(name)
+		if err != nil {
+			return err
+		}
+		if f.command == "NACK" {
+			return q.Nack(f.header["requeue"] != "false", tag)
+		}
+		return q.Ack(tag)
+	}
+
+	if _, ok := f.header["transaction"]; ok {
+		tx, err := c.transaction(f)
+		if err != nil {
+			return err
+		}
+		tx.acks = append(tx.acks, apply)
+		return nil
+	}
+	return apply()
+}
+
+func (c *conn) begin(f frame) error {
+	id := f.header["transaction"]
+	if id == "" {
+		return errors.New("missing transaction")
+	}
+	if _, ok := c.txs[id]; ok {
+		return errTransactionExists
+	}
+	c.txs[id] = &transaction{}
+	return nil
+}
+
+// commit publishes the messages of a transaction, all of them or none, and
+// then applies its acknowledgements.
+func (c *conn) commit(f frame) error {
+	tx, err := c.transaction(f)
+	if err != nil {
+		return err
+	}
+	delete(c.txs, f.header["transaction"])
+
+	if len(tx.msgs) > 0 {
+		if _, err := c.broker.Publish(broker.Tx{Messages: tx.msgs}); err != nil {
+			return err
+		}
+	}
+	for _, apply := range tx.acks {
+		if err := apply(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) transaction(f frame) (*transaction, error) {
+	tx, ok := c.txs[f.header["transaction"]]
+	if !ok {
+		return nil, errNoTransaction
+	}
+	return tx, nil
+}
@@ -0,0 +1,206 @@
+package stomp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/server/listen/listentest"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// connect dials and sends CONNECT.
+func connect(t *testing.T, addr string) *client {
+	t.Helper()
+	c := dial(t, addr)
+	c.write(newFrame("CONNECT", "accept-version", "1.1,1.2", "host", "localhost"))
+	c.read("CONNECTED")
+	return c
+}
+
+func (c *client) write(frames ...frame) {
+	c.t.Helper()
+	var data []byte
+	for _, f := range frames {
+		data = append(data, f.encode()...)
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatalf("failed to write: %v", err)
+	}
+}
+
+// read reads the next frame and checks its command.
+func (c *client) read(command string) frame {
+	c.t.Helper()
+	for {
+		f, err := readFrame(c.r)
+		if err != nil {
+			c.t.Fatalf("failed to read: %v", err)
+		}
+		if f.command == "" {
+			continue
+		}
+		if f.command != command {
+			c.t.Fatalf("expected %s, got %s %v %q", command, f.command, f.header, f.body)
+		}
+		return f
+	}
+}
+
+func TestServer_Connect(t *testing.T) {
+	_, addr := listentest.Start(t, &config.Config{}, New)
+
+	t.Run("negotiates", func(t *testing.T) {
+		c := dial(t, addr)
+		c.write(newFrame("STOMP", "accept-version", "1.2", "heart-beat", "1000,0"))
+		f := c.read("CONNECTED")
+		if f.header["version"] != "1.2" || f.header["heart-beat"] != "10000,10000" {
+			t.Errorf("unexpected headers %v", f.header)
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		c := dial(t, addr)
+		c.write(newFrame("CONNECT", "accept-version", "1.0"))
+		if f := c.read("ERROR"); f.header["version"] != "1.2" {
+			t.Errorf("expected supported version 1.2, got %v", f.header)
+		}
+		if _, err := readFrame(c.r); err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+}
+
+func TestServer_Subscribe(t *testing.T) {
+	b, addr := listentest.Start(t, &config.Config{Queues: []config.QueueConfig{{Name: "q", Size: 10, MaxSub: 1, RequireAck: true}}}, New)
+	q, _ := b.GetQueue("q")
+	c := connect(t, addr)
+
+	c.write(newFrame("SUBSCRIBE", "id", "0", "destination", "/queue/q", "ack", "client-individual", "receipt", "r1"))
+	if f := c.read("RECEIPT"); f.header["receipt-id"] != "r1" {
+		t.Errorf("expected receipt r1, got %v", f.header)
+	}
+
+	text := newFrame("SEND", "destination", "q", "content-type", "text/plain", "type", "greeting")
+	text.body = []byte("hello: world")
+	obj := newFrame("SEND", "destination", "/queue/q")
+	obj.body = []byte(`{"n":1}`)
+	c.write(text, obj)
+
+	first := c.read("MESSAGE")
+	if string(first.body) != "hello: world" || first.header["content-type"] != "text/plain" || first.header["type"] != "greeting" {
+		t.Errorf("unexpected message %v %q", first.header, first.body)
+	}
+	if first.header["subscription"] != "0" || first.header["destination"] != "/queue/q" || first.header["message-id"] == "" {
+		t.Errorf("unexpected message headers %v", first.header)
+	}
+	second := c.read("MESSAGE")
+	if string(second.body) != `{"n":1}` || second.header["content-type"] != "application/json" {
+		t.Errorf("unexpected message %v %q", second.header, second.body)
+	}
+
+	// The message stays on the queue until it is acknowledged.
+	if info := q.Info(); info.Messages != 2 {
+		t.Errorf("expected 2 messages, got %d", info.Messages)
+	}
+	c.write(
+		newFrame("ACK", "id", first.header["ack"]),
+		newFrame("ACK", "id", second.header["ack"]),
+		newFrame("UNSUBSCRIBE", "id", "0", "receipt", "r2"),
+	)
+	c.read("RECEIPT")
+	if info := q.Info(); info.Messages != 0 || info.Subscribers != 0 {
+		t.Errorf("expected no messages and subscribers, got %d and %d", info.Messages, info.Subscribers)
+	}
+}
+
+func TestServer_Transaction(t *testing.T) {
+	b, addr := listentest.Start(t, &config.Config{Queues: []config.QueueConfig{
+		{Name: "a", Size: 10, MaxSub: 1},
+		{Name: "b", Size: 10, MaxSub: 1},
+	}}, New)
+	c := connect(t, addr)
+
+	first := newFrame("SEND", "destination", "a", "transaction", "tx")
+	first.body = []byte(`1`)
+	second := newFrame("SEND", "destination", "b", "transaction", "tx", "receipt", "sent")
+	second.body = []byte(`2`)
+	c.write(newFrame("BEGIN", "transaction", "tx"), first, second)
+	c.read("RECEIPT")
+
+	qa, _ := b.GetQueue("a")
+	qb, _ := b.GetQueue("b")
+	if qa.Info().Messages != 0 || qb.Info().Messages != 0 {
+		t.Fatalf("expected nothing sent before the commit")
+	}
+	c.write(newFrame("COMMIT", "transaction", "tx", "receipt", "committed"))
+	c.read("RECEIPT")
+	if qa.Info().Messages != 1 || qb.Info().Messages != 1 {
+		t.Errorf("expected a message on each queue after the commit")
+	}
+}
+
+func TestServer_Error(t *testing.T) {
+	_, addr := listentest.Start(t, &config.Config{Queues: []config.QueueConfig{{Name: "q", Size: 10, MaxSub: 1}}}, New)
+	c := connect(t, addr)
+
+	send := newFrame("SEND", "destination", "/queue/missing", "receipt", "r1")
+	send.body = []byte(`{}`)
+	c.write(send)
+	f := c.read("ERROR")
+	if f.header["receipt-id"] != "r1" || !strings.Contains(f.header["message"], broker.ErrQueueNotFound.Error()) {
+		t.Errorf("unexpected error %v", f.header)
+	}
+	if _, err := readFrame(c.r); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+
+	// Queues that do not require acknowledgements only take ack:auto.
+	c = connect(t, addr)
+	c.write(newFrame("SUBSCRIBE", "id", "0", "destination", "/queue/q", "ack", "client-individual"))
+	if f := c.read("ERROR"); !strings.Contains(f.header["message"], broker.ErrAckDisabled.Error()) {
+		t.Errorf("unexpected error %v", f.header)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("\r\nSEND\r\ndestination:a\\cb\r\nx:1\r\nx:2\r\n\r\nbody\x00\n" +
+		"SEND\ncontent-length:3\n\na\x00b\x00"))
+
+	if f, err := readFrame(r); err != nil || f.command != "" {
+		t.Fatalf("expected a heart-beat, got %v and %v", f, err)
+	}
+	f, err := readFrame(r)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if f.command != "SEND" || f.header["destination"] != "a:b" || f.header["x"] != "1" || string(f.body) != "body" {
+		t.Errorf("unexpected frame %v %q", f.header, f.body)
+	}
+	if f, _ := readFrame(r); f.command != "" {
+		t.Fatalf("expected a heart-beat, got %v", f)
+	}
+	if f, err = readFrame(r); err != nil || string(f.body) != "a\x00b" {
+		t.Errorf("expected a body with NUL, got %q and %v", f.body, err)
+	}
+}
@@ -0,0 +1,230 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+)
+
+// Frame types. Clients send the requests, the server the rest.
+const (
+	framePublish     = 0x01
+	frameSubscribe   = 0x02
+	frameUnsubscribe = 0x03
+	frameAck         = 0x04
+	frameNack        = 0x05
+	frameHeartbeat   = 0x06
+
+	frameOK      = 0x81
+	frameError   = 0x82
+	frameMessage = 0x83
+	frameEnd     = 0x84
+)
+
+// Subscribe flags.
+const (
+	subscribeFromOffset = 1 << iota
+	subscribeSince
+)
+
+// maxFrameSize bounds the length of a frame a client may send.
+const maxFrameSize = 16 << 20
+
+// headerSize is the length prefix, the type and the correlation ID.
+const headerSize = 9
+
+var (
+	errFrameSize  = errors.New("invalid frame size")
+	errShortFrame = errors.New("frame too short")
+)
+
+type frame struct {
+	typ  byte
+	id   uint32
+	body []byte
+}
+
+func readFrame(r *bufio.Reader) (frame, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return frame{}, err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n < headerSize-4 || n > maxFrameSize {
+		return frame{}, errFrameSize
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, err
+	}
+	return frame{typ: data[0], id: binary.BigEndian.Uint32(data[1:5]), body: data[5:]}, nil
+}
+
+// encoder builds a frame.
+type encoder struct {
+	buf []byte
+}
+
+func newFrame(typ byte, id uint32) *encoder {
+	e := &encoder{buf: make([]byte, headerSize, 64)}
+	e.buf[4] = typ
+	binary.BigEndian.PutUint32(e.buf[5:], id)
+	return e
+}
+
+func (e *encoder) uint8(v byte)    { e.buf = append(e.buf, v) }
+func (e *encoder) uint16(v uint16) { e.buf = binary.BigEndian.AppendUint16(e.buf, v) }
+func (e *encoder) uint32(v uint32) { e.buf = binary.BigEndian.AppendUint32(e.buf, v) }
+func (e *encoder) uint64(v uint64) { e.buf = binary.BigEndian.AppendUint64(e.buf, v) }
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+}
+
+// string writes s with a 2-byte length; longer strings are cut.
+func (e *encoder) string(s string) {
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+	e.uint16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// time writes t in nanoseconds since the Unix epoch, or 0 for the zero
+// time.
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.uint64(0)
+		return
+	}
+	e.uint64(uint64(t.UnixNano()))
+}
+
+// frame finishes the frame and returns it.
+func (e *encoder) frame() []byte {
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+	return e.buf
+}
+
+// decoder reads the body of a frame. Once the body runs out every read
+// returns a zero value and err is set.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errShortFrame
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint8() byte {
+	if b := d.next(1); d.err == nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); d.err == nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); d.err == nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); d.err == nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool { return d.uint8() != 0 }
+
+func (d *decoder) string() string { return string(d.next(int(d.uint16()))) }
+
+func (d *decoder) bytes() []byte { return d.next(int(d.uint32())) }
+
+func (d *decoder) time() time.Time {
+	if ns := d.uint64(); ns != 0 {
+		return time.Unix(0, int64(ns))
+	}
+	return time.Time{}
+}
+
+// encodeFields writes the fields of msg that publishers set: expiry,
+// priority, headers and payload.
+func encodeFields(e *encoder, msg broker.Message) {
+	var expires time.Time
+	if msg.ExpiresAt != nil {
+		expires = *msg.ExpiresAt
+	}
+	e.time(expires)
+	e.uint32(uint32(msg.Priority))
+	e.uint16(uint16(len(msg.Headers)))
+	for k, v := range msg.Headers {
+		e.string(k)
+		e.string(v)
+	}
+	e.bytes(msg.Payload)
+}
+
+func decodeFields(d *decoder, msg *broker.Message) {
+	if expires := d.time(); !expires.IsZero() {
+		msg.ExpiresAt = &expires
+	}
+	msg.Priority = int(d.uint32())
+	if n := int(d.uint16()); n > 0 {
+		msg.Headers = make(map[string]string, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			k := d.string()
+			msg.Headers[k] = d.string()
+		}
+	}
+	msg.Payload = d.bytes()
+}
+
+// messageFrame is a delivery to the subscription with the given ID.
+func messageFrame(id uint32, d broker.Delivery) []byte {
+	e := newFrame(frameMessage, id)
+	e.uint64(d.Tag)
+	e.bool(d.Redelivered)
+	e.string(d.Message.ID)
+	e.uint64(d.Message.Offset)
+	e.uint32(uint32(d.Message.Partition))
+	e.time(d.Message.Timestamp)
+	encodeFields(e, d.Message)
+	return e.frame()
+}
@@ -0,0 +1,308 @@
+// Package tcp serves the broker over a binary protocol on plain TCP, for
+// clients whose message rates make HTTP and JSON too heavy.
+//
+// Every frame is a 4-byte length followed by that many bytes: a 1-byte
+// frame type, a 4-byte correlation ID chosen by the client and a body.
+// Integers are big-endian, strings carry a 2-byte length and payloads a
+// 4-byte one. Clients may send any number of requests without waiting;
+// every request gets an OK or error frame with its correlation ID, in
+// order. Deliveries carry the correlation ID of the subscribe request.
+package tcp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/filter"
+	"github.com/IgorLem99/simple_broker/internal/server/listen"
+)
+
+// idleTimeout is how long a client may send nothing before it is
+// disconnected. Clients that only consume send heartbeats.
+const idleTimeout = time.Minute
+
+var (
+	errSubscriptionExists = errors.New("subscription already exists")
+	errNoSubscription     = errors.New("no such subscription")
+	errInvalidPayload     = errors.New("payload is not valid JSON")
+)
+
+// badRequest is an error in the request itself.
+type badRequest struct{ error }
+
+type Server struct {
+	*listen.Server
+}
+
+func New(addr string, b *broker.Broker) *Server {
+	return &Server{listen.New(addr, func(lc *listen.Conn) { newConn(b, lc).serve() })}
+}
+
+type conn struct {
+	*listen.Conn
+	broker *broker.Broker
+
+	mu   sync.Mutex
+	subs map[uint32]*subscription
+	wg   sync.WaitGroup
+}
+
+type subscription struct {
+	q   *broker.Queue
+	sub broker.Subscriber
+}
+
+func newConn(b *broker.Broker, lc *listen.Conn) *conn {
+	return &conn{Conn: lc, broker: b, subs: make(map[uint32]*subscription)}
+}
+
+// serve handles the requests of the client until it goes away.
+func (c *conn) serve() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.Run(0, nil)
+	}()
+
+	defer func() {
+		_ = c.Close()
+		c.mu.Lock()
+		for id, s := range c.subs {
+			delete(c.subs, id)
+			s.q.Unsubscribe(s.sub)
+		}
+		c.mu.Unlock()
+		c.wg.Wait()
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(idleTimeout))
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if reply := c.handle(f); reply != nil && !c.Send(reply) {
+			return
+		}
+	}
+}
+
+// handle carries out a request and returns the reply, or nil if it was
+// already sent.
+func (c *conn) handle(f frame) []byte {
+	d := &decoder{buf: f.body}
+	var reply []byte
+	var err error
+	switch f.typ {
+	case framePublish:
+		reply, err = c.publish(f.id, d)
+	case frameSubscribe:
+		if err = c.subscribe(f.id, d); err == nil {
+			return nil
+		}
+	case frameUnsubscribe:
+		err = c.unsubscribe(d)
+	case frameAck, frameNack:
+		err = c.ack(f.typ == frameNack, d)
+	case frameHeartbeat:
+		return newFrame(frameHeartbeat, f.id).frame()
+	default:
+		return errorFrame(f.id, http.StatusBadRequest, "unknown frame type")
+	}
+
+	if err != nil {
+		return errorFrame(f.id, errorCode(err), err.Error())
+	}
+	if reply == nil {
+		reply = newFrame(frameOK, f.id).frame()
+	}
+	return reply
+}
+
+// publish sends a message to a queue. Publishing a duplicate answers with
+// the original message, like the HTTP API.
+func (c *conn) publish(id uint32, d *decoder) ([]byte, error) {
+	name := d.string()
+	msg := broker.Message{ID: d.string()}
+	decodeFields(d, &msg)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if !json.Valid(msg.Payload) {
+		return nil, errInvalidPayload
+	}
+
+	q, err := c.broker.GetQueue(name)
+	if err != nil {
+		return nil, err
+	}
+	if msg, err = q.Send(msg); err != nil && err != broker.ErrDuplicate {
+		return nil, err
+	}
+
+	e := newFrame(frameOK, id)
+	e.string(msg.ID)
+	e.uint64(msg.Offset)
+	e.uint32(uint32(msg.Partition))
+	return e.frame(), nil
+}
+
+// subscribe subscribes to a queue and forwards its deliveries until the
+// client unsubscribes or goes away. Unless it fails, it sends the reply
+// itself, which carries the subscriber ID.
+func (c *conn) subscribe(id uint32, d *decoder) error {
+	name := d.string()
+	opts := []broker.SubscribeOption{broker.WithGroup(d.string())}
+	expr := d.string()
+	flags := d.uint8()
+	offset := d.uint64()
+	since := d.time()
+	if d.err != nil {
+		return d.err
+	}
+	if flags&subscribeFromOffset != 0 {
+		opts = append(opts, broker.FromOffset(offset))
+	}
+	if flags&subscribeSince != 0 {
+		opts = append(opts, broker.Since(since))
+	}
+	if expr != "" {
+		f, err := filter.Parse(expr)
+		if err != nil {
+			return badRequest{err}
+		}
+		opts = append(opts, broker.WithFilter(f))
+	}
+
+	q, err := c.broker.GetQueue(name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if _, ok := c.subs[id]; ok {
+		c.mu.Unlock()
+		return errSubscriptionExists
+	}
+	sub, err := q.Subscribe(opts...)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	s := &subscription{q: q, sub: sub}
+	c.subs[id] = s
+	c.mu.Unlock()
+
+	// The reply goes out before the first delivery.
+	subID, _ := q.SubscriberID(sub)
+	e := newFrame(frameOK, id)
+	e.uint64(subID)
+	if c.Send(e.frame()) {
+		c.wg.Add(1)
+		go c.deliver(id, s)
+	}
+	return nil
+}
+
+// deliver forwards the deliveries of s. If the broker ends the
+// subscription, the client gets an end frame.
+func (c *conn) deliver(id uint32, s *subscription) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case d, ok := <-s.sub:
+			if !ok {
+				c.mu.Lock()
+				ended := c.subs[id] == s
+				if ended {
+					delete(c.subs, id)
+				}
+				c.mu.Unlock()
+				if ended {
+					c.Send(newFrame(frameEnd, id).frame())
+				}
+				return
+			}
+			if !c.Send(messageFrame(id, d)) {
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) unsubscribe(d *decoder) error {
+	id := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+
+	c.mu.Lock()
+	s, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+	if !ok {
+		return errNoSubscription
+	}
+	s.q.Unsubscribe(s.sub)
+	return nil
+}
+
+// ack acknowledges or, if nack is set, rejects deliveries on a queue.
+func (c *conn) ack(nack bool, d *decoder) error {
+	name := d.string()
+	requeue := nack && d.bool()
+	n := int(d.uint32())
+	if d.err == nil && len(d.buf) < 8*n {
+		return errShortFrame
+	}
+	tags := make([]uint64, n)
+	for i := range tags {
+		tags[i] = d.uint64()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	q, err := c.broker.GetQueue(name)
+	if err != nil {
+		return err
+	}
+	if nack {
+		return q.Nack(requeue, tags...)
+	}
+	return q.Ack(tags...)
+}
+
+func errorFrame(id uint32, code int, text string) []byte {
+	e := newFrame(frameError, id)
+	e.uint16(uint16(code))
+	e.string(text)
+	return e.frame()
+}
+
+// errorCode is the HTTP status the HTTP API answers err with.
+func errorCode(err error) int {
+	switch err {
+	case broker.ErrQueueNotFound, broker.ErrUnknownDelivery, errNoSubscription:
+		return http.StatusNotFound
+	case broker.ErrQueueFull, broker.ErrQueueClosed, broker.ErrTooManySub:
+		return http.StatusServiceUnavailable
+	case errSubscriptionExists:
+		return http.StatusConflict
+	case broker.ErrAckDisabled, broker.ErrPartitionedOffset, errShortFrame, errInvalidPayload:
+		return http.StatusBadRequest
+	}
+	if _, ok := err.(badRequest); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,165 @@
+package tcp
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/IgorLem99/simple_broker/internal/broker"
+	"github.com/IgorLem99/simple_broker/internal/config"
+	"github.com/IgorLem99/simple_broker/internal/server/listen/listentest"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) write(frames ...*encoder) {
+	c.t.Helper()
+	var data []byte
+	for _, e := range frames {
+		data = append(data, e.frame()...)
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatalf("failed to write: %v", err)
+	}
+}
+
+// read reads a frame and checks its type and correlation ID.
+func (c *client) read(typ byte, id uint32) *decoder {
+	c.t.Helper()
+	f, err := readFrame(c.r)
+	if err != nil {
+		c.t.Fatalf("failed to read: %v", err)
+	}
+	if f.typ != typ || f.id != id {
+		d := decoder{buf: f.body}
+		if f.typ == frameError {
+			c.t.Fatalf("expected frame %#x for %d, got error %d %q for %d", typ, id, d.uint16(), d.string(), f.id)
+		}
+		c.t.Fatalf("expected frame %#x for %d, got %#x for %d", typ, id, f.typ, f.id)
+	}
+	return &decoder{buf: f.body}
+}
+
+func publishFrame(id uint32, queue, payload string) *encoder {
+	e := newFrame(framePublish, id)
+	e.string(queue)
+	e.string("")
+	encodeFields(e, broker.Message{Payload: []byte(payload)})
+	return e
+}
+
+func subscribeFrame(id uint32, queue string) *encoder {
+	e := newFrame(frameSubscribe, id)
+	e.string(queue)
+	e.string("")
+	e.string("")
+	e.uint8(0)
+	e.uint64(0)
+	e.time(time.Time{})
+	return e
+}
+
+func TestServer_Publish(t *testing.T) {
+	b, addr := listentest.Start(t, &config.Config{Queues: []config.QueueConfig{{Name: "q", Size: 10, MaxSub: 1}}}, New)
+	c := dial(t, addr)
+
+	// Requests are pipelined and answered in order.
+	c.write(
+		publishFrame(1, "q", `{"n":1}`),
+		publishFrame(2, "missing", `{"n":2}`),
+		publishFrame(3, "q", `not json`),
+		publishFrame(4, "q", `{"n":3}`),
+		newFrame(frameHeartbeat, 5),
+	)
+
+	d := c.read(frameOK, 1)
+	if id, offset := d.string(), d.uint64(); id == "" || offset != 0 {
+		t.Errorf("expected an ID and offset 0, got %q and %d", id, offset)
+	}
+	d = c.read(frameError, 2)
+	if code := d.uint16(); code != http.StatusNotFound {
+		t.Errorf("expected code %d, got %d", http.StatusNotFound, code)
+	}
+	d = c.read(frameError, 3)
+	if code := d.uint16(); code != http.StatusBadRequest {
+		t.Errorf("expected code %d, got %d", http.StatusBadRequest, code)
+	}
+	d = c.read(frameOK, 4)
+	if _, offset := d.string(), d.uint64(); offset != 1 {
+		t.Errorf("expected offset 1, got %d", offset)
+	}
+	c.read(frameHeartbeat, 5)
+
+	q, _ := b.GetQueue("q")
+	if info := q.Info(); info.Messages != 2 {
+		t.Errorf("expected 2 messages, got %d", info.Messages)
+	}
+}
+
+func TestServer_Subscribe(t *testing.T) {
+	b, addr := listentest.Start(t, &config.Config{Queues: []config.QueueConfig{{Name: "q", Size: 10, MaxSub: 1, RequireAck: true}}}, New)
+	c := dial(t, addr)
+	q, _ := b.GetQueue("q")
+
+	c.write(subscribeFrame(7, "q"))
+	if subID := c.read(frameOK, 7).uint64(); subID == 0 {
+		t.Errorf("expected a subscriber ID")
+	}
+
+	headers := map[string]string{"type": "order"}
+	if _, err := q.Send(broker.Message{Headers: headers, Payload: []byte(`{"n":1}`)}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	d := c.read(frameMessage, 7)
+	tag, redelivered := d.uint64(), d.bool()
+	var msg broker.Message
+	msg.ID, msg.Offset, msg.Partition, msg.Timestamp = d.string(), d.uint64(), int(d.uint32()), d.time()
+	decodeFields(d, &msg)
+	if d.err != nil {
+		t.Fatalf("failed to decode message: %v", d.err)
+	}
+	if tag == 0 || redelivered || msg.Timestamp.IsZero() || msg.Headers["type"] != "order" || string(msg.Payload) != `{"n":1}` {
+		t.Errorf("unexpected delivery %d %v %+v", tag, redelivered, msg)
+	}
+
+	ack := newFrame(frameAck, 8)
+	ack.string("q")
+	ack.uint32(1)
+	ack.uint64(tag)
+	unsubscribe := newFrame(frameUnsubscribe, 9)
+	unsubscribe.uint32(7)
+	c.write(ack, unsubscribe, subscribeFrame(10, "q"), subscribeFrame(10, "q"))
+	c.read(frameOK, 8)
+	c.read(frameOK, 9)
+	c.read(frameOK, 10)
+	if code := c.read(frameError, 10).uint16(); code != http.StatusConflict {
+		t.Errorf("expected code %d, got %d", http.StatusConflict, code)
+	}
+	if info := q.Info(); info.Messages != 0 {
+		t.Errorf("expected no messages left, got %d", info.Messages)
+	}
+
+	// Deleting the queue ends the subscription.
+	if err := b.DeleteQueue("q"); err != nil {
+		t.Fatalf("failed to delete queue: %v", err)
+	}
+	c.read(frameEnd, 10)
+}
@@ -0,0 +1,461 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed  = errors.New("wal: log closed")
+	ErrCorrupt = errors.New("wal: corrupt record")
+)
+
+type SyncPolicy int
+
+const (
+	SyncAlways SyncPolicy = iota
+	SyncInterval
+	SyncNever
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "", "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("wal: unknown fsync policy %q", s)
+	}
+}
+
+const (
+	DefaultSegmentSize  = 64 << 20
+	DefaultSyncInterval = time.Second
+
+	headerSize = 8
+	segmentExt = ".log"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Options struct {
+	SegmentSize  int64
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+type segment struct {
+	first uint64
+	path  string
+}
+
+// Log is an append-only sequence of records split across segment files.
+// Every record is identified by a monotonically increasing sequence number
+// starting at 1.
+type Log struct {
+	mu       sync.Mutex
+	dir      string
+	opts     Options
+	segments []segment
+	file     *os.File
+	size     int64
+	next     uint64
+	dirty    bool
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// broken is the error that left a partial or unsynced record at the
+	// end of the active segment, after which nothing can be appended.
+	broken error
+}
+
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:      dir,
+		opts:     opts,
+		segments: segments,
+		next:     1,
+		done:     make(chan struct{}),
+	}
+
+	if len(segments) == 0 {
+		if err := l.createSegment(1); err != nil {
+			return nil, err
+		}
+	} else if err := l.openTail(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+
+	return l, nil
+}
+
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{first: first, path: filepath.Join(dir, name)})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+
+	return segments, nil
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+// openTail opens the last segment for appending. A partially written record
+// at the end of it (e.g. after a crash mid-write) is cut off.
+func (l *Log) openTail() error {
+	last := l.segments[len(l.segments)-1]
+
+	f, err := os.OpenFile(last.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var (
+		count uint64
+		valid int64
+	)
+	err = readRecords(f, func(data []byte) error {
+		count++
+		valid += headerSize + int64(len(data))
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrCorrupt) {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Truncate(valid); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = valid
+	l.next = last.first + count
+
+	return nil
+}
+
+func (l *Log) createSegment(first uint64) error {
+	path := segmentPath(l.dir, first)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if err := syncDir(l.dir); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	l.segments = append(l.segments, segment{first: first, path: path})
+	l.file = f
+	l.size = 0
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	return d.Sync()
+}
+
+func (l *Log) roll() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.dirty = false
+
+	return l.createSegment(l.next)
+}
+
+// Append writes data as a new record and returns its sequence number.
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+	if l.broken != nil {
+		return 0, l.broken
+	}
+
+	recSize := int64(headerSize + len(data))
+	if l.size > 0 && l.size+recSize > l.opts.SegmentSize {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := make([]byte, recSize)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[headerSize:], data)
+
+	if _, err := l.file.Write(buf); err != nil {
+		// Cut off the part of the record that made it to the file, or the
+		// next record would follow it and be lost on replay.
+		if terr := l.file.Truncate(l.size); terr != nil {
+			l.broken = terr
+		} else if _, serr := l.file.Seek(l.size, io.SeekStart); serr != nil {
+			l.broken = serr
+		}
+		return 0, err
+	}
+	l.size += recSize
+
+	if l.opts.Sync == SyncAlways {
+		if err := l.file.Sync(); err != nil {
+			// Whether the record reached the disk is unknown, and the next
+			// sync could report success for it.
+			l.broken = err
+			return 0, err
+		}
+	} else {
+		l.dirty = true
+	}
+
+	seq := l.next
+	l.next++
+
+	return seq, nil
+}
+
+// Replay calls fn for every record in the log, oldest first.
+func (l *Log) Replay(fn func(seq uint64, data []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	for _, s := range l.segments {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return err
+		}
+
+		seq := s.first
+		err = readRecords(f, func(data []byte) error {
+			if err := fn(seq, data); err != nil {
+				return err
+			}
+			seq++
+			return nil
+		})
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readRecords calls fn for every record of a segment file. A record that
+// claims to be longer than the rest of the file is corrupt.
+func readRecords(f *os.File, fn func(data []byte) error) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	remaining := fi.Size()
+
+	br := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return ErrCorrupt
+			}
+			return err
+		}
+
+		n := int64(binary.LittleEndian.Uint32(header[0:4]))
+		if n > remaining-headerSize {
+			return ErrCorrupt
+		}
+		remaining -= headerSize + n
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ErrCorrupt
+			}
+			return err
+		}
+
+		if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return ErrCorrupt
+		}
+
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+}
+
+// Truncate removes segments that only contain records older than seq.
+// The active segment is never removed.
+func (l *Log) Truncate(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	n := 0
+	for n < len(l.segments)-1 && l.segments[n+1].first <= seq {
+		if err := os.Remove(l.segments[n].path); err != nil {
+			return err
+		}
+		n++
+	}
+	l.segments = l.segments[n:]
+
+	return nil
+}
+
+// Truncatable reports whether Truncate(seq) would remove any segment.
+func (l *Log) Truncatable(seq uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.segments) > 1 && l.segments[1].first <= seq
+}
+
+// NextSeq returns the sequence number the next appended record will get.
+func (l *Log) NextSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.next
+}
+
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	return l.sync()
+}
+
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+
+	return l.file.Sync()
+}
+
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			_ = l.Sync()
+		}
+	}
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+
+	l.wg.Wait()
+
+	if err := l.file.Sync(); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
@@ -0,0 +1,285 @@
+package wal
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func readAll(t *testing.T, l *Log) ([]uint64, []string) {
+	t.Helper()
+	var (
+		seqs []uint64
+		data []string
+	)
+	err := l.Replay(func(seq uint64, d []byte) error {
+		seqs = append(seqs, seq)
+		data = append(data, string(d))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	return seqs, data
+}
+
+func TestLog_AppendReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+
+	for i, rec := range []string{"a", "b", "c"} {
+		seq, err := l.Append([]byte(rec))
+		if err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+		if seq != uint64(i+1) {
+			t.Errorf("expected seq %d, got %d", i+1, seq)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen log: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	seqs, data := readAll(t, l)
+	if !reflect.DeepEqual(seqs, []uint64{1, 2, 3}) {
+		t.Errorf("unexpected seqs %v", seqs)
+	}
+	if !reflect.DeepEqual(data, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected records %v", data)
+	}
+
+	seq, err := l.Append([]byte("d"))
+	if err != nil {
+		t.Fatalf("append after reopen failed: %v", err)
+	}
+	if seq != 4 {
+		t.Errorf("expected seq 4 after reopen, got %d", seq)
+	}
+}
+
+func TestLog_TornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	if _, err := l.Append([]byte("complete")); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// Simulate a crash in the middle of writing the second record.
+	f, err := os.OpenFile(segmentPath(dir, 1), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	if _, err := f.Write([]byte{42, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatalf("failed to write garbage: %v", err)
+	}
+	_ = f.Close()
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen log: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	_, data := readAll(t, l)
+	if !reflect.DeepEqual(data, []string{"complete"}) {
+		t.Errorf("expected torn record to be dropped, got %v", data)
+	}
+	if seq, _ := l.Append([]byte("next")); seq != 2 {
+		t.Errorf("expected seq 2, got %d", seq)
+	}
+}
+
+func TestLog_SegmentsAndTruncate(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{SegmentSize: 20})
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	for i := 0; i < 5; i++ {
+		if _, err := l.Append([]byte("0123456789")); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	if got := len(l.segments); got != 5 {
+		t.Fatalf("expected 5 segments, got %d", got)
+	}
+
+	if l.Truncatable(1) {
+		t.Error("nothing should be truncatable before seq 1")
+	}
+	if !l.Truncatable(3) {
+		t.Error("expected segments before seq 3 to be truncatable")
+	}
+	if err := l.Truncate(3); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+
+	seqs, _ := readAll(t, l)
+	if !reflect.DeepEqual(seqs, []uint64{3, 4, 5}) {
+		t.Errorf("unexpected seqs after truncate %v", seqs)
+	}
+
+	if err := l.Truncate(100); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	if got := len(l.segments); got != 1 {
+		t.Errorf("active segment must be kept, got %d segments", got)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := map[string]SyncPolicy{
+		"":         SyncAlways,
+		"always":   SyncAlways,
+		"interval": SyncInterval,
+		"never":    SyncNever,
+	}
+	for in, want := range tests {
+		got, err := ParseSyncPolicy(in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", in, err)
+		}
+		if got != want {
+			t.Errorf("%q: expected %v, got %v", in, want, got)
+		}
+	}
+
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("expected an error for unknown policy")
+	}
+}
+
+func TestLog_Closed(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{Sync: SyncInterval})
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if _, err := l.Append([]byte("x")); err != ErrClosed {
+		t.Errorf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestLog_CorruptLength(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	if _, err := l.Append([]byte("complete")); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// A header claiming a 4 GiB record must not be trusted.
+	f, err := os.OpenFile(segmentPath(dir, 1), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	if _, err := f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1}); err != nil {
+		t.Fatalf("failed to write garbage: %v", err)
+	}
+	_ = f.Close()
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen log: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	if _, data := readAll(t, l); !reflect.DeepEqual(data, []string{"complete"}) {
+		t.Errorf("expected the corrupt record to be dropped, got %v", data)
+	}
+}
+
+func TestLog_FailedAppend(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	if _, err := l.Append([]byte("complete")); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+
+	// Writes to a read-only file fail, and so does cutting it back, which
+	// leaves the log unable to append.
+	active := l.file
+	if l.file, err = os.Open(segmentPath(dir, 1)); err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	defer func() { _ = active.Close() }()
+	if _, err := l.Append([]byte("failed")); err == nil {
+		t.Fatalf("expected the append to fail")
+	}
+	l.file, active = active, l.file
+	if _, err := l.Append([]byte("next")); err == nil {
+		t.Errorf("expected appends to fail once the log is broken")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen log: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	if _, data := readAll(t, l); !reflect.DeepEqual(data, []string{"complete"}) {
+		t.Errorf("unexpected records %v", data)
+	}
+}
+
+func TestLog_FailedSync(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	// Pipes take writes but cannot be synced.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+	defer func() { _ = w.Close() }()
+	active := l.file
+	l.file = w
+	_, err = l.Append([]byte("unsynced"))
+	l.file = active
+	if err == nil {
+		t.Fatalf("expected the append to fail")
+	}
+	if _, err := l.Append([]byte("next")); err == nil {
+		t.Errorf("expected appends to fail once a sync failed")
+	}
+}
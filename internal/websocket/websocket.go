@@ -0,0 +1,446 @@
+// Package websocket implements the WebSocket protocol (RFC 6455) with the
+// standard library: the server side of the handshake, a minimal client,
+// and message framing with fragmentation and control frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+const (
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Close codes.
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseInvalidData   = 1007
+	ClosePolicy        = 1008
+	CloseTooBig        = 1009
+	CloseInternalError = 1011
+	CloseTryAgainLater = 1013
+
+	// closeNoStatus is reported for close frames without a code. It is
+	// never sent.
+	closeNoStatus = 1005
+)
+
+// DefaultReadLimit bounds the size of a message unless SetReadLimit
+// changes it.
+const DefaultReadLimit = 1 << 20
+
+// writeWait bounds the time a frame may take to write.
+const writeWait = 10 * time.Second
+
+// acceptGUID is appended to the key of a handshake to derive the accept
+// value.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrBadHandshake  = errors.New("websocket: bad handshake")
+	ErrMessageTooBig = errors.New("websocket: message too big")
+	ErrClosed        = errors.New("websocket: close sent")
+)
+
+// CloseError is returned by ReadMessage once the peer closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", e.Code, e.Reason)
+}
+
+// protocolError is a frame that breaks the protocol. The connection is
+// closed with code.
+type protocolError struct {
+	code int
+	msg  string
+}
+
+func (e *protocolError) Error() string {
+	return "websocket: " + e.msg
+}
+
+// Conn is a WebSocket connection. ReadMessage must be called from one
+// goroutine at a time; the write methods may be called concurrently.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool
+	limit  int64
+	pong   func(data []byte)
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// Upgrade turns an HTTP request into a WebSocket connection. If the request
+// is not a valid handshake it answers with an error status and returns
+// ErrBadHandshake.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Dial opens a client connection to a ws:// URL. The header is sent with
+// the handshake.
+func Dial(url string, header http.Header) (*Conn, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch req.URL.Scheme {
+	case "ws":
+		req.URL.Scheme = "http"
+	case "http":
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", req.URL.Scheme)
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	key := base64.StdEncoding.EncodeToString(b)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(host, "80")
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		_ = resp.Body.Close()
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrBadHandshake, resp.Status)
+	}
+
+	return newConn(conn, br, true), nil
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{conn: conn, br: br, client: client, limit: DefaultReadLimit}
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether a comma-separated header has token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetReadLimit bounds the size of the messages ReadMessage accepts. A
+// bigger message closes the connection.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.limit = limit
+}
+
+// SetPongHandler sets a function that ReadMessage calls with every pong it
+// reads.
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pong = h
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message. It answers pings
+// and close frames on the way. Once the peer closed the connection it
+// returns a *CloseError.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var (
+		msgType int
+		msg     []byte
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			var pe *protocolError
+			switch {
+			case errors.As(err, &pe):
+				_ = c.WriteClose(pe.code, pe.msg)
+			case err == ErrMessageTooBig:
+				_ = c.WriteClose(CloseTooBig, "")
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.pong != nil {
+				c.pong(payload)
+			}
+			continue
+		case opClose:
+			ce := &CloseError{Code: closeNoStatus}
+			if len(payload) >= 2 {
+				ce.Code = int(binary.BigEndian.Uint16(payload))
+				ce.Reason = string(payload[2:])
+			}
+			code := ce.Code
+			if code == closeNoStatus {
+				code = CloseNormal
+			}
+			_ = c.WriteClose(code, "")
+			return 0, nil, ce
+		case TextMessage, BinaryMessage:
+			if msgType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			msgType = op
+		case opContinuation:
+			if msgType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if int64(len(msg)+len(payload)) > c.limit {
+			_ = c.WriteClose(CloseTooBig, "")
+			return 0, nil, ErrMessageTooBig
+		}
+		msg = append(msg, payload...)
+
+		if fin {
+			if msgType == TextMessage && !utf8.Valid(msg) {
+				return 0, nil, c.fail(CloseInvalidData, "invalid utf-8")
+			}
+			return msgType, msg, nil
+		}
+	}
+}
+
+// fail closes the connection with code and returns the matching error.
+func (c *Conn) fail(code int, msg string) error {
+	_ = c.WriteClose(code, msg)
+	return &protocolError{code: code, msg: msg}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *Conn) readFrame() (fin bool, op int, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	op = int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &protocolError{CloseProtocolError, "reserved bits set"}
+	}
+	if masked == c.client {
+		return false, 0, nil, &protocolError{CloseProtocolError, "wrong masking"}
+	}
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if op >= opClose && (n > 125 || !fin) {
+		return false, 0, nil, &protocolError{CloseProtocolError, "invalid control frame"}
+	}
+	if n > uint64(c.limit) {
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, op, payload, nil
+}
+
+// WriteMessage sends data as one message of the given type.
+func (c *Conn) WriteMessage(msgType int, data []byte) error {
+	return c.writeFrame(msgType, data)
+}
+
+// Ping sends a ping; the peer answers with a pong carrying data.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(opPing, data)
+}
+
+// WriteClose starts the closing handshake. Nothing can be written after it.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+
+	return c.writeFrame(opClose, payload)
+}
+
+func (c *Conn) writeFrame(op int, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|byte(op))
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close closes the underlying connection without a closing handshake.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
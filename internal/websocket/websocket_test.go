@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer echoes every message back until the client closes.
+func echoServer(t *testing.T, limit int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if limit > 0 {
+			conn.SetReadLimit(limit)
+		}
+
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dial(t *testing.T, srv *httptest.Server) *Conn {
+	t.Helper()
+	conn, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	return conn
+}
+
+// rawFrame builds a masked client frame by hand.
+func rawFrame(first byte, payload string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+func TestConn_Echo(t *testing.T) {
+	srv := echoServer(t, 0)
+	conn := dial(t, srv)
+
+	for _, msg := range []string{"hello", strings.Repeat("x", 200), strings.Repeat("y", 70000)} {
+		if err := conn.WriteMessage(TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		typ, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if typ != TextMessage || string(got) != msg {
+			t.Errorf("expected text of %d bytes, got type %d with %d bytes", len(msg), typ, len(got))
+		}
+	}
+}
+
+func TestConn_Fragments(t *testing.T) {
+	srv := echoServer(t, 0)
+	conn := dial(t, srv)
+
+	// A ping between the fragments is answered right away.
+	var frames []byte
+	frames = append(frames, rawFrame(TextMessage, "hel")...)
+	frames = append(frames, rawFrame(0x80|opPing, "p")...)
+	frames = append(frames, rawFrame(0x80|opContinuation, "lo")...)
+	if _, err := conn.conn.Write(frames); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	var pong string
+	conn.SetPongHandler(func(data []byte) { pong = string(data) })
+	_, got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(got) != "hello" || pong != "p" {
+		t.Errorf("expected hello after pong p, got %q after pong %q", got, pong)
+	}
+}
+
+func TestConn_Close(t *testing.T) {
+	t.Run("handshake", func(t *testing.T) {
+		srv := echoServer(t, 0)
+		conn := dial(t, srv)
+
+		if err := conn.WriteClose(CloseNormal, "bye"); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+		var ce *CloseError
+		if _, _, err := conn.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseNormal {
+			t.Errorf("expected close %d, got %v", CloseNormal, err)
+		}
+		if err := conn.WriteMessage(TextMessage, []byte("late")); err != ErrClosed {
+			t.Errorf("expected error %v, got %v", ErrClosed, err)
+		}
+	})
+
+	t.Run("message too big", func(t *testing.T) {
+		srv := echoServer(t, 10)
+		conn := dial(t, srv)
+
+		if err := conn.WriteMessage(TextMessage, []byte(strings.Repeat("x", 11))); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		var ce *CloseError
+		if _, _, err := conn.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseTooBig {
+			t.Errorf("expected close %d, got %v", CloseTooBig, err)
+		}
+	})
+
+	t.Run("unmasked frame", func(t *testing.T) {
+		srv := echoServer(t, 0)
+		conn := dial(t, srv)
+
+		if _, err := conn.conn.Write([]byte{0x80 | TextMessage, 2, 'h', 'i'}); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		var ce *CloseError
+		if _, _, err := conn.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseProtocolError {
+			t.Errorf("expected close %d, got %v", CloseProtocolError, err)
+		}
+	})
+}
+
+func TestUpgrade_BadHandshake(t *testing.T) {
+	srv := echoServer(t, 0)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("expected status %d with version 13, got %d", http.StatusUpgradeRequired, resp.StatusCode)
+	}
+}